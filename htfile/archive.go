@@ -0,0 +1,268 @@
+package htfile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+)
+
+const (
+	archiveFormatKey  = "format"
+	archiveIncludeKey = "include"
+	archiveExcludeKey = "exclude"
+	formatTar         = "tar"
+	formatTarGz       = "tar.gz"
+	formatZip         = "zip"
+	defaultFileMode   = os.FileMode(0644)
+	defaultDirMode    = os.FileMode(0755)
+)
+
+var (
+	headerContentDisposition = http.CanonicalHeaderKey("content-disposition")
+	archiveContentTypes      = map[string]string{
+		formatTar:   "application/x-tar",
+		formatTarGz: "application/gzip",
+		formatZip:   "application/zip"}
+	invalidPattern = errors.New("Invalid pattern.")
+)
+
+type archiveWriter interface {
+	add(name string, fi os.FileInfo, ext bool, link string) (io.Writer, error)
+	Close() error
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+type nameFilter struct {
+	include []string
+	exclude []string
+}
+
+// without the extended properties, the mode, the owner and the access and change times are not revealed,
+// following the rules of the property maps
+func publicMode(fi os.FileInfo) os.FileMode {
+	if fi.IsDir() {
+		return os.ModeDir | defaultDirMode
+	}
+	return fi.Mode()&^os.ModePerm | defaultFileMode
+}
+
+func newTarArchive(w io.Writer, compress bool) *tarArchive {
+	ta := new(tarArchive)
+	if compress {
+		ta.gz = gzip.NewWriter(w)
+		w = ta.gz
+	}
+	ta.tw = tar.NewWriter(w)
+	return ta
+}
+
+func (ta *tarArchive) add(name string, fi os.FileInfo, ext bool, link string) (io.Writer, error) {
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	if !ext {
+		hdr.Mode = int64(publicMode(fi).Perm())
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = fi.ModTime(), fi.ModTime()
+	}
+	return ta.tw, ta.tw.WriteHeader(hdr)
+}
+
+func (ta *tarArchive) Close() error {
+	err := ta.tw.Close()
+	if err != nil || ta.gz == nil {
+		return err
+	}
+	return ta.gz.Close()
+}
+
+func (za *zipArchive) add(name string, fi os.FileInfo, ext bool, link string) (io.Writer, error) {
+	zh, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return nil, err
+	}
+	zh.Name = name
+	if !ext {
+		zh.SetMode(publicMode(fi))
+	}
+	if fi.Mode().IsRegular() {
+		zh.Method = zip.Deflate
+	}
+	wr, err := za.zw.CreateHeader(zh)
+	if err != nil || link == "" {
+		return wr, err
+	}
+
+	// symlinks are stored with the target as content
+	_, err = io.WriteString(wr, link)
+	return wr, err
+}
+
+func (za *zipArchive) Close() error { return za.zw.Close() }
+
+func getQryPatterns(qry url.Values, key string) ([]string, error) {
+	ps := qry[key]
+	for _, p := range ps {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, invalidPattern
+		}
+	}
+	return ps, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if m, _ := path.Match(p, name); m {
+			return true
+		}
+	}
+	return false
+}
+
+// exclusion applies to directories, too, inclusion only to files
+func (nf *nameFilter) match(fi os.FileInfo) bool {
+	if matchAny(nf.exclude, fi.Name()) {
+		return false
+	}
+	return fi.IsDir() || len(nf.include) == 0 || matchAny(nf.include, fi.Name())
+}
+
+// entries that cannot be read are skipped, only write errors abort the archive
+func writeArchive(aw archiveWriter, u *user.User, p, name string, fi os.FileInfo, nf *nameFilter) error {
+	own, err := isOwner(u, fi)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.IsDir():
+		d, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		fis, err := d.Readdir(0)
+		share.Doretlog42(d.Close)
+		if err != nil {
+			return nil
+		}
+		_, err = aw.add(name+"/", fi, own, "")
+		if err != nil {
+			return err
+		}
+		sort.Sort(byName(fis))
+		for _, fii := range fis {
+			if !nf.match(fii) {
+				continue
+			}
+			err = writeArchive(aw, u, path.Join(p, fii.Name()), name+"/"+fii.Name(), fii, nf)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case fi.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(p)
+		if err != nil {
+			return nil
+		}
+		_, err = aw.add(name, fi, own, link)
+		return err
+	case fi.Mode().IsRegular():
+		f, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer share.Doretlog42(f.Close)
+		wr, err := aw.add(name, fi, own, "")
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(wr, f, fi.Size())
+		return err
+	default:
+		return nil
+	}
+}
+
+type byName []os.FileInfo
+
+func (fis byName) Len() int           { return len(fis) }
+func (fis byName) Less(i, j int) bool { return fis[i].Name() < fis[j].Name() }
+func (fis byName) Swap(i, j int)      { fis[i], fis[j] = fis[j], fis[i] }
+
+func (h *handler) archivef(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	formats := qry[archiveFormatKey]
+	format := formatTar
+	if len(formats) > 0 {
+		format = formats[0]
+	}
+	ct, ok := archiveContentTypes[format]
+	if !share.CheckBadReq(w, len(formats) <= 1 && ok) {
+		return
+	}
+	nf := new(nameFilter)
+	nf.include, err = getQryPatterns(qry, archiveIncludeKey)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	nf.exclude, err = getQryPatterns(qry, archiveExcludeKey)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	fi, err := os.Lstat(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	u, err := user.Current()
+	if !share.CheckServerError(w, u != nil && err == nil) {
+		return
+	}
+
+	name := path.Base(p)
+	header := w.Header()
+	header.Set(share.HeaderContentType, ct)
+	header.Set(headerContentDisposition, fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	if r.Method == "HEAD" {
+		return
+	}
+
+	// the archive is streamed, once started, errors can only be signaled by closing the connection
+	var aw archiveWriter
+	switch format {
+	case formatZip:
+		aw = &zipArchive{zw: zip.NewWriter(w)}
+	default:
+		aw = newTarArchive(w, format == formatTarGz)
+	}
+	err = writeArchive(aw, u, p, name, fi, nf)
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,194 @@
+package htfile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	tst "github.com/aryszka/tasked/testing"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func makeArchiveTree(t *testing.T) string {
+	dir := path.Join(dn, "archive")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, path.Join(dir, "sub"))
+	tst.EnsureDirF(t, path.Join(dir, "skip"))
+	for _, n := range []string{"file0.txt", "file1.log", "sub/file2.txt", "skip/file3.txt"} {
+		content := "content of " + n
+		tst.WithNewFileF(t, path.Join(dir, n), func(f *os.File) error {
+			_, err := f.Write([]byte(content))
+			return err
+		})
+	}
+	err := os.Symlink("file0.txt", path.Join(dir, "link"))
+	tst.ErrFatal(t, err)
+	return dir
+}
+
+func getArchive(t *testing.T, qry string) []byte {
+	var b []byte
+	tst.Htreq(t, "GET", tst.S.URL+"/archive?"+qry, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		var err error
+		b, err = ioutil.ReadAll(rsp.Body)
+		tst.ErrFatal(t, err)
+	})
+	return b
+}
+
+func readTar(t *testing.T, r io.Reader) map[string]string {
+	entries := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		tst.ErrFatal(t, err)
+		if hdr.Typeflag == tar.TypeSymlink {
+			entries[hdr.Name] = "-> " + hdr.Linkname
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		tst.ErrFatal(t, err)
+		entries[hdr.Name] = string(b)
+	}
+}
+
+func checkEntries(t *testing.T, entries, expect map[string]string) {
+	if len(entries) != len(expect) {
+		t.Log(entries)
+		t.Fail()
+	}
+	for n, c := range expect {
+		if ec, ok := entries[n]; !ok || ec != c {
+			t.Log(n, ec)
+			t.Fail()
+		}
+	}
+}
+
+var allArchiveEntries = map[string]string{
+	"archive/":               "",
+	"archive/file0.txt":      "content of file0.txt",
+	"archive/file1.log":      "content of file1.log",
+	"archive/link":           "-> file0.txt",
+	"archive/skip/":          "",
+	"archive/skip/file3.txt": "content of skip/file3.txt",
+	"archive/sub/":           "",
+	"archive/sub/file2.txt":  "content of sub/file2.txt"}
+
+func TestArchiveInvalid(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeArchiveTree(t)
+	for _, qry := range []string{
+		"cmd=archive&format=rar",
+		"cmd=archive&format=tar&format=zip",
+		"cmd=archive&include=[",
+		"cmd=archive&exclude=["} {
+		tst.Htreq(t, "GET", tst.S.URL+"/archive?"+qry, nil, func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusBadRequest {
+				t.Log(qry, rsp.StatusCode)
+				t.Fail()
+			}
+		})
+	}
+	tst.Htreq(t, "GET", tst.S.URL+"/not-existing?cmd=archive", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusNotFound {
+			t.Fail()
+		}
+	})
+}
+
+func TestArchiveTar(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeArchiveTree(t)
+	tst.Htreq(t, "HEAD", tst.S.URL+"/archive?cmd=archive", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK ||
+			rsp.Header.Get("Content-Type") != "application/x-tar" ||
+			rsp.Header.Get("Content-Disposition") != `attachment; filename="archive.tar"` {
+			t.Fail()
+		}
+	})
+	checkEntries(t, readTar(t, bytes.NewBuffer(getArchive(t, "cmd=archive"))), allArchiveEntries)
+
+	// owner sees the real mode
+	tr := tar.NewReader(bytes.NewBuffer(getArchive(t, "cmd=archive&include=file1.log")))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		tst.ErrFatal(t, err)
+		fi, err := os.Lstat(path.Join(dn, hdr.Name))
+		tst.ErrFatal(t, err)
+		if hdr.Mode&int64(os.ModePerm) != int64(fi.Mode().Perm()) {
+			t.Fail()
+		}
+	}
+}
+
+func TestArchiveTarGz(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeArchiveTree(t)
+	gz, err := gzip.NewReader(bytes.NewBuffer(getArchive(t, "cmd=archive&format=tar.gz")))
+	tst.ErrFatal(t, err)
+	checkEntries(t, readTar(t, gz), allArchiveEntries)
+}
+
+func TestArchiveZip(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeArchiveTree(t)
+	b := getArchive(t, "cmd=archive&format=zip")
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	tst.ErrFatal(t, err)
+	entries := make(map[string]string)
+	for _, zf := range zr.File {
+		f, err := zf.Open()
+		tst.ErrFatal(t, err)
+		c, err := ioutil.ReadAll(f)
+		f.Close()
+		tst.ErrFatal(t, err)
+		if zf.Mode()&os.ModeSymlink != 0 {
+			entries[zf.Name] = "-> " + string(c)
+			continue
+		}
+		entries[zf.Name] = string(c)
+	}
+	checkEntries(t, entries, allArchiveEntries)
+}
+
+func TestArchiveFilter(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeArchiveTree(t)
+	checkEntries(t, readTar(t, bytes.NewBuffer(getArchive(t, "cmd=archive&include=*.txt&exclude=skip"))),
+		map[string]string{
+			"archive/":              "",
+			"archive/file0.txt":     "content of file0.txt",
+			"archive/sub/":          "",
+			"archive/sub/file2.txt": "content of sub/file2.txt"})
+	checkEntries(t, readTar(t, bytes.NewBuffer(getArchive(t, "cmd=archive&exclude=*.txt&exclude=link"))),
+		map[string]string{
+			"archive/":          "",
+			"archive/file1.log": "content of file1.log",
+			"archive/skip/":     "",
+			"archive/sub/":      ""})
+
+	// single file
+	tst.Htreq(t, "GET", tst.S.URL+"/archive/file0.txt?cmd=archive", nil, func(rsp *http.Response) {
+		checkEntries(t, readTar(t, rsp.Body), map[string]string{"file0.txt": "content of file0.txt"})
+	})
+}
@@ -0,0 +1,213 @@
+package htfile
+
+import (
+	"compress/gzip"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	gzipEncoding           = "gzip"
+	identityEncoding       = "identity"
+	precompressedExt       = ".gz"
+	defaultCompressMinSize = 1 << 10
+	gzipEtagSuffix         = "-" + gzipEncoding + "\""
+)
+
+var (
+	headerContentEncoding = http.CanonicalHeaderKey("content-encoding")
+	headerAcceptEncoding  = http.CanonicalHeaderKey("accept-encoding")
+
+	compressibleTypes = []string{
+		"text/*",
+		"application/json",
+		"application/javascript",
+		"application/x-javascript",
+		"application/xml",
+		ndjsonContentType,
+		"image/svg+xml"}
+)
+
+func compressible(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml") {
+		return true
+	}
+	for _, t := range compressibleTypes {
+		if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// tells whether the client accepts gzip encoding, either explicitly, or by the wildcard
+func acceptsGzip(r *http.Request) bool {
+	for _, a := range strings.Split(r.Header.Get(headerAcceptEncoding), ",") {
+		parts := strings.Split(a, ";")
+		enc := strings.ToLower(strings.TrimSpace(parts[0]))
+		if enc != gzipEncoding && enc != "x-gzip" && enc != "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compresses the successful responses of compressible types, when the client accepts it, and the length
+// of the response is unknown or not smaller than minSize. The decision is made when the header is written.
+type compressWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	minSize     int64
+	accepts     bool
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+// returns the etag of the gzip encoded representation
+func gzipEtag(et string) string {
+	if !strings.HasSuffix(et, "\"") || strings.HasSuffix(et, gzipEtagSuffix) {
+		return et
+	}
+	return et[:len(et)-1] + gzipEtagSuffix
+}
+
+// marks a response as gzip encoded. The content digest of the identity bytes doesn't apply, and the etag
+// gets a suffix, so that the conditional requests don't validate the identity representation.
+func setGzipEncoded(h http.Header) {
+	h.Set(headerContentEncoding, gzipEncoding)
+	h.Del(headerContentDigest)
+	if et := h.Get(share.HeaderEtag); et != "" {
+		h.Set(share.HeaderEtag, gzipEtag(et))
+	}
+}
+
+func (cw *compressWriter) compress(status int) bool {
+	h := cw.Header()
+	if status != http.StatusOK || h.Get(headerContentEncoding) != "" || !compressible(h.Get(share.HeaderContentType)) {
+		return false
+	}
+	if cl := h.Get(share.HeaderContentLength); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err == nil && n < cw.minSize {
+			return false
+		}
+	}
+	return true
+}
+
+// tells whether a whole file will be compressed, so that the etag of the compressed representation can be
+// set before the conditional headers of the request are evaluated
+func (cw *compressWriter) compressesFile(ct string, size int64) bool {
+	return cw.accepts && cw.r.Header.Get(headerRange) == "" && compressible(ct) && size >= cw.minSize
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	if cw.compress(status) {
+		h := cw.Header()
+		h.Add(headerVary, headerAcceptEncoding)
+		if cw.accepts {
+			h.Del(share.HeaderContentLength)
+			setGzipEncoded(h)
+			if cw.r.Method != "HEAD" {
+				cw.gz = gzip.NewWriter(cw.ResponseWriter)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.gz != nil {
+		share.Dolog(cw.gz.Flush)
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) close() {
+	if cw.gz != nil {
+		share.Dolog(cw.gz.Close)
+	}
+}
+
+// wraps the response writer, when compression is enabled. The returned function needs to be called at the
+// end of the response.
+func (h *handler) compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if h.compressMinSize < 0 {
+		return w, func() {}
+	}
+	cw := &compressWriter{ResponseWriter: w, r: r, minSize: h.compressMinSize, accepts: acceptsGzip(r)}
+	return cw, cw.close
+}
+
+// opens the precompressed sibling of a file, when the client accepts gzip, the whole file is requested, and
+// the sibling is not older than the file. Symlinks are not used as siblings.
+func (h *handler) openPrecompressed(r *http.Request, p string, fi os.FileInfo) *os.File {
+	if h.compressMinSize < 0 || !acceptsGzip(r) || r.Header.Get(headerRange) != "" {
+		return nil
+	}
+	gp := p + precompressedExt
+	gfi, err := os.Lstat(gp)
+	if err != nil || !gfi.Mode().IsRegular() || gfi.ModTime().Before(fi.ModTime()) {
+		return nil
+	}
+	f, err := os.Open(gp)
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+// returns the request body, decoded according to the content encoding. Fails with unsupported media type
+// when the encoding is not supported.
+func requestBody(w http.ResponseWriter, r *http.Request) (io.Reader, bool) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get(headerContentEncoding))) {
+	case "", identityEncoding:
+		return r.Body, true
+	case gzipEncoding, "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if !share.CheckBadReq(w, err == nil) {
+			return nil, false
+		}
+		return gz, true
+	default:
+		share.ErrorResponse(w, http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+}
@@ -0,0 +1,204 @@
+package htfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/aryszka/tasked/share"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(b)
+	tst.ErrFatal(t, err)
+	err = gz.Close()
+	tst.ErrFatal(t, err)
+	return buf.Bytes()
+}
+
+func getEncoded(t *testing.T, relurl string, header map[string]string, f func(*http.Response, []byte)) {
+	r, err := http.NewRequest("GET", tst.S.URL+relurl, nil)
+	tst.ErrFatal(t, err)
+	r.Header.Set(headerAcceptEncoding, "gzip")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	tst.Htreqr(t, r, func(rsp *http.Response) {
+		b, err := ioutil.ReadAll(rsp.Body)
+		tst.ErrFatal(t, err)
+		if rsp.Header.Get(headerContentEncoding) == gzipEncoding {
+			gz, err := gzip.NewReader(bytes.NewBuffer(b))
+			tst.ErrFatal(t, err)
+			b, err = ioutil.ReadAll(gz)
+			tst.ErrFatal(t, err)
+		}
+		f(rsp, b)
+	})
+}
+
+func initCompress(t *testing.T) (string, []byte) {
+	dir := path.Join(dn, "compress")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	text := []byte(strings.Repeat("some text ", 300))
+	for n, c := range map[string][]byte{
+		"large.txt": text,
+		"small.txt": []byte("some text"),
+		"image.png": text,
+		"app.js":    []byte("original"),
+		"app.js.gz": gzipBytes(t, []byte("precompressed"))} {
+		err := ioutil.WriteFile(path.Join(dir, n), c, os.ModePerm)
+		tst.ErrFatal(t, err)
+	}
+	return dir, text
+}
+
+func TestCompress(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, text := initCompress(t)
+
+	getEncoded(t, "/compress/large.txt", nil, func(rsp *http.Response, b []byte) {
+		if rsp.StatusCode != http.StatusOK || rsp.Header.Get(headerContentEncoding) != gzipEncoding ||
+			rsp.Header.Get(headerVary) != headerAcceptEncoding || !bytes.Equal(b, text) {
+			t.Fail()
+		}
+	})
+
+	// the identity validators don't apply to the encoded representation
+	fi, err := os.Lstat(path.Join(dir, "large.txt"))
+	tst.ErrFatal(t, err)
+	et := etag(fi)
+	gzipEt := et[:len(et)-1] + "-gzip\""
+	digestHeaders := map[string]string{"Want-Digest": "sha-256", "Want-Content-Digest": "sha-256"}
+	getEncoded(t, "/compress/large.txt", digestHeaders, func(rsp *http.Response, b []byte) {
+		if rsp.Header.Get(headerContentEncoding) != gzipEncoding || rsp.Header.Get(share.HeaderEtag) != gzipEt ||
+			rsp.Header.Get("Digest") == "" || rsp.Header.Get("Content-Digest") != "" {
+			t.Fail()
+		}
+	})
+	getEncoded(t, "/compress/large.txt", map[string]string{headerAcceptEncoding: "identity",
+		"Want-Content-Digest": "sha-256"}, func(rsp *http.Response, b []byte) {
+		if rsp.Header.Get(share.HeaderEtag) != et || rsp.Header.Get("Content-Digest") == "" {
+			t.Fail()
+		}
+	})
+	getEncoded(t, "/compress/large.txt", map[string]string{"If-None-Match": gzipEt, "Range": "bytes=0-3",
+		"If-Range": gzipEt}, func(rsp *http.Response, b []byte) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fail()
+		}
+	})
+
+	// the conditional requests are evaluated against the etag of the encoded representation
+	getEncoded(t, "/compress/large.txt", map[string]string{"If-None-Match": gzipEt},
+		func(rsp *http.Response, b []byte) {
+			if rsp.StatusCode != http.StatusNotModified || rsp.Header.Get(share.HeaderEtag) != gzipEt {
+				t.Fail()
+			}
+		})
+	getEncoded(t, "/compress/large.txt", map[string]string{"If-None-Match": et},
+		func(rsp *http.Response, b []byte) {
+			if rsp.StatusCode != http.StatusOK || !bytes.Equal(b, text) {
+				t.Fail()
+			}
+		})
+	ifMatch := map[string]string{"If-Match": gzipEt}
+	expectHeaderStatus(t, "PUT", "/compress/large.txt", ifMatch, http.StatusOK)
+	expectHeaderStatus(t, "PUT", "/compress/large.txt", ifMatch, http.StatusPreconditionFailed)
+	err = ioutil.WriteFile(path.Join(dir, "large.txt"), text, os.ModePerm)
+	tst.ErrFatal(t, err)
+
+	for _, n := range []string{"small.txt", "image.png"} {
+		getEncoded(t, "/compress/"+n, nil, func(rsp *http.Response, b []byte) {
+			if rsp.StatusCode != http.StatusOK || rsp.Header.Get(headerContentEncoding) != "" {
+				t.Fail()
+			}
+		})
+	}
+	getEncoded(t, "/compress/large.txt", map[string]string{"Range": "bytes=0-3"}, func(rsp *http.Response, b []byte) {
+		if rsp.StatusCode != http.StatusPartialContent || rsp.Header.Get(headerContentEncoding) != "" ||
+			string(b) != "some" {
+			t.Fail()
+		}
+	})
+	getEncoded(t, "/compress/large.txt", map[string]string{headerAcceptEncoding: "gzip;q=0, identity"},
+		func(rsp *http.Response, b []byte) {
+			if rsp.Header.Get(headerContentEncoding) != "" || !bytes.Equal(b, text) {
+				t.Fail()
+			}
+		})
+
+	// listing
+	for i := 0; i < 30; i++ {
+		err := ioutil.WriteFile(path.Join(dir, strings.Repeat("x", i+1)), nil, os.ModePerm)
+		tst.ErrFatal(t, err)
+	}
+	getEncoded(t, "/compress", nil, func(rsp *http.Response, b []byte) {
+		if rsp.Header.Get(headerContentEncoding) != gzipEncoding || !bytes.HasPrefix(b, []byte("[{")) {
+			t.Fail()
+		}
+	})
+
+	// precompressed
+	getEncoded(t, "/compress/app.js", nil, func(rsp *http.Response, b []byte) {
+		if rsp.Header.Get(headerContentEncoding) != gzipEncoding || string(b) != "precompressed" ||
+			!strings.Contains(rsp.Header.Get("Content-Type"), "javascript") ||
+			!strings.HasSuffix(rsp.Header.Get(share.HeaderEtag), "-gzip\"") {
+			t.Fail()
+		}
+	})
+	getEncoded(t, "/compress/app.js", map[string]string{headerAcceptEncoding: "identity"},
+		func(rsp *http.Response, b []byte) {
+			if rsp.Header.Get(headerContentEncoding) != "" || string(b) != "original" {
+				t.Fail()
+			}
+		})
+
+	// disabled
+	ht = New(&testOptions{root: dn, compressMinSize: -1})
+	tst.Thnd.Sh = ht.ServeHTTP
+	for _, n := range []string{"large.txt", "app.js"} {
+		getEncoded(t, "/compress/"+n, nil, func(rsp *http.Response, b []byte) {
+			if rsp.Header.Get(headerContentEncoding) != "" {
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestPutEncoded(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, _ := initCompress(t)
+	put := func(enc string, body []byte, status int) {
+		r, err := http.NewRequest("PUT", tst.S.URL+"/compress/put", bytes.NewBuffer(body))
+		tst.ErrFatal(t, err)
+		r.Header.Set(headerContentEncoding, enc)
+		tst.Htreqr(t, r, func(rsp *http.Response) {
+			if rsp.StatusCode != status {
+				t.Log(enc, rsp.StatusCode)
+				t.Fail()
+			}
+		})
+	}
+	put("br", []byte("data"), http.StatusUnsupportedMediaType)
+	put("gzip", []byte("not gzip"), http.StatusBadRequest)
+	put("gzip", gzipBytes(t, []byte("decoded")), http.StatusOK)
+	b, err := ioutil.ReadFile(path.Join(dir, "put"))
+	if err != nil || string(b) != "decoded" {
+		t.Fail()
+	}
+
+	// the limit applies to the decoded body
+	ht = New(&testOptions{root: dn, maxRequestBody: 42})
+	tst.Thnd.Sh = ht.ServeHTTP
+	put("gzip", gzipBytes(t, bytes.Repeat([]byte("x"), 420)), http.StatusRequestEntityTooLarge)
+}
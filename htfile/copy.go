@@ -0,0 +1,265 @@
+package htfile
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	preserveKey       = "preserve"
+	preserveTimes     = "times"
+	preserveOwner     = "owner"
+	preserveXattr     = "xattr"
+	preserveHardlinks = "links"
+)
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// what to keep from the source when copying. When lenient, failing to keep the owner or the extended
+// attributes is not an error.
+type copyOptions struct {
+	times     bool
+	owner     bool
+	xattr     bool
+	hardlinks bool
+	lenient   bool
+	follow    func(string) bool
+	copied    map[inode]string
+}
+
+var invalidPreserve = errors.New("Invalid preserve option.")
+
+// parses the preserve query values, e.g. preserve=times,owner
+func getQryPreserve(qry url.Values) (*copyOptions, error) {
+	o := new(copyOptions)
+	for _, v := range qry[preserveKey] {
+		for _, pv := range strings.Split(v, ",") {
+			switch strings.TrimSpace(pv) {
+			case preserveTimes:
+				o.times = true
+			case preserveOwner:
+				o.owner = true
+			case preserveXattr:
+				o.xattr = true
+			case preserveHardlinks:
+				o.hardlinks = true
+			default:
+				return nil, invalidPreserve
+			}
+		}
+	}
+	return o, nil
+}
+
+func tempPath(p string) (string, error) {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(p), fmt.Sprintf(".%s.%x", path.Base(p), b)), nil
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err == errno
+	case *os.LinkError:
+		return e.Err == errno
+	case *os.SyscallError:
+		return e.Err == errno
+	default:
+		return err == errno
+	}
+}
+
+// the owner is set before the mode, because changing the owner can clear the setuid and setgid bits, and
+// the times are set last
+func preserveMeta(from, to string, fi os.FileInfo, o *copyOptions) error {
+	sstat, _ := fi.Sys().(*syscall.Stat_t)
+	if o.xattr {
+		err := copyXattrs(from, to, "")
+		if err != nil && !o.lenient {
+			return err
+		}
+	}
+	if o.owner && sstat != nil {
+		err := os.Lchown(to, int(sstat.Uid), int(sstat.Gid))
+		if err != nil && !(o.lenient && os.IsPermission(err)) {
+			return err
+		}
+	}
+	err := os.Chmod(to, fi.Mode())
+	if err != nil {
+		return err
+	}
+	if o.times && sstat != nil {
+		return os.Chtimes(to, time.Unix(sstat.Atim.Sec, sstat.Atim.Nsec), fi.ModTime())
+	}
+	return nil
+}
+
+func copyLink(from, to string, o *copyOptions) error {
+	link, err := os.Readlink(from)
+	if err != nil {
+		return err
+	}
+	err = os.Symlink(link, to)
+	if err != nil || !o.owner {
+		return err
+	}
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if sstat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		err = os.Lchown(to, int(sstat.Uid), int(sstat.Gid))
+		if o.lenient && os.IsPermission(err) {
+			return nil
+		}
+	}
+	return err
+}
+
+func copyFile(from, to string) error {
+	ff, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(ff.Close)
+	tf, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(tf.Close)
+	_, err = io.Copy(tf, ff)
+	return err
+}
+
+// copies a file or a directory tree to a not existing path. Symlinks are copied as links, unless follow is
+// set and returns true for them, in which case the content of the target is copied. Links to directories
+// are always copied as links, to avoid cycles. Only regular files, directories and symlinks are copied.
+func copyTreeOpts(from, to string, o *copyOptions) error {
+	if from == to {
+		return nil
+	}
+	fi, err := os.Lstat(from)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		tfi, err := os.Stat(from)
+		if err != nil || tfi.IsDir() || o.follow == nil || !o.follow(from) {
+			return copyLink(from, to, o)
+		}
+		fi = tfi
+	}
+	switch {
+	case fi.IsDir():
+		err = os.Mkdir(to, 0700)
+		if err != nil {
+			return err
+		}
+		d, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		fis, err := d.Readdir(0)
+		share.Doretlog42(d.Close)
+		if err != nil {
+			return err
+		}
+		for _, fii := range fis {
+			err = copyTreeOpts(path.Join(from, fii.Name()), path.Join(to, fii.Name()), o)
+			if err != nil {
+				return err
+			}
+		}
+	case fi.Mode().IsRegular():
+		sstat, ok := fi.Sys().(*syscall.Stat_t)
+		if o.hardlinks && ok && sstat.Nlink > 1 {
+			if o.copied == nil {
+				o.copied = make(map[inode]string)
+			}
+			id := inode{uint64(sstat.Dev), sstat.Ino}
+			if p, ok := o.copied[id]; ok {
+				return os.Link(p, to)
+			}
+			o.copied[id] = to
+		}
+		err = copyFile(from, to)
+		if err != nil {
+			return err
+		}
+	default:
+		return &os.PathError{Op: "copy", Path: from, Err: syscall.EINVAL}
+	}
+	return preserveMeta(from, to, fi, o)
+}
+
+// copies to a temporary path next to the target, and renames it in place only when complete, so that a
+// failure doesn't leave a partial copy behind. An existing directory is not replaced.
+func copyAtomic(from, to string, o *copyOptions) error {
+	if fi, err := os.Lstat(to); err == nil && fi.IsDir() {
+		return &os.PathError{Op: "copy", Path: to, Err: syscall.EISDIR}
+	}
+	tmp, err := tempPath(to)
+	if err != nil {
+		return err
+	}
+
+	// the hardlinks are tracked per copy, by their temporary path
+	o.copied = nil
+	err = copyTreeOpts(from, tmp, o)
+	if err == nil {
+		err = os.Rename(tmp, to)
+	}
+	if err != nil {
+		share.Doretlog42(func() error { return os.RemoveAll(tmp) })
+	}
+	return err
+}
+
+// copies and then deletes the source. The source is left intact, until the copy is complete. It is then
+// renamed before deleting, so that a partial delete doesn't leave a partial source behind.
+func moveCopy(from, to string) error {
+	err := copyAtomic(from, to, &copyOptions{
+		times:     true,
+		owner:     true,
+		xattr:     true,
+		hardlinks: true,
+		lenient:   true})
+	if err != nil {
+		return err
+	}
+	tmp, err := tempPath(from)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(from, tmp)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(tmp)
+}
+
+// renames, or, across devices, copies and then deletes the source
+func moveTree(from, to string) error {
+	err := os.Rename(from, to)
+	if !isErrno(err, syscall.EXDEV) {
+		return err
+	}
+	return moveCopy(from, to)
+}
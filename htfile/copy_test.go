@@ -0,0 +1,154 @@
+package htfile
+
+import (
+	tst "github.com/aryszka/tasked/testing"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func initCopy(t *testing.T) string {
+	tst.RemoveIfExistsF(t, path.Join(dn, "copy-preserved"))
+	return initTestDir(t, "copy-preserve", map[string]string{"sub/file": "content"})
+}
+
+func statT(t *testing.T, p string) *syscall.Stat_t {
+	fi, err := os.Lstat(p)
+	tst.ErrFatal(t, err)
+	return fi.Sys().(*syscall.Stat_t)
+}
+
+func TestCopyPreserve(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initCopy(t)
+	cdir := path.Join(dn, "copy-preserved")
+	defer tst.RemoveIfExistsF(t, cdir)
+	f := path.Join(dir, "sub/file")
+	cf := path.Join(cdir, "sub/file")
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	err := os.Chtimes(f, mtime, mtime)
+	tst.ErrFatal(t, err)
+	err = os.Lchown(f, 1, 1)
+	tst.ErrFatal(t, err)
+
+	expectStatus(t, "COPY", "/copy-preserve?to=/copy-preserved&preserve=invalid", http.StatusBadRequest)
+	expectStatus(t, "COPY", "/copy-preserve?to=/copy-preserved", http.StatusOK)
+	fi, err := os.Stat(cf)
+	if err != nil || fi.ModTime().Equal(mtime) || statT(t, cf).Uid == 1 {
+		t.Fail()
+	}
+
+	tst.RemoveIfExistsF(t, cdir)
+	expectStatus(t, "COPY", "/copy-preserve?to=/copy-preserved&preserve=times,owner", http.StatusOK)
+	checkFileContent(t, cf, "content")
+	fi, err = os.Stat(cf)
+	if err != nil || !fi.ModTime().Equal(mtime) {
+		t.Fail()
+	}
+	if st := statT(t, cf); st.Uid != 1 || st.Gid != 1 {
+		t.Fail()
+	}
+}
+
+func TestCopyPreserveXattr(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initCopy(t)
+	defer tst.RemoveIfExistsF(t, path.Join(dn, "copy-preserved"))
+	err := syscall.Setxattr(path.Join(dir, "sub/file"), "user.test", []byte("value"), 0)
+	if err == syscall.ENOTSUP || err == syscall.EPERM {
+		t.Skip("extended attributes not supported")
+	}
+	tst.ErrFatal(t, err)
+	expectStatus(t, "COPY", "/copy-preserve?to=/copy-preserved&preserve=xattr", http.StatusOK)
+	v := make([]byte, 16)
+	n, err := syscall.Getxattr(path.Join(dn, "copy-preserved/sub/file"), "user.test", v)
+	if err != nil || string(v[:n]) != "value" {
+		t.Fail()
+	}
+}
+
+func TestCopyPreserveHardlinks(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initCopy(t)
+	cdir := path.Join(dn, "copy-preserved")
+	defer tst.RemoveIfExistsF(t, cdir)
+	err := os.Link(path.Join(dir, "sub/file"), path.Join(dir, "link"))
+	tst.ErrFatal(t, err)
+
+	expectStatus(t, "COPY", "/copy-preserve?to=/copy-preserved", http.StatusOK)
+	if statT(t, path.Join(cdir, "link")).Ino == statT(t, path.Join(cdir, "sub/file")).Ino {
+		t.Fail()
+	}
+
+	tst.RemoveIfExistsF(t, cdir)
+	expectStatus(t, "COPY", "/copy-preserve?to=/copy-preserved&preserve=links", http.StatusOK)
+	if statT(t, path.Join(cdir, "link")).Ino != statT(t, path.Join(cdir, "sub/file")).Ino {
+		t.Fail()
+	}
+}
+
+func TestCopyAtomic(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initCopy(t)
+	l, err := net.Listen("unix", path.Join(dir, "sub/socket"))
+	tst.ErrFatal(t, err)
+	defer l.Close()
+	expectStatus(t, "COPY", "/copy-preserve?to=/copy-preserved", http.StatusBadRequest)
+	if _, err := os.Lstat(path.Join(dn, "copy-preserved")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+	d, err := os.Open(dn)
+	tst.ErrFatal(t, err)
+	names, err := d.Readdirnames(0)
+	d.Close()
+	tst.ErrFatal(t, err)
+	for _, n := range names {
+		if strings.HasPrefix(n, ".copy-preserved.") {
+			t.Fail()
+		}
+	}
+}
+
+func TestMoveCopy(t *testing.T) {
+	dir := initCopy(t)
+	to := path.Join(dn, "copy-preserved")
+	defer tst.RemoveIfExistsF(t, to)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	err := os.Chtimes(path.Join(dir, "sub/file"), mtime, mtime)
+	tst.ErrFatal(t, err)
+	err = moveCopy(dir, to)
+	tst.ErrFatal(t, err)
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+		t.Fail()
+	}
+	checkFileContent(t, path.Join(to, "sub/file"), "content")
+	fi, err := os.Stat(path.Join(to, "sub/file"))
+	if err != nil || !fi.ModTime().Equal(mtime) {
+		t.Fail()
+	}
+
+	// a failing copy leaves the source intact
+	tst.EnsureDirF(t, dir)
+	l, err := net.Listen("unix", path.Join(dir, "socket"))
+	tst.ErrFatal(t, err)
+	defer l.Close()
+	err = moveCopy(dir, path.Join(dn, "copy-moved"))
+	if err == nil {
+		t.Fail()
+	}
+	if _, err := os.Lstat(path.Join(dir, "socket")); err != nil {
+		t.Fail()
+	}
+	if _, err := os.Lstat(path.Join(dn, "copy-moved")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
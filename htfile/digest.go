@@ -0,0 +1,265 @@
+package htfile
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	digestKey    = "digest"
+	digestsDir   = "digests"
+	digestSha256 = "sha256"
+	digestMd5    = "md5"
+	digestCrc32c = "crc32c"
+)
+
+// the cached digests are valid as long as the etag, derived from the inode, the size and the
+// modification time, doesn't change
+type digestCache struct {
+	Etag    string            `json:"etag"`
+	Digests map[string]string `json:"digests"`
+}
+
+var (
+	digestAlgorithms = map[string]func() hash.Hash{
+		digestSha256: sha256.New,
+		digestMd5:    md5.New,
+		digestCrc32c: func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }}
+
+	// names used in the Digest and Content-Digest headers
+	digestHeaderNames = map[string]string{
+		digestSha256: "sha-256",
+		digestMd5:    "md5",
+		digestCrc32c: "crc32c"}
+
+	headerDigest            = http.CanonicalHeaderKey("digest")
+	headerContentDigest     = http.CanonicalHeaderKey("content-digest")
+	headerWantDigest        = http.CanonicalHeaderKey("want-digest")
+	headerWantContentDigest = http.CanonicalHeaderKey("want-content-digest")
+	headerRange             = http.CanonicalHeaderKey("range")
+	invalidDigest           = errors.New("Invalid digest.")
+)
+
+func getQryDigests(qry url.Values) ([]string, error) {
+	algs := qry[digestKey]
+	for _, alg := range algs {
+		if _, ok := digestAlgorithms[alg]; !ok {
+			return nil, invalidDigest
+		}
+	}
+	return algs, nil
+}
+
+// parses the Want-Digest and Want-Content-Digest header format, e.g. sha-256;q=0.3, md5;q=1,
+// keeping the supported algorithms with non-zero quality
+func parseWantDigest(h string) []string {
+	var algs []string
+	for _, v := range strings.Split(h, ",") {
+		parts := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) > 1 {
+			q := strings.TrimSpace(parts[1])
+			if strings.HasPrefix(q, "q=") {
+				if qv, err := strconv.ParseFloat(q[2:], 64); err != nil || qv <= 0 {
+					continue
+				}
+			}
+		}
+		for alg, hn := range digestHeaderNames {
+			if hn == name {
+				algs = append(algs, alg)
+				break
+			}
+		}
+	}
+	return algs
+}
+
+func (h *handler) digestCachePath(fi os.FileInfo) (string, bool) {
+	sstat, ok := fi.Sys().(*syscall.Stat_t)
+	if h.cachedir == "" || !ok {
+		return "", false
+	}
+	return path.Join(h.cachedir, digestsDir, fmt.Sprintf("%x-%x", sstat.Dev, sstat.Ino)), true
+}
+
+func readDigestCache(p, et string) *digestCache {
+	dc := new(digestCache)
+	b, err := ioutil.ReadFile(p)
+	if err != nil || json.Unmarshal(b, dc) != nil || dc.Etag != et || dc.Digests == nil {
+		return &digestCache{Etag: et, Digests: make(map[string]string)}
+	}
+	return dc
+}
+
+func writeDigestCache(p string, dc *digestCache) error {
+	err := share.EnsureDir(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(dc)
+	if err != nil {
+		return err
+	}
+	f, err := createTemp(p, 0600)
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(f.Close)
+	_, err = f.Write(b)
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		share.Doretlog42(func() error { return os.Remove(f.Name()) })
+	}
+	return err
+}
+
+// returns the hex encoded digests of an open file, reading the file only for those missing from the cache
+func (h *handler) fileDigests(f *os.File, algs []string) (map[string]string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	et := etag(fi)
+	cp, cached := h.digestCachePath(fi)
+	dc := &digestCache{Etag: et, Digests: make(map[string]string)}
+	if cached {
+		dc = readDigestCache(cp, et)
+	}
+
+	hs := make(map[string]hash.Hash)
+	var ws []io.Writer
+	for _, alg := range algs {
+		if _, ok := dc.Digests[alg]; ok {
+			continue
+		}
+		if _, ok := hs[alg]; ok {
+			continue
+		}
+		hs[alg] = digestAlgorithms[alg]()
+		ws = append(ws, hs[alg])
+	}
+	if len(hs) > 0 {
+		_, err = io.Copy(io.MultiWriter(ws...), io.NewSectionReader(f, 0, fi.Size()))
+		if err != nil {
+			return nil, err
+		}
+		for alg, hsh := range hs {
+			dc.Digests[alg] = hex.EncodeToString(hsh.Sum(nil))
+		}
+
+		// not cached if the file changed during reading
+		if fi, err = f.Stat(); cached && err == nil && etag(fi) == et {
+			share.Dolog(func() error { return writeDigestCache(cp, dc) })
+		}
+	}
+
+	d := make(map[string]string)
+	for _, alg := range algs {
+		d[alg] = dc.Digests[alg]
+	}
+	return d, nil
+}
+
+func formatDigestHeader(d map[string]string, algs []string, format string) string {
+	var vs []string
+	for _, alg := range algs {
+		b, err := hex.DecodeString(d[alg])
+		if err != nil {
+			continue
+		}
+		vs = append(vs, fmt.Sprintf(format, digestHeaderNames[alg], base64.StdEncoding.EncodeToString(b)))
+	}
+	return strings.Join(vs, ", ")
+}
+
+// sets the Digest header when requested by Want-Digest, and the Content-Digest header when requested by
+// Want-Content-Digest and the full content is served
+func (h *handler) setDigestHeaders(w http.ResponseWriter, r *http.Request, f *os.File) error {
+	algs := parseWantDigest(r.Header.Get(headerWantDigest))
+	calgs := parseWantDigest(r.Header.Get(headerWantContentDigest))
+	if r.Header.Get(headerRange) != "" {
+		calgs = nil
+	}
+	if len(algs) == 0 && len(calgs) == 0 {
+		return nil
+	}
+	d, err := h.fileDigests(f, append(algs, calgs...))
+	if err != nil {
+		return err
+	}
+	if len(algs) > 0 {
+		w.Header().Set(headerDigest, formatDigestHeader(d, algs, "%s=%s"))
+	}
+	if len(calgs) > 0 {
+		w.Header().Set(headerContentDigest, formatDigestHeader(d, calgs, "%s=:%s:"))
+	}
+	return nil
+}
+
+// checks the digests passed in the query as algorithm=hex-value against the file
+func (h *handler) verifyf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	expected := make(map[string]string)
+	var algs []string
+	for alg := range digestAlgorithms {
+		vs := qry[alg]
+		if len(vs) == 0 {
+			continue
+		}
+		if !share.CheckBadReq(w, len(vs) == 1) {
+			return
+		}
+		expected[alg] = strings.ToLower(vs[0])
+		algs = append(algs, alg)
+	}
+	if !share.CheckBadReq(w, len(algs) > 0) {
+		return
+	}
+	f, err := os.Open(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	defer share.Doretlog42(f.Close)
+	fi, err := f.Stat()
+	if !share.CheckOsError(w, err) || !share.CheckHandle(w, !fi.IsDir(), http.StatusNotFound) {
+		return
+	}
+	d, err := h.fileDigests(f, algs)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	match := true
+	results := make(map[string]bool)
+	for _, alg := range algs {
+		results[alg] = d[alg] == expected[alg]
+		match = match && results[alg]
+	}
+	w.Header().Set(share.HeaderEtag, etag(fi))
+	_, err = share.WriteJsonResponse(w, r, map[string]interface{}{
+		"match":   match,
+		"digests": results})
+	share.CheckServerError(w, err != share.MarshalError)
+}
@@ -0,0 +1,217 @@
+package htfile
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+var (
+	digestContent  = []byte("some content")
+	sha256Sum      = sha256.Sum256(digestContent)
+	md5Sum         = md5.Sum(digestContent)
+	crc32cSum      = crc32.Checksum(digestContent, crc32.MakeTable(crc32.Castagnoli))
+	crc32cSumBytes = []byte{byte(crc32cSum >> 24), byte(crc32cSum >> 16), byte(crc32cSum >> 8), byte(crc32cSum)}
+)
+
+func makeDigestFile(t *testing.T) string {
+	dir := path.Join(dn, "digest")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	p := path.Join(dir, "file")
+	tst.WithNewFileF(t, p, func(f *os.File) error {
+		_, err := f.Write(digestContent)
+		return err
+	})
+	return p
+}
+
+func TestParseWantDigest(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		algs   []string
+	}{
+		{"", nil},
+		{"sha-256", []string{digestSha256}},
+		{"SHA-256;q=0.3, md5;q=1, unixsum", []string{digestSha256, digestMd5}},
+		{"sha-256;q=0, crc32c", []string{digestCrc32c}},
+	} {
+		algs := parseWantDigest(c.header)
+		if len(algs) != len(c.algs) {
+			t.Log(c.header, algs)
+			t.Fail()
+			continue
+		}
+		for i, alg := range algs {
+			if alg != c.algs[i] {
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestPropsDigest(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeDigestFile(t)
+	url := tst.S.URL + "/digest/file"
+	tst.Htreq(t, "GET", url+"?cmd=props&digest=sha1", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusBadRequest {
+			t.Fail()
+		}
+	})
+	for method, u := range map[string]string{"GET": url + "?cmd=props&", "PROPS": url + "?"} {
+		tst.Htreq(t, method, u+"digest=sha256&digest=md5&digest=crc32c", nil, func(rsp *http.Response) {
+			var pr map[string]interface{}
+			err := json.NewDecoder(rsp.Body).Decode(&pr)
+			tst.ErrFatal(t, err)
+			d, ok := pr["digests"].(map[string]interface{})
+			if !ok || d[digestSha256] != hex.EncodeToString(sha256Sum[:]) ||
+				d[digestMd5] != hex.EncodeToString(md5Sum[:]) ||
+				d[digestCrc32c] != hex.EncodeToString(crc32cSumBytes) {
+				t.Log(pr)
+				t.Fail()
+			}
+		})
+	}
+
+	// no digests for directories
+	tst.Htreq(t, "GET", tst.S.URL+"/digest?cmd=props&digest=sha256", nil, func(rsp *http.Response) {
+		var pr map[string]interface{}
+		err := json.NewDecoder(rsp.Body).Decode(&pr)
+		tst.ErrFatal(t, err)
+		if _, ok := pr["digests"]; ok {
+			t.Fail()
+		}
+	})
+}
+
+func TestDigestHeaders(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeDigestFile(t)
+	r, err := http.NewRequest("GET", tst.S.URL+"/digest/file", nil)
+	tst.ErrFatal(t, err)
+	tst.Htreqr(t, r, func(rsp *http.Response) {
+		if rsp.Header.Get("Digest") != "" || rsp.Header.Get("Content-Digest") != "" {
+			t.Fail()
+		}
+	})
+	r.Header.Set("Want-Digest", "sha-256, md5")
+	r.Header.Set("Want-Content-Digest", "sha-256")
+	tst.Htreqr(t, r, func(rsp *http.Response) {
+		b, err := ioutil.ReadAll(rsp.Body)
+		tst.ErrFatal(t, err)
+		if string(b) != string(digestContent) ||
+			rsp.Header.Get("Digest") != "sha-256="+base64.StdEncoding.EncodeToString(sha256Sum[:])+
+				", md5="+base64.StdEncoding.EncodeToString(md5Sum[:]) ||
+			rsp.Header.Get("Content-Digest") != "sha-256=:"+base64.StdEncoding.EncodeToString(sha256Sum[:])+":" {
+			t.Log(rsp.Header)
+			t.Fail()
+		}
+	})
+
+	// content digest only for the full content
+	r.Header.Set("Range", "bytes=0-3")
+	tst.Htreqr(t, r, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusPartialContent || rsp.Header.Get("Digest") == "" ||
+			rsp.Header.Get("Content-Digest") != "" {
+			t.Fail()
+		}
+	})
+}
+
+func TestDigestCache(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir}).(*handler)
+	p := makeDigestFile(t)
+	f, err := os.Open(p)
+	tst.ErrFatal(t, err)
+	defer f.Close()
+	fi, err := f.Stat()
+	tst.ErrFatal(t, err)
+	d, err := ht.fileDigests(f, []string{digestSha256})
+	tst.ErrFatal(t, err)
+	if d[digestSha256] != hex.EncodeToString(sha256Sum[:]) {
+		t.Fail()
+	}
+	cp, ok := ht.digestCachePath(fi)
+	if !ok {
+		t.Fatal()
+	}
+	dc := readDigestCache(cp, etag(fi))
+	if dc.Digests[digestSha256] != d[digestSha256] {
+		t.Fail()
+	}
+
+	// served from the cache
+	dc.Digests[digestSha256] = "cached"
+	err = writeDigestCache(cp, dc)
+	tst.ErrFatal(t, err)
+	d, err = ht.fileDigests(f, []string{digestSha256})
+	if err != nil || d[digestSha256] != "cached" {
+		t.Fail()
+	}
+
+	// invalidated by modification
+	fw, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0)
+	tst.ErrFatal(t, err)
+	_, err = fw.Write([]byte("\n"))
+	fw.Close()
+	tst.ErrFatal(t, err)
+	d, err = ht.fileDigests(f, []string{digestSha256})
+	sum := sha256.Sum256(append(digestContent, '\n'))
+	if err != nil || d[digestSha256] != hex.EncodeToString(sum[:]) {
+		t.Fail()
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeDigestFile(t)
+	url := tst.S.URL + "/digest/file?cmd=verify"
+	for _, c := range []struct {
+		qry    string
+		status int
+		match  bool
+	}{
+		{"", http.StatusBadRequest, false},
+		{"&sha256=00&sha256=01", http.StatusBadRequest, false},
+		{"&sha256=" + hex.EncodeToString(sha256Sum[:]), http.StatusOK, true},
+		{"&sha256=" + hex.EncodeToString(sha256Sum[:]) + "&md5=00", http.StatusOK, false},
+		{"&md5=" + hex.EncodeToString(md5Sum[:]) + "&crc32c=" + hex.EncodeToString(crc32cSumBytes),
+			http.StatusOK, true},
+	} {
+		tst.Htreq(t, "GET", url+c.qry, nil, func(rsp *http.Response) {
+			if rsp.StatusCode != c.status {
+				t.Log(c.qry, rsp.StatusCode)
+				t.Fail()
+				return
+			}
+			if rsp.StatusCode != http.StatusOK {
+				return
+			}
+			var res map[string]interface{}
+			err := json.NewDecoder(rsp.Body).Decode(&res)
+			tst.ErrFatal(t, err)
+			if res["match"] != c.match {
+				t.Log(c.qry, res)
+				t.Fail()
+			}
+		})
+	}
+	tst.Htreq(t, "GET", tst.S.URL+"/digest?cmd=verify&sha256=00", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusNotFound {
+			t.Fail()
+		}
+	})
+}
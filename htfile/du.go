@@ -0,0 +1,318 @@
+package htfile
+
+import (
+	"encoding/json"
+	"github.com/aryszka/tasked/share"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	duDir          = "du"
+	duFileExt      = ".json"
+	duQryDepth     = "depth"
+	duWorkers      = 8
+	duCacheExpiry  = 10 * time.Minute
+	duPersistDelay = time.Minute
+)
+
+// the disk usage of a file or a directory tree, with the breakdown of the children to the requested
+// depth. The size is the sum of the apparent sizes of the files, the symlinks are not followed.
+type duStats struct {
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	Files    int        `json:"files"`
+	Dirs     int        `json:"dirs"`
+	Children []*duStats `json:"children,omitempty"`
+}
+
+// the cached totals of a directory
+type duEntry struct {
+	Size     int64
+	Files    int
+	Dirs     int
+	Computed time.Time
+}
+
+// caches the totals of the directories in the cachedir, keyed by their resolved path. The entries of a
+// changed path, of its subtree and of its parent directories are removed after the mutating requests, and
+// the changes are persisted after duPersistDelay. Since changes made by others are not noticed, the
+// entries expire.
+type duCache struct {
+	h       *handler
+	mx      sync.Mutex
+	loaded  bool
+	dirty   bool
+	timer   *time.Timer
+	entries map[string]*duEntry
+}
+
+// the cache key of a path in the root: the path with its parent directory resolved
+func duKey(p string) (string, error) {
+	dir, err := filepath.EvalSymlinks(path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, path.Base(p)), nil
+}
+
+func (c *duCache) filename() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(c.h.cachedir, duDir, u.Uid+duFileExt), nil
+}
+
+// expects the lock to be held
+func (c *duCache) load() error {
+	if c.loaded {
+		return nil
+	}
+	c.loaded = true
+	c.entries = make(map[string]*duEntry)
+	fn, err := c.filename()
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.entries)
+}
+
+// expects the lock to be held
+func (c *duCache) persist() error {
+	fn, err := c.filename()
+	if err != nil {
+		return err
+	}
+	err = c.h.ensureSharedDir(path.Dir(fn))
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	c.dirty = false
+	f, err := createTemp(fn, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fn)
+	}
+	if err != nil {
+		share.Doretlog42(func() error { return os.Remove(f.Name()) })
+	}
+	return err
+}
+
+func (c *duCache) get(p string) *duEntry {
+	if c == nil {
+		return nil
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	share.Dolog(c.load)
+	e, ok := c.entries[p]
+	if !ok || time.Now().Sub(e.Computed) > duCacheExpiry {
+		return nil
+	}
+	return e
+}
+
+func (c *duCache) set(p string, e *duEntry) {
+	if c == nil {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	share.Dolog(c.load)
+	c.entries[p] = e
+	c.dirty = true
+}
+
+// persists the pending changes
+func (c *duCache) save() {
+	if c == nil {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.dirty {
+		share.Dolog(c.persist)
+	}
+}
+
+// the keys of a changed path: the path itself, and, when it is a symlink, its target, too
+func (c *duCache) changedKeys(p string) []string {
+	lp, err := c.h.getLinkPath(p)
+	if err != nil {
+		return nil
+	}
+	rp, err := resolveExisting(path.Dir(lp))
+	if err != nil {
+		return nil
+	}
+	keys := []string{path.Join(rp, path.Base(lp))}
+	if tp, err := filepath.EvalSymlinks(lp); err == nil && tp != keys[0] {
+		keys = append(keys, tp)
+	}
+	return keys
+}
+
+// removes the entries of the changed paths, their subtrees, and their parent directories
+func (c *duCache) invalidate(ps []string) {
+	if c == nil || len(ps) == 0 {
+		return
+	}
+	var keys []string
+	for _, p := range ps {
+		keys = append(keys, c.changedKeys(p)...)
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	share.Dolog(c.load)
+	for _, k := range keys {
+		for ck := range c.entries {
+			if isUnder(k, ck) || isUnder(ck, k) {
+				delete(c.entries, ck)
+				c.dirty = true
+			}
+		}
+	}
+	if c.dirty && c.timer == nil {
+		c.timer = time.AfterFunc(duPersistDelay, c.save)
+	}
+}
+
+// computes the totals of a directory, walking the subdirectories concurrently, with at most duWorkers
+// additional goroutines. The unreadable subdirectories are skipped.
+func (h *handler) duTree(p, rp string, sem chan struct{}) (*duEntry, error) {
+	if e := h.du.get(rp); e != nil {
+		return e, nil
+	}
+	fis, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		mx sync.Mutex
+		wg sync.WaitGroup
+	)
+	total := &duEntry{}
+	walkChild := func(fi os.FileInfo) {
+		e, err := h.duTree(path.Join(p, fi.Name()), path.Join(rp, fi.Name()), sem)
+		if err != nil {
+			return
+		}
+		mx.Lock()
+		defer mx.Unlock()
+		total.Size += e.Size
+		total.Files += e.Files
+		total.Dirs += e.Dirs
+	}
+	for _, fi := range fis {
+		mx.Lock()
+		if !fi.IsDir() {
+			total.Size += fi.Size()
+			total.Files++
+			mx.Unlock()
+			continue
+		}
+		total.Dirs++
+		mx.Unlock()
+		select {
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func(fi os.FileInfo) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				walkChild(fi)
+			}(fi)
+		default:
+			walkChild(fi)
+		}
+	}
+	wg.Wait()
+	total.Computed = time.Now()
+	h.du.set(rp, total)
+	return total, nil
+}
+
+func (h *handler) duStats(p, rp string, fi os.FileInfo, depth int, sem chan struct{}) (*duStats, error) {
+	s := &duStats{Name: fi.Name()}
+	if !fi.IsDir() {
+		s.Size = fi.Size()
+		s.Files = 1
+		return s, nil
+	}
+	e, err := h.duTree(p, rp, sem)
+	if err != nil {
+		return nil, err
+	}
+	s.Size, s.Files, s.Dirs = e.Size, e.Files, e.Dirs
+	if depth <= 0 {
+		return s, nil
+	}
+	fis, err := ioutil.ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+	s.Children = make([]*duStats, 0, len(fis))
+	for _, cfi := range fis {
+		cs, err := h.duStats(path.Join(p, cfi.Name()), path.Join(rp, cfi.Name()), cfi, depth-1, sem)
+		if err != nil {
+			continue
+		}
+		s.Children = append(s.Children, cs)
+	}
+	return s, nil
+}
+
+func (h *handler) duf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	depth, err := getQryNum(qry, duQryDepth)
+	if !share.CheckBadReq(w, err == nil && depth >= 0) {
+		return
+	}
+	fi, err := os.Lstat(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	rp, err := duKey(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	s, err := h.duStats(p, rp, fi, depth, make(chan struct{}, duWorkers))
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	h.du.save()
+	_, err = share.WriteJsonResponse(w, r, s)
+	share.CheckServerError(w, err != share.MarshalError)
+}
@@ -0,0 +1,124 @@
+package htfile
+
+import (
+	"bytes"
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func initDu(t *testing.T) {
+	dir := path.Join(dn, "du")
+	tst.RemoveIfExistsF(t, dir)
+	for i := 0; i < 12; i++ {
+		tst.EnsureDirF(t, path.Join(dir, "a", strings.Repeat("x", i+1), "y"))
+	}
+	tst.EnsureDirF(t, path.Join(dir, "b"))
+	for n, size := range map[string]int{
+		"a/1":     10,
+		"a/x/y/2": 20,
+		"b/3":     30,
+		"4":       40} {
+		err := ioutil.WriteFile(path.Join(dir, n), []byte(strings.Repeat("x", size)), os.ModePerm)
+		tst.ErrFatal(t, err)
+	}
+	err := os.Symlink("b", path.Join(dir, "link"))
+	tst.ErrFatal(t, err)
+}
+
+func getDu(t *testing.T, relurl string) *duStats {
+	var s duStats
+	tst.Htreq(t, "GET", tst.S.URL+relurl, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(relurl, rsp.StatusCode)
+		}
+		err := json.NewDecoder(rsp.Body).Decode(&s)
+		tst.ErrFatal(t, err)
+	})
+	return &s
+}
+
+func TestDu(t *testing.T) {
+	initDu(t)
+	tst.RemoveIfExistsF(t, path.Join(cachedir, duDir))
+	ht := New(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	expectStatus(t, "GET", "/du?cmd=du&depth=-1", http.StatusBadRequest)
+	expectStatus(t, "GET", "/no-such-dir?cmd=du", http.StatusNotFound)
+
+	s := getDu(t, "/du?cmd=du")
+	if s.Name != "du" || s.Size != 100+int64(len("b")) || s.Files != 5 || s.Dirs != 26 || s.Children != nil {
+		t.Fatal(s)
+	}
+	fis, err := ioutil.ReadDir(path.Join(cachedir, duDir))
+	if err != nil || len(fis) != 1 {
+		t.Fail()
+	}
+
+	s = getDu(t, "/du?cmd=du&depth=1")
+	if len(s.Children) != 4 {
+		t.Fatal(s.Children)
+	}
+	for _, c := range s.Children {
+		switch c.Name {
+		case "a":
+			if c.Size != 30 || c.Files != 2 || c.Dirs != 24 || c.Children != nil {
+				t.Fail()
+			}
+		case "b":
+			if c.Size != 30 || c.Files != 1 || c.Dirs != 0 {
+				t.Fail()
+			}
+		case "4":
+			if c.Size != 40 || c.Files != 1 {
+				t.Fail()
+			}
+		case "link":
+			if c.Files != 1 {
+				t.Fail()
+			}
+		default:
+			t.Fail()
+		}
+	}
+
+	// the cached totals are invalidated by the changes
+	tst.Htreq(t, "PUT", tst.S.URL+"/du/a/x/y/5", bytes.NewBufferString("12345"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+	})
+	if s = getDu(t, "/du/a?cmd=du"); s.Size != 35 || s.Files != 3 {
+		t.Fail()
+	}
+
+	// and by the changes through symlinks
+	if s = getDu(t, "/du/b?cmd=du"); s.Size != 30 || s.Files != 1 {
+		t.Fail()
+	}
+	tst.Htreq(t, "PUT", tst.S.URL+"/du/link/6", bytes.NewBufferString("123456"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+	})
+	if s = getDu(t, "/du/b?cmd=du"); s.Size != 36 || s.Files != 2 {
+		t.Fail()
+	}
+	expectStatus(t, "DELETE", "/du/b", http.StatusOK)
+	if s = getDu(t, "/du?cmd=du"); s.Size != 76 || s.Files != 5 || s.Dirs != 25 {
+		t.Fail()
+	}
+	ht.(*handler).Close()
+
+	// without cachedir
+	ht = New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	if s = getDu(t, "/du/4?cmd=du&depth=1"); s.Size != 40 || s.Files != 1 || s.Children != nil {
+		t.Fail()
+	}
+}
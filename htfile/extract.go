@@ -0,0 +1,307 @@
+package htfile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const extractTempPrefix = "extract"
+
+type archiveEntry struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	link    string
+	open    func() (io.ReadCloser, error)
+}
+
+type extractFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+type extractResult struct {
+	Extracted int               `json:"extracted"`
+	Failed    []*extractFailure `json:"failed"`
+}
+
+var (
+	invalidEntryPath     = errors.New("Invalid entry path.")
+	unsupportedEntryType = errors.New("Unsupported entry type.")
+	entryTooLarge        = errors.New("Entry too large.")
+)
+
+// the format is taken from the query or, if missing, from the content type
+func getExtractFormat(r *http.Request, qry url.Values) (string, bool) {
+	formats := qry[archiveFormatKey]
+	if len(formats) > 1 {
+		return "", false
+	}
+	if len(formats) == 1 {
+		_, ok := archiveContentTypes[formats[0]]
+		return formats[0], ok
+	}
+	ct := r.Header.Get(share.HeaderContentType)
+	for f, fct := range archiveContentTypes {
+		if fct == ct {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+func forEachTar(r io.Reader, compressed bool, do func(*archiveEntry)) error {
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer share.Doretlog42(gz.Close)
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := &archiveEntry{
+			name:    hdr.Name,
+			mode:    hdr.FileInfo().Mode(),
+			modTime: hdr.ModTime,
+			open:    func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil }}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			e.link = hdr.Linkname
+		case tar.TypeLink:
+			e.mode = os.ModeIrregular
+		}
+		do(e)
+	}
+}
+
+// zip needs random access, the body is stored in a temporary file first
+func (h *handler) forEachZip(r io.Reader, do func(*archiveEntry)) error {
+	f, err := ioutil.TempFile(h.cachedir, extractTempPrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		share.Doretlog42(f.Close)
+		share.Doretlog42(func() error { return os.Remove(f.Name()) })
+	}()
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, n)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		e := &archiveEntry{
+			name:    zf.Name,
+			mode:    zf.Mode(),
+			modTime: zf.Modified,
+			open:    zf.Open}
+		if e.mode&os.ModeSymlink != 0 {
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+			share.Doretlog42(rc.Close)
+			if err != nil {
+				return err
+			}
+			e.link = string(b)
+		}
+		do(e)
+	}
+	return nil
+}
+
+// checks that a path, after resolving the symlinks in it, is still inside the root
+func (h *handler) checkResolved(p string) error {
+	rp, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	in, err := h.withinRoot(rp)
+	if err != nil {
+		return err
+	}
+	if !in {
+		return invalidEntryPath
+	}
+	return nil
+}
+
+func (h *handler) extractFile(p string, e *archiveEntry) error {
+	err := os.MkdirAll(path.Dir(p), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = h.checkResolved(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	p, fi, err := prepareTarget(p)
+	if err != nil {
+		return err
+	}
+	err = h.checkResolved(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	rc, err := e.open()
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(rc.Close)
+	_, err = h.replaceFile(p, fi, nil, func(f *os.File) error {
+		if fi == nil {
+			err := f.Chmod(e.mode.Perm())
+			if err != nil {
+				return err
+			}
+		}
+		if h.maxRequestBody <= 0 {
+			_, err := io.Copy(f, rc)
+			return err
+		}
+		n, err := io.Copy(f, io.LimitReader(rc, h.maxRequestBody+1))
+		if err == nil && n > h.maxRequestBody {
+			err = entryTooLarge
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if e.modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(p, e.modTime, e.modTime)
+}
+
+// symlinks are created only if the symlink policy allows them, and they point inside the root after
+// resolving the symlinks in their target. Absolute targets are not portable, and they are rejected.
+func (h *handler) extractLink(p string, e *archiveEntry) error {
+	if h.symlinks == symlinksNever || path.IsAbs(e.link) {
+		return invalidEntryPath
+	}
+	err := os.MkdirAll(path.Dir(p), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = h.checkResolved(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.EvalSymlinks(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	target, err := h.linkTarget(dir, e.link)
+	if err == invalidPath {
+		return invalidEntryPath
+	}
+	if err != nil {
+		return err
+	}
+	err = removeIfExists(p)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, p)
+}
+
+func (h *handler) extractEntry(dir string, e *archiveEntry) error {
+	p := path.Join(dir, e.name)
+	if pathIntersect(dir, p) != leftContains {
+		return invalidEntryPath
+	}
+	switch {
+	case e.mode.IsDir():
+		err := os.MkdirAll(p, os.ModePerm)
+		if err != nil {
+			return err
+		}
+		return h.checkResolved(p)
+	case e.mode&os.ModeSymlink != 0:
+		return h.extractLink(p, e)
+	case e.mode.IsRegular():
+		return h.extractFile(p, e)
+	default:
+		return unsupportedEntryType
+	}
+}
+
+func (h *handler) extractf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	dir, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	format, ok := getExtractFormat(r, qry)
+	if !share.CheckBadReq(w, ok) {
+		return
+	}
+	fi, err := os.Stat(dir)
+	if !share.CheckHandle(w, err != nil || fi.IsDir(), http.StatusNotFound) {
+		return
+	}
+	err = os.MkdirAll(dir, os.ModePerm)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+
+	var rr io.Reader = r.Body
+	var mr *share.MaxReader
+	if h.maxRequestBody > 0 {
+		mr = &share.MaxReader{Reader: rr, Count: h.maxRequestBody}
+		rr = mr
+	}
+	res := &extractResult{Failed: make([]*extractFailure, 0)}
+	do := func(e *archiveEntry) {
+		// the root entry of the archive, e.g. ./, is the target directory itself
+		if e.mode.IsDir() && pathIntersect(dir, path.Join(dir, e.name)) == samePath {
+			return
+		}
+		err := h.extractEntry(dir, e)
+		if err == nil {
+			res.Extracted++
+			return
+		}
+		if perr, ok := err.(*os.PathError); ok {
+			err = perr.Err
+		}
+		res.Failed = append(res.Failed, &extractFailure{Name: e.name, Error: err.Error()})
+	}
+	switch format {
+	case formatZip:
+		err = h.forEachZip(rr, do)
+	default:
+		err = forEachTar(rr, format == formatTarGz, do)
+	}
+	if !share.CheckHandle(w, mr == nil || mr.Count > 0, http.StatusRequestEntityTooLarge) ||
+		!share.CheckBadReq(w, err == nil) {
+		return
+	}
+	_, err = share.WriteJsonResponse(w, r, res)
+	share.CheckServerError(w, err != share.MarshalError)
+}
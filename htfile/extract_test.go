@@ -0,0 +1,246 @@
+package htfile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+}
+
+func makeTar(t *testing.T, entries []testEntry) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0640,
+			ModTime:  time.Unix(1234567890, 0)}
+		switch e.typeflag {
+		case tar.TypeDir:
+			hdr.Mode = 0750
+		case tar.TypeSymlink, tar.TypeLink:
+			hdr.Linkname = e.content
+		default:
+			hdr.Size = int64(len(e.content))
+		}
+		err := tw.WriteHeader(hdr)
+		tst.ErrFatal(t, err)
+		if e.typeflag == tar.TypeReg {
+			_, err = tw.Write([]byte(e.content))
+			tst.ErrFatal(t, err)
+		}
+	}
+	err := tw.Close()
+	tst.ErrFatal(t, err)
+	return buf.Bytes()
+}
+
+func extractReq(t *testing.T, method, url string, body []byte, ct string, clb func(*http.Response)) {
+	r, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	tst.ErrFatal(t, err)
+	if ct != "" {
+		r.Header.Set("Content-Type", ct)
+	}
+	tst.Htreqr(t, r, clb)
+}
+
+func readExtractResult(t *testing.T, rsp *http.Response) *extractResult {
+	if rsp.StatusCode != http.StatusOK {
+		t.Fatal(rsp.StatusCode)
+	}
+	res := new(extractResult)
+	err := json.NewDecoder(rsp.Body).Decode(res)
+	tst.ErrFatal(t, err)
+	return res
+}
+
+func checkFileContent(t *testing.T, p, content string) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil || string(b) != content {
+		t.Log(p, err)
+		t.Fail()
+	}
+}
+
+func TestExtractInvalid(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "extract")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	tst.WithNewFileF(t, path.Join(dir, "file"), nil)
+	tb := makeTar(t, []testEntry{{"file", tar.TypeReg, "content"}})
+	for _, c := range []struct {
+		url    string
+		body   []byte
+		ct     string
+		status int
+	}{
+		{"/extract?cmd=extract", tb, "", http.StatusBadRequest},
+		{"/extract?cmd=extract&format=rar", tb, "", http.StatusBadRequest},
+		{"/extract?cmd=extract&format=tar", []byte("not an archive"), "", http.StatusBadRequest},
+		{"/extract?cmd=extract&format=zip", []byte("not an archive"), "", http.StatusBadRequest},
+		{"/extract/file?cmd=extract&format=tar", tb, "", http.StatusNotFound},
+		{"/extract?cmd=extract", tb, "text/plain", http.StatusBadRequest},
+	} {
+		extractReq(t, "PUT", tst.S.URL+c.url, c.body, c.ct, func(rsp *http.Response) {
+			if rsp.StatusCode != c.status {
+				t.Log(c.url, rsp.StatusCode)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "extract")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	tst.WithNewFileF(t, path.Join(dir, "existing"), func(f *os.File) error {
+		_, err := f.Write([]byte("old content"))
+		return err
+	})
+	tb := makeTar(t, []testEntry{
+		{"./", tar.TypeDir, ""},
+		{"sub/", tar.TypeDir, ""},
+		{"sub/file0", tar.TypeReg, "content0"},
+		{"other/file1", tar.TypeReg, "content1"},
+		{"existing", tar.TypeReg, "new content"},
+		{"sub/link", tar.TypeSymlink, "file0"},
+		{"../escaped", tar.TypeReg, "escaped"},
+		{"escaping-link", tar.TypeSymlink, "../../.."},
+		{"hardlink", tar.TypeLink, "sub/file0"}})
+	extractReq(t, "PUT", tst.S.URL+"/extract/target?cmd=extract&format=tar", tb, "", func(rsp *http.Response) {
+		res := readExtractResult(t, rsp)
+		if res.Extracted != 5 || len(res.Failed) != 3 ||
+			res.Failed[0].Name != "../escaped" || res.Failed[1].Name != "escaping-link" ||
+			res.Failed[2].Name != "hardlink" {
+			t.Log(res)
+			t.Fail()
+		}
+	})
+	target := path.Join(dir, "target")
+	checkFileContent(t, path.Join(target, "sub/file0"), "content0")
+	checkFileContent(t, path.Join(target, "other/file1"), "content1")
+	checkFileContent(t, path.Join(target, "existing"), "new content")
+	checkFileContent(t, path.Join(target, "sub/link"), "content0")
+	fi, err := os.Lstat(path.Join(target, "sub/file0"))
+	if err != nil || fi.Mode().Perm() != 0640 || fi.ModTime().Unix() != 1234567890 {
+		t.Fail()
+	}
+	for _, p := range []string{path.Join(dir, "escaped"), path.Join(target, "escaping-link")} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Fail()
+		}
+	}
+
+	// a link pointing outside of the root cannot be written through
+	err = os.Symlink("/", path.Join(target, "root-link"))
+	tst.ErrFatal(t, err)
+	tb = makeTar(t, []testEntry{
+		{"root-link/tmp/escaped", tar.TypeReg, "escaped"},
+		{"tmp-link", tar.TypeSymlink, "root-link/tmp"}})
+	extractReq(t, "POST", tst.S.URL+"/extract/target?cmd=extract", tb, "application/x-tar",
+		func(rsp *http.Response) {
+			res := readExtractResult(t, rsp)
+			if res.Extracted != 0 || len(res.Failed) != 2 {
+				t.Fail()
+			}
+		})
+	for _, p := range []string{"/tmp/escaped", path.Join(target, "tmp-link")} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Fail()
+		}
+	}
+
+	// no symlinks when they are never followed
+	ht = New(&testOptions{root: dn, symlinks: symlinksNever})
+	tst.Thnd.Sh = ht.ServeHTTP
+	tb = makeTar(t, []testEntry{{"sub/other-link", tar.TypeSymlink, "file0"}})
+	extractReq(t, "POST", tst.S.URL+"/extract/target?cmd=extract", tb, "application/x-tar",
+		func(rsp *http.Response) {
+			res := readExtractResult(t, rsp)
+			if res.Extracted != 0 || len(res.Failed) != 1 {
+				t.Fail()
+			}
+		})
+}
+
+func TestExtractZip(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "extract")
+	tst.RemoveIfExistsF(t, dir)
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, e := range []testEntry{{"file0", 0, "content0"}, {"sub/file1", 0, "content1"}, {"../escaped", 0, ""}} {
+		wr, err := zw.Create(e.name)
+		tst.ErrFatal(t, err)
+		_, err = wr.Write([]byte(e.content))
+		tst.ErrFatal(t, err)
+	}
+	err := zw.Close()
+	tst.ErrFatal(t, err)
+	extractReq(t, "POST", tst.S.URL+"/extract?cmd=extract", buf.Bytes(), "application/zip",
+		func(rsp *http.Response) {
+			res := readExtractResult(t, rsp)
+			if res.Extracted != 2 || len(res.Failed) != 1 || res.Failed[0].Name != "../escaped" {
+				t.Fail()
+			}
+		})
+	checkFileContent(t, path.Join(dir, "file0"), "content0")
+	checkFileContent(t, path.Join(dir, "sub/file1"), "content1")
+}
+
+func TestExtractArchived(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	makeArchiveTree(t)
+	dir := path.Join(dn, "extract")
+	tst.RemoveIfExistsF(t, dir)
+	extractReq(t, "PUT", tst.S.URL+"/extract?cmd=extract&format=tar.gz",
+		getArchive(t, "cmd=archive&format=tar.gz"), "", func(rsp *http.Response) {
+			res := readExtractResult(t, rsp)
+			if res.Extracted != len(allArchiveEntries) || len(res.Failed) != 0 {
+				t.Fail()
+			}
+		})
+	for n, c := range allArchiveEntries {
+		if c == "" || c[0] == '-' {
+			continue
+		}
+		checkFileContent(t, path.Join(dir, n), c)
+	}
+}
+
+func TestExtractMaxRequestBody(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxRequestBody: 1024})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "extract")
+	tst.RemoveIfExistsF(t, dir)
+	tb := makeTar(t, []testEntry{{"file", tar.TypeReg, string(make([]byte, 2048))}})
+	extractReq(t, "PUT", tst.S.URL+"/extract?cmd=extract&format=tar", tb, "", func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fail()
+		}
+	})
+	if _, err := os.Lstat(path.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,308 @@
+package htfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	searchQueryContext    = "context"
+	searchQueryMaxMatches = "maxMatches"
+
+	defaultMaxMatches = 10
+	maxSearchContext  = 20
+
+	// the part of a line after this length is not searched
+	maxLineLength = 1 << 16
+
+	// the returned lines are cut at this length
+	maxSnippetLength = 1 << 10
+)
+
+// a matching line, with the line number starting from 1, and the context lines before and after it
+type contentMatch struct {
+	Line   int      `json:"line"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// the media types searched by content by default are the known text types
+func defaultSearchTypes() []string {
+	var types []string
+	for _, ct := range textMimeTypes {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			continue
+		}
+		found := false
+		for _, t := range types {
+			if t == mt {
+				found = true
+				break
+			}
+		}
+		if !found {
+			types = append(types, mt)
+		}
+	}
+	return types
+}
+
+// parses a comma separated list of media types, where the subtype can be *, e.g. text/*
+func parseSearchTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			types = append(types, t)
+		}
+	}
+	if len(types) == 0 {
+		return defaultSearchTypes()
+	}
+	return types
+}
+
+func (h *handler) searchable(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	for _, t := range h.searchTypes {
+		if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return h.mimeTypes.isText(mt)
+}
+
+type grepOptions struct {
+	rx         *regexp.Regexp
+	context    int
+	maxMatches int
+}
+
+func getQryGrepOptions(qry url.Values, rx *regexp.Regexp) (*grepOptions, error) {
+	context, err := getQryNum(qry, searchQueryContext)
+	if err != nil || context < 0 {
+		return nil, invalidQueryString
+	}
+	if context > maxSearchContext {
+		context = maxSearchContext
+	}
+	maxMatches, err := getQryNum(qry, searchQueryMaxMatches)
+	if err != nil || maxMatches < 0 {
+		return nil, invalidQueryString
+	}
+	if maxMatches == 0 {
+		maxMatches = defaultMaxMatches
+	}
+	return &grepOptions{rx: rx, context: context, maxMatches: maxMatches}, nil
+}
+
+// decodes UTF-16 to UTF-8
+type utf16Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	buf   []byte
+}
+
+func (u *utf16Reader) readUnit() (uint16, error) {
+	var b [2]byte
+	_, err := io.ReadFull(u.r, b[:])
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return u.order.Uint16(b[:]), err
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.buf) < len(p) {
+		c, err := u.readUnit()
+		if err != nil {
+			if len(u.buf) > 0 {
+				break
+			}
+			return 0, err
+		}
+		r := rune(c)
+		if utf16.IsSurrogate(r) {
+			c2, err := u.readUnit()
+			if err != nil {
+				r = utf8.RuneError
+			} else {
+				r = utf16.DecodeRune(r, rune(c2))
+			}
+		}
+		var rb [utf8.UTFMax]byte
+		u.buf = append(u.buf, rb[:utf8.EncodeRune(rb[:], r)]...)
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	return n, nil
+}
+
+// detects UTF-16 from the byte order mark, the charset of the content type, or the position of the
+// zero bytes in the head of the file. Returns nil when the content is binary.
+func textReader(f io.Reader, ct string) io.Reader {
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(512)
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(head, []byte{0xef, 0xbb, 0xbf}):
+		br.Discard(3)
+	case bytes.HasPrefix(head, []byte{0xff, 0xfe}):
+		br.Discard(2)
+		order = binary.LittleEndian
+	case bytes.HasPrefix(head, []byte{0xfe, 0xff}):
+		br.Discard(2)
+		order = binary.BigEndian
+	default:
+		if _, params, err := mime.ParseMediaType(ct); err == nil {
+			switch strings.ToLower(params["charset"]) {
+			case "utf-16le":
+				order = binary.LittleEndian
+			case "utf-16be", "utf-16":
+				order = binary.BigEndian
+			}
+		}
+		if order == nil {
+			var even, odd int
+			for i, b := range head {
+				if b == 0 {
+					if i%2 == 0 {
+						even++
+					} else {
+						odd++
+					}
+				}
+			}
+			switch {
+			case odd > len(head)/4 && even == 0:
+				order = binary.LittleEndian
+			case even > len(head)/4 && odd == 0:
+				order = binary.BigEndian
+			case even+odd > 0:
+				return nil
+			}
+		}
+	}
+	if order == nil {
+		return br
+	}
+	return &utf16Reader{r: br, order: order}
+}
+
+// reads a line without the line ending, cut at maxLineLength
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, isPrefix, err := r.ReadLine()
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if len(line) < maxLineLength {
+			line = append(line, b...)
+			if len(line) > maxLineLength {
+				line = line[:maxLineLength]
+			}
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func snippet(line string) string {
+	if len(line) > maxSnippetLength {
+		return line[:maxSnippetLength]
+	}
+	return line
+}
+
+// returns the matching lines with their context, until the maximum number of matches is reached
+func grep(r io.Reader, o *grepOptions) ([]*contentMatch, error) {
+	var (
+		matches []*contentMatch
+		before  []string
+		pending []*contentMatch
+		n       int
+	)
+	br := bufio.NewReader(r)
+	for len(matches) < o.maxMatches || len(pending) > 0 {
+		line, err := readLine(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		n++
+		if strings.ContainsRune(line, 0) {
+			return nil, nil
+		}
+		s := snippet(line)
+		var stillPending []*contentMatch
+		for _, m := range pending {
+			m.After = append(m.After, s)
+			if len(m.After) < o.context {
+				stillPending = append(stillPending, m)
+			}
+		}
+		pending = stillPending
+		if len(matches) < o.maxMatches && o.rx.MatchString(line) {
+			m := &contentMatch{Line: n, Text: s, Before: append([]string(nil), before...)}
+			matches = append(matches, m)
+			if o.context > 0 {
+				pending = append(pending, m)
+			}
+		}
+		if o.context > 0 {
+			before = append(before, s)
+			if len(before) > o.context {
+				before = before[1:]
+			}
+		}
+	}
+	return matches, nil
+}
+
+// searches a file by content, when its type is searchable
+func (h *handler) grepFile(fi *fileInfo, o *grepOptions) []*contentMatch {
+	if fi.IsDir() {
+		return nil
+	}
+	f, err := os.Open(path.Join(fi.dirname, fi.Name()))
+	if err != nil {
+		return nil
+	}
+	defer share.Doretlog42(f.Close)
+	ct, err := h.contentType(fi.Name(), f)
+	if err != nil || !h.searchable(ct) {
+		return nil
+	}
+	r := textReader(f, ct)
+	if r == nil {
+		return nil
+	}
+	matches, err := grep(r, o)
+	if err != nil {
+		return nil
+	}
+	return matches
+}
@@ -0,0 +1,143 @@
+package htfile
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func encodeUtf16(s string, order binary.ByteOrder, bom bool) []byte {
+	var b []byte
+	if bom {
+		b = make([]byte, 2)
+		order.PutUint16(b, 0xfeff)
+	}
+	for _, u := range utf16.Encode([]rune(s)) {
+		ub := make([]byte, 2)
+		order.PutUint16(ub, u)
+		b = append(b, ub...)
+	}
+	return b
+}
+
+func initGrep(t *testing.T) string {
+	dir := path.Join(dn, "grep")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	for n, c := range map[string][]byte{
+		"lines.txt":   []byte("one\ntwo\nthree match\nfour\nfive\nsix match\r\nseven"),
+		"binary":      append([]byte("match"), 0, 1, 2, 3),
+		"data.json":   []byte("{\"match\": true}"),
+		"utf16le.txt": encodeUtf16("first\nsecond match\n", binary.LittleEndian, true),
+		"utf16be.txt": encodeUtf16("first match\n", binary.BigEndian, false),
+		"long.txt":    []byte(strings.Repeat("x", maxLineLength+10) + "match\nmatch\n")} {
+		err := ioutil.WriteFile(path.Join(dir, n), c, os.ModePerm)
+		tst.ErrFatal(t, err)
+	}
+	return dir
+}
+
+func grepSearch(t *testing.T, qry string) map[string][]*contentMatch {
+	return grepSearchIn(t, "/grep", qry)
+}
+
+func grepSearchIn(t *testing.T, dir, qry string) map[string][]*contentMatch {
+	result := make(map[string][]*contentMatch)
+	tst.Htreq(t, "SEARCH", tst.S.URL+dir+qry, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(qry, rsp.StatusCode)
+		}
+		var ms []struct {
+			Name    string
+			Matches []*contentMatch
+		}
+		err := json.NewDecoder(rsp.Body).Decode(&ms)
+		tst.ErrFatal(t, err)
+		for _, m := range ms {
+			result[m.Name] = m.Matches
+		}
+	})
+	return result
+}
+
+func TestGrep(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxSearchResults: 30})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initGrep(t)
+	expectStatus(t, "SEARCH", "/grep?content=match&context=-1", http.StatusBadRequest)
+	expectStatus(t, "SEARCH", "/grep?content=match&maxMatches=x", http.StatusBadRequest)
+
+	result := grepSearch(t, "?content=match")
+	if len(result) != 4 {
+		t.Log(result)
+		t.Fail()
+	}
+	ms := result["lines.txt"]
+	if len(ms) != 2 || ms[0].Line != 3 || ms[0].Text != "three match" ||
+		ms[1].Line != 6 || ms[1].Text != "six match" || ms[0].Before != nil {
+		t.Fail()
+	}
+	if ms := result["utf16le.txt"]; len(ms) != 1 || ms[0].Line != 2 || ms[0].Text != "second match" {
+		t.Fail()
+	}
+	if ms := result["utf16be.txt"]; len(ms) != 1 || ms[0].Text != "first match" {
+		t.Fail()
+	}
+
+	// the part of long lines is not searched after the limit
+	if ms := result["long.txt"]; len(ms) != 1 || ms[0].Line != 2 {
+		t.Fail()
+	}
+
+	result = grepSearch(t, "?content=match&maxMatches=1&context=2&name=lines")
+	ms = result["lines.txt"]
+	if len(ms) != 1 || strings.Join(ms[0].Before, ",") != "one,two" || strings.Join(ms[0].After, ",") != "four,five" {
+		t.Fail()
+	}
+
+	// configured types
+	ht = New(&testOptions{root: dn, maxSearchResults: 30, searchTypes: "application/json, text/x-none"})
+	tst.Thnd.Sh = ht.ServeHTTP
+	result = grepSearch(t, "?content=match")
+	if len(result) != 1 || result["data.json"] == nil {
+		t.Fail()
+	}
+}
+
+func TestGrepContext(t *testing.T) {
+	rx := regexp.MustCompile("m")
+	ms, err := grep(strings.NewReader("a\nm1\nb\nm2\nc\nd"), &grepOptions{rx: rx, context: 2, maxMatches: 10})
+	tst.ErrFatal(t, err)
+	if len(ms) != 2 ||
+		strings.Join(ms[0].Before, ",") != "a" || strings.Join(ms[0].After, ",") != "b,m2" ||
+		strings.Join(ms[1].Before, ",") != "m1,b" || strings.Join(ms[1].After, ",") != "c,d" {
+		t.Fail()
+	}
+}
+
+func TestSearchTypes(t *testing.T) {
+	h := &handler{searchTypes: parseSearchTypes("")}
+	for ct, expect := range map[string]bool{
+		"text/plain; charset=utf-8": true,
+		"text/html":                 true,
+		"application/x-javascript":  true,
+		"application/json":          false,
+		"image/png":                 false} {
+		if h.searchable(ct) != expect {
+			t.Log(ct)
+			t.Fail()
+		}
+	}
+	h.searchTypes = parseSearchTypes("Text/*")
+	if !h.searchable("text/csv") || h.searchable("application/json") {
+		t.Fail()
+	}
+}
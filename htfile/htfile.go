@@ -1,7 +1,7 @@
 package htfile
 
 import (
-	"bufio"
+	"crypto/rand"
 	"github.com/aryszka/tasked/share"
 	"encoding/json"
 	"errors"
@@ -16,6 +16,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -26,6 +27,7 @@ const (
 	searchQueryName    = "name"
 	searchQueryContent = "content"
 	copyRenameToKey    = "to"
+	appendOffsetKey    = "offset"
 )
 
 type fileInfo struct {
@@ -46,12 +48,43 @@ type handler struct {
 	dn               string
 	maxRequestBody   int64
 	maxSearchResults int
+	fsyncFiles       bool
+	fsyncDirs        bool
+	cachedir         string
+	uploadExpiry     int
+	maxUploadSize    int64
+	trash            bool
+	trashExpiry      int
+	trashMaxSize     int64
+	maxVersions      int
+	versionExpiry    int
+	symlinks         string
+	searchTypes      []string
+	index            *searchIndex
+	du               *duCache
+	compressMinSize  int64
+	mimeTypes        *mimeTypes
 }
 
 type Options interface {
 	Root() string
+	Cachedir() string
 	MaxRequestBody() int64
 	MaxSearchResults() int
+	FsyncFiles() bool
+	FsyncDirs() bool
+	UploadExpiry() int
+	MaxUploadSize() int64
+	Trash() bool
+	TrashExpiry() int
+	TrashMaxSize() int64
+	MaxVersions() int
+	VersionExpiry() int
+	Symlinks() string
+	SearchTypes() string
+	SearchIndex() int
+	CompressMinSize() int
+	MimeTypes() string
 }
 
 type pathMatch int
@@ -74,6 +107,10 @@ var (
 		"txt16b": "text/plain; charset=utf-16be"}
 	invalidQueryString = errors.New("Invalid querystring.")
 	invalidPath        = errors.New("Invalid path.")
+	invalidRange       = errors.New("Invalid range.")
+	invalidProps       = errors.New("Invalid properties.")
+	preconditionFailed = errors.New("Precondition failed.")
+	headerContentRange = http.CanonicalHeaderKey("content-range")
 )
 
 func replaceMode(n, m os.FileMode) os.FileMode {
@@ -102,6 +139,10 @@ func toPropertyMap(fi os.FileInfo, ext bool) map[string]interface{} {
 	}
 	if fii, ok := fi.(*fileInfo); ok {
 		m["dirname"] = fii.dirname
+		fi = fii.sys
+	}
+	if li, ok := fi.(*linkInfo); ok {
+		m["link"] = li.link
 	}
 	return m
 }
@@ -149,6 +190,78 @@ func isOwner(u *user.User, fi os.FileInfo) (bool, error) {
 	return strconv.FormatUint(uint64(sstat.Uid), 10) == u.Uid, nil
 }
 
+func etag(fi os.FileInfo) string {
+	var ino uint64
+	if sstat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		ino = sstat.Ino
+	}
+	return fmt.Sprintf("\"%x-%x-%x\"", ino, fi.Size(), fi.ModTime().UnixNano())
+}
+
+func matchEtag(list, et string) bool {
+	for _, t := range strings.Split(list, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+
+		// the etag of the gzip encoded representation validates the file, too
+		if t == "*" || t == et || t == gzipEtag(et) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns preconditionFailed when the If-Match or If-None-Match header of the request doesn't hold for p
+func preconditions(r *http.Request, p string) error {
+	if r == nil {
+		return nil
+	}
+	ifm := r.Header.Get(share.HeaderIfMatch)
+	ifnm := r.Header.Get(share.HeaderIfNoneMatch)
+	if ifm == "" && ifnm == "" {
+		return nil
+	}
+	// symlinks are compared by the etag of their target, the same way as served by GET
+	fi, err := os.Stat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+	et := ""
+	if exists {
+		et = etag(fi)
+	}
+	if ifm != "" && !(exists && matchEtag(ifm, et)) || ifnm != "" && exists && matchEtag(ifnm, et) {
+		return preconditionFailed
+	}
+	return nil
+}
+
+// tells whether the request may only create the target, with If-None-Match: *
+func createOnly(r *http.Request) bool {
+	return r != nil && strings.TrimSpace(r.Header.Get(share.HeaderIfNoneMatch)) == "*"
+}
+
+func checkPreconditions(w http.ResponseWriter, r *http.Request, p string) bool {
+	err := preconditions(r, p)
+	return share.CheckHandle(w, err != preconditionFailed, http.StatusPreconditionFailed) &&
+		share.CheckOsError(w, err)
+}
+
+// runs a function while holding an exclusive lock on the directory of p, shared by all processes. The
+// lock is taken on the directory, because the replaced files change their inode.
+func withDirLock(p string, f func() error) error {
+	d, err := os.Open(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(d.Close)
+	err = syscall.Flock(int(d.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	return f()
+}
+
 func detectContentType(name string, f *os.File) (ct string, err error) {
 	ct = mime.TypeByExtension(filepath.Ext(name))
 	if len(ct) > 0 {
@@ -167,80 +280,78 @@ func detectContentType(name string, f *os.File) (ct string, err error) {
 	return
 }
 
-func searchFiles(dirs []*fileInfo, max int, qry func(fi *fileInfo) bool) []*fileInfo {
-	if max <= 0 || len(dirs) == 0 {
-		return nil
-	}
-	return append(func() (res []*fileInfo) {
-		di := dirs[0]
-		dirs = dirs[1:]
-		p := path.Join(di.dirname, di.Name())
-		d, err := os.Open(p)
+func createTemp(p string, mode os.FileMode) (*os.File, error) {
+	b := make([]byte, 6)
+	for {
+		_, err := rand.Read(b)
 		if err != nil {
-			return
+			return nil, err
 		}
-		defer share.Doretlog42(d.Close)
-		fis, err := d.Readdir(0)
-		if err != nil {
-			return
+		tp := path.Join(path.Dir(p), fmt.Sprintf(".%s.%x", path.Base(p), b))
+		f, err := os.OpenFile(tp, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+		if !os.IsExist(err) {
+			return f, err
 		}
-		for _, fi := range fis {
-			fii := &fileInfo{sys: fi, dirname: p}
-			if qry(fii) {
-				res = append(res, fii)
-				max = max - 1
-				if max == 0 {
-					return res
-				}
-			}
-			if fii.IsDir() {
-				dirs = append(dirs, fii)
-			}
+	}
+}
+
+// resolves symlinks, creates the missing parent directories, and checks that an existing target can be
+// overwritten. Returns nil file info when the target doesn't exist.
+func prepareTarget(p string) (string, os.FileInfo, error) {
+	err := os.MkdirAll(path.Dir(p), os.ModePerm)
+	if err != nil {
+		return "", nil, err
+	}
+	fi, err := os.Lstat(p)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		p, err = filepath.EvalSymlinks(p)
+		if err == nil {
+			fi, err = os.Lstat(p)
 		}
-		return
-	}(), searchFiles(dirs, max, qry)...)
+	}
+	if os.IsNotExist(err) {
+		return p, nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	// fails the same way as truncating would, on directories or without write permission
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	share.Doretlog42(f.Close)
+	return p, fi, nil
 }
 
-func copyTree(from, to string) error {
-	if from == to {
+// sets the mode, the owner and the user extended attributes of the replaced file p on its replacement
+func inheritProps(f *os.File, p string, fi os.FileInfo) error {
+	if fi == nil {
 		return nil
 	}
-	fi, err := os.Lstat(from)
+	err := f.Chmod(fi.Mode())
 	if err != nil {
 		return err
 	}
-	ff, err := os.Open(from)
+	if sstat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		// best effort, only root can give away files
+		f.Chown(int(sstat.Uid), int(sstat.Gid))
+	}
+	err = copyXattrs(p, f.Name(), xattrUserPrefix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func syncDir(dn string) error {
+	d, err := os.Open(dn)
 	if err != nil {
 		return err
 	}
-	defer share.Doretlog42(ff.Close)
-	if fi.IsDir() {
-		err = os.Mkdir(to, os.ModePerm)
-		if err != nil {
-			return err
-		}
-		fis, err := ff.Readdir(0)
-		if err != nil {
-			return err
-		}
-		for _, fii := range fis {
-			err = copyTree(path.Join(from, fii.Name()), path.Join(to, fii.Name()))
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		tf, err := os.Create(to)
-		if err != nil {
-			return err
-		}
-		defer share.Doretlog42(tf.Close)
-		_, err = io.Copy(tf, ff)
-		if err != nil {
-			return err
-		}
-	}
-	return os.Chmod(to, fi.Mode())
+	defer share.Doretlog42(d.Close)
+	return d.Sync()
 }
 
 func getQryNum(qry url.Values, key string) (int, error) {
@@ -254,6 +365,49 @@ func getQryNum(qry url.Values, key string) (int, error) {
 	return strconv.Atoi(ns[0])
 }
 
+func getQryNum64(qry url.Values, key string) (int64, bool, error) {
+	ns, ok := qry[key]
+	if !ok {
+		return 0, false, nil
+	}
+	if len(ns) != 1 {
+		return 0, false, invalidQueryString
+	}
+	n, err := strconv.ParseInt(ns[0], 10, 64)
+	return n, true, err
+}
+
+// accepts only the complete form, e.g. bytes 0-499/1234 or bytes 0-499/*
+func parseContentRange(cr string) (int64, int64, error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(cr, prefix) {
+		return 0, 0, invalidRange
+	}
+	cr = cr[len(prefix):]
+	sl := strings.Index(cr, "/")
+	if sl < 0 {
+		return 0, 0, invalidRange
+	}
+	if cr[sl+1:] != "*" {
+		if _, err := strconv.ParseUint(cr[sl+1:], 10, 63); err != nil {
+			return 0, 0, invalidRange
+		}
+	}
+	se := strings.Split(cr[:sl], "-")
+	if len(se) != 2 {
+		return 0, 0, invalidRange
+	}
+	start, err := strconv.ParseInt(se[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, invalidRange
+	}
+	end, err := strconv.ParseInt(se[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, invalidRange
+	}
+	return start, end + 1 - start, nil
+}
+
 func getQryExpression(qry url.Values, key string) (*regexp.Regexp, error) {
 	exprs := qry[key]
 	if len(exprs) > 1 {
@@ -269,13 +423,106 @@ func getQryExpression(qry url.Values, key string) (*regexp.Regexp, error) {
 	return regexp.Compile(expr)
 }
 
+// returns the path in the root. The symlinks are resolved, and the resolved path needs to be in the root,
+// too.
 func (h *handler) getPath(p string) (string, error) {
-	p = path.Join(h.dn, p)
-	i := pathIntersect(h.dn, p)
-	if i < leftContains {
-		return "", invalidPath
+	return h.checkPath(p, true)
+}
+
+// returns the path in the root, like getPath, but the last element is not resolved when it is a symlink,
+// so that the link itself can be handled
+func (h *handler) getLinkPath(p string) (string, error) {
+	return h.checkPath(p, false)
+}
+
+// moves a temporary file in place. The preconditions of the request, when not nil, are checked while
+// holding the lock of the directory, and the create only requests fail, instead of replacing a file
+// created in the meantime.
+func (h *handler) commitTemp(f *os.File, p string, r *http.Request) error {
+	if h.fsyncFiles {
+		err := f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return withDirLock(p, func() error { return h.commitTempLocked(f, p, r) })
+}
+
+func (h *handler) commitTempLocked(f *os.File, p string, r *http.Request) error {
+	err := preconditions(r, p)
+	if err != nil {
+		return err
+	}
+	if h.versioningEnabled() {
+		err := h.saveVersion(p, false)
+		if err != nil {
+			return err
+		}
+	}
+	ofi, oerr := os.Lstat(p)
+	if createOnly(r) {
+		err = os.Link(f.Name(), p)
+		if os.IsExist(err) {
+			return preconditionFailed
+		}
+		if err == nil {
+			err = os.Remove(f.Name())
+		}
+	} else {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the metadata kept in a sidecar file follows the content to the new inode
+	if oerr == nil {
+		share.Dolog(func() error { return h.moveMetaSidecar(ofi, f) })
+	}
+	if !h.fsyncDirs {
+		return nil
+	}
+	return syncDir(path.Dir(p))
+}
+
+// writes a temporary file next to the target, and renames it in place only when complete, so readers
+// never see partial content, and failures keep the old content. The preconditions of the request, when
+// not nil, are checked again before the rename.
+func (h *handler) replaceFile(p string, fi os.FileInfo, r *http.Request,
+	write func(*os.File) error) (os.FileInfo, error) {
+	mode := os.FileMode(0666)
+	if fi != nil {
+		mode = fi.Mode()
+	}
+	f, err := createTemp(p, mode)
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		share.Doretlog42(f.Close)
+		if !committed {
+			share.Doretlog42(func() error { return os.Remove(f.Name()) })
+		}
+	}()
+	err = inheritProps(f, p, fi)
+	if err != nil {
+		return nil, err
+	}
+	err = write(f)
+	if err != nil {
+		return nil, err
+	}
+	tfi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	err = h.commitTemp(f, p, r)
+	if err != nil {
+		return nil, err
 	}
-	return p, nil
+	committed = true
+	return tfi, nil
 }
 
 func (h *handler) searchf(w http.ResponseWriter, r *http.Request, qry url.Values) {
@@ -298,53 +545,94 @@ func (h *handler) searchf(w http.ResponseWriter, r *http.Request, qry url.Values
 	if !share.CheckBadReq(w, err == nil) {
 		return
 	}
+	tags := qry[searchQueryTag]
+	filter, err := getQrySearchFilter(qry, p)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	cursor, err := getQryCursor(qry)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	terms := tokenizeTerms(qry[searchQueryText])
+	if !share.CheckBadReq(w, len(terms) > 0 || len(qry[searchQueryText]) == 0) {
+		return
+	}
 	di, err := os.Lstat(p)
 	if !share.CheckOsError(w, err) {
 		return
 	}
-	result := searchFiles([]*fileInfo{&fileInfo{sys: di, dirname: path.Dir(p)}}, max, func(fi *fileInfo) bool {
-		if rxn != nil && !rxn.MatchString(fi.Name()) {
-			return false
+	var grepOpts *grepOptions
+	if rxc != nil {
+		grepOpts, err = getQryGrepOptions(qry, rxc)
+		if !share.CheckBadReq(w, err == nil) {
+			return
 		}
-		if rxc != nil {
-			if fi.IsDir() {
-				return false
-			}
-			f, err := os.Open(path.Join(fi.dirname, fi.Name()))
-			if err != nil {
-				return false
-			}
-			defer share.Doretlog42(f.Close)
-			ct, err := detectContentType(fi.Name(), f)
-			if err != nil {
-				return false
-			}
-			textType := false
-			for _, tct := range textMimeTypes {
-				if tct == ct {
-					textType = true
-					break
-				}
-			}
-			if !textType || !rxc.MatchReader(bufio.NewReader(f)) {
-				return false
+	}
+	rel, indexed := h.indexRel(p)
+	indexed = indexed && di.IsDir()
+	match := func(fi *fileInfo) (bool, []*contentMatch) {
+		if rxn != nil && !rxn.MatchString(fi.Name()) || !filter.match(fi) {
+			return false, nil
+		}
+		if len(terms) > 0 && !indexed && !hasTokens(h.fileTokens(path.Join(fi.dirname, fi.Name()), fi), terms) {
+			return false, nil
+		}
+		if len(tags) > 0 {
+			m, err := h.readMeta(path.Join(fi.dirname, fi.Name()), fi)
+			if err != nil || !m.hasTags(tags) {
+				return false, nil
 			}
 		}
+		if grepOpts == nil {
+			return true, nil
+		}
+		matches := h.grepFile(fi, grepOpts)
+		return len(matches) > 0, matches
+	}
+	sp := &searchPage{
+		roots:  []*fileInfo{&fileInfo{sys: di, dirname: path.Dir(p)}},
+		filter: filter,
+		after:  cursor,
+		max:    max,
+		match:  match,
+		done:   r.Context().Done()}
+	if indexed {
+		sp.indexed = true
+		sp.candidates = h.index.candidates(rel, terms)
+	}
+	if acceptsNdjson(r) {
+		h.streamSearch(w, r, sp)
+		return
+	}
+	var pmaps []map[string]interface{}
+	next := sp.walk(func(fi *fileInfo, matches []*contentMatch) bool {
+		pmaps = append(pmaps, h.searchProps(fi, matches))
 		return true
 	})
-	pmaps := make([]map[string]interface{}, len(result))
-	for i, fi := range result {
-		pmaps[i] = toPropertyMap(fi, false)
+	if pmaps == nil {
+		pmaps = []map[string]interface{}{}
+	}
+	if next != "" {
+		w.Header().Set(headerSearchCursor, next)
 	}
 	_, err = share.WriteJsonResponse(w, r, pmaps)
 	share.CheckServerError(w, err != share.MarshalError)
 }
 
 func (h *handler) propsf(w http.ResponseWriter, r *http.Request) {
-	p, err := h.getPath(r.URL.Path)
+	p, err := h.getLinkPath(r.URL.Path)
 	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
 		return
 	}
+	qry, err := url.ParseQuery(r.URL.RawQuery)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	algs, err := getQryDigests(qry)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
 	fi, err := os.Lstat(p)
 	if !share.CheckOsError(w, err) {
 		return
@@ -357,7 +645,33 @@ func (h *handler) propsf(w http.ResponseWriter, r *http.Request) {
 	if !share.CheckServerError(w, err == nil) {
 		return
 	}
-	pr := toPropertyMap(fi, own)
+	pr := toPropertyMap(withLink(p, fi), own)
+	err = h.addMeta(pr, p, fi)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	if own && fi.Mode()&os.ModeSymlink == 0 {
+		xattrs, err := userXattrs(p)
+		if !share.CheckOsError(w, err) {
+			return
+		}
+		if len(xattrs) > 0 {
+			pr["xattrs"] = xattrs
+		}
+	}
+	if len(algs) > 0 && fi.Mode().IsRegular() {
+		f, err := os.Open(p)
+		if !share.CheckOsError(w, err) {
+			return
+		}
+		defer share.Doretlog42(f.Close)
+		d, err := h.fileDigests(f, algs)
+		if !share.CheckOsError(w, err) {
+			return
+		}
+		pr["digests"] = d
+	}
+	w.Header().Set(share.HeaderEtag, etag(fi))
 	_, err = share.WriteJsonResponse(w, r, pr)
 	share.CheckServerError(w, err != share.MarshalError)
 }
@@ -373,6 +687,13 @@ func (h *handler) modpropsf(w http.ResponseWriter, r *http.Request) {
 	mode := int64(-1)
 	owner := ""
 	group := ""
+	var (
+		modTime    *int64
+		accessTime *int64
+		xattrs     map[string]*string
+		tags       []string
+		meta       map[string]*string
+	)
 	for k, v := range m {
 		switch k {
 		case "mode":
@@ -396,6 +717,35 @@ func (h *handler) modpropsf(w http.ResponseWriter, r *http.Request) {
 			if !share.CheckBadReq(w, ok) {
 				return
 			}
+		case "modTime", "accessTime":
+			n, ok := v.(json.Number)
+			if !share.CheckBadReq(w, ok) {
+				return
+			}
+			t, err := n.Int64()
+			if !share.CheckBadReq(w, err == nil && t >= 0) {
+				return
+			}
+			if k == "modTime" {
+				modTime = &t
+			} else {
+				accessTime = &t
+			}
+		case "xattrs":
+			xattrs, err = getXattrProps(v)
+			if !share.CheckBadReq(w, err == nil) {
+				return
+			}
+		case "tags":
+			tags, err = getTagsProp(v)
+			if !share.CheckBadReq(w, err == nil) {
+				return
+			}
+		case "meta":
+			meta, err = getMetaProp(v)
+			if !share.CheckBadReq(w, err == nil) {
+				return
+			}
 		default:
 			share.ErrorResponse(w, http.StatusBadRequest)
 			return
@@ -403,7 +753,7 @@ func (h *handler) modpropsf(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p, err := h.getPath(r.URL.Path)
-	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) || !checkPreconditions(w, r, p) {
 		return
 	}
 	fi, err := os.Lstat(p)
@@ -420,26 +770,61 @@ func (h *handler) modpropsf(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = applyProps(p, fi, mode, owner, group)
+	if err == nil {
+		err = applyXattrs(p, xattrs)
+	}
+	if err == nil {
+		err = h.applyMeta(p, fi, tags, meta)
+	}
+	if err == nil {
+		err = applyTimes(p, fi, modTime, accessTime)
+	}
+	share.CheckHandle(w, err == nil, http.StatusNotFound)
+}
+
+// sets the modification and the access time, when not nil, keeping the current value of the other one.
+// Expects the times as unix seconds.
+func applyTimes(p string, fi os.FileInfo, modTime, accessTime *int64) error {
+	if modTime == nil && accessTime == nil {
+		return nil
+	}
+	mtime := fi.ModTime()
+	atime := mtime
+	if sstat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		atime = time.Unix(sstat.Atim.Sec, sstat.Atim.Nsec)
+	}
+	if modTime != nil {
+		mtime = time.Unix(*modTime, 0)
+	}
+	if accessTime != nil {
+		atime = time.Unix(*accessTime, 0)
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+// changes the mode, when not negative, and the owner and the group, when not empty
+func applyProps(p string, fi os.FileInfo, mode int64, owner, group string) error {
 	var (
 		uid *uint32
 		gid *uint32
 	)
 	if len(owner) > 0 {
 		usr, err := user.Lookup(owner)
-		if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
-			return
+		if err != nil {
+			return err
 		}
 		puid, err := strconv.ParseUint(usr.Uid, 10, 32)
-		if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
-			return
+		if err != nil {
+			return err
 		}
 		upuid := uint32(puid)
 		uid = &upuid
 	}
 	if len(group) > 0 {
 		grp, err := share.LookupGroupByName(group)
-		if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
-			return
+		if err != nil {
+			return err
 		}
 		gid = &grp.Id
 	}
@@ -448,33 +833,44 @@ func (h *handler) modpropsf(w http.ResponseWriter, r *http.Request) {
 		rmode := replaceMode(fi.Mode(), os.FileMode(mode))
 		if rmode != fi.Mode() {
 			err := os.Chmod(p, rmode)
-			if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
-				return
+			if err != nil {
+				return err
 			}
 		}
 	}
-	if uid != nil || gid != nil {
-		sstat, ok := fi.Sys().(*syscall.Stat_t)
-		if !share.CheckHandle(w, ok, http.StatusNotFound) {
-			return
-		}
-		if uid == nil {
-			uid = &sstat.Uid
-		}
-		if gid == nil {
-			gid = &sstat.Gid
-		}
-		if *uid != sstat.Uid || *gid != sstat.Gid {
-			err = os.Chown(p, int(*uid), int(*gid))
-			if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
-				return
-			}
-		}
+	if uid == nil && gid == nil {
+		return nil
+	}
+	sstat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return invalidProps
+	}
+	if uid == nil {
+		uid = &sstat.Uid
 	}
+	if gid == nil {
+		gid = &sstat.Gid
+	}
+	if *uid == sstat.Uid && *gid == sstat.Gid {
+		return nil
+	}
+	return os.Chown(p, int(*uid), int(*gid))
 }
 
 func (h *handler) getDir(w http.ResponseWriter, r *http.Request, d *os.File) {
-	dfis, err := d.Readdir(0)
+	qry, err := url.ParseQuery(r.URL.RawQuery)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	o, err := getQryListOptions(qry)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	format, err := getListFormat(r, qry)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	entries, total, more, err := listDir(d, o)
 	if !share.CheckOsError(w, err) {
 		return
 	}
@@ -482,59 +878,206 @@ func (h *handler) getDir(w http.ResponseWriter, r *http.Request, d *os.File) {
 	if !share.CheckServerError(w, u != nil && err == nil) {
 		return
 	}
-	prs := make([]map[string]interface{}, len(dfis))
-	for i, dfi := range dfis {
+	var next string
+	if more {
+		next = entries[len(entries)-1].cursor()
+		w.Header().Set(headerListCursor, next)
+	}
+	w.Header().Set(headerTotalCount, strconv.Itoa(total))
+	w.Header().Set(headerVary, headerAccept)
+	if format == listFormatHtml {
+		writeListHtml(w, r, qry, entries, next)
+		return
+	}
+	prs := make([]map[string]interface{}, len(entries))
+	for i, e := range entries {
+		dfi := e.fi
 		own, err := isOwner(u, dfi)
 		if !share.CheckServerError(w, err == nil) {
 			return
 		}
-		prs[i] = toPropertyMap(dfi, own)
+		dp := path.Join(d.Name(), dfi.Name())
+		prs[i] = toPropertyMap(withLink(dp, dfi), own)
+		share.Dolog(func() error { return h.addMeta(prs[i], dp, dfi) })
+	}
+	if format == listFormatNdjson {
+		writeNdjson(w, r, prs)
+		return
 	}
 	_, err = share.WriteJsonResponse(w, r, prs)
 	share.CheckServerError(w, err != share.MarshalError)
 }
 
 func (h *handler) getFile(w http.ResponseWriter, r *http.Request, f *os.File, fi os.FileInfo) {
-	ct, err := detectContentType(fi.Name(), f)
+	ct, err := h.contentType(fi.Name(), f)
 	if !share.CheckServerError(w, err == nil) {
 		return
 	}
 	header := w.Header()
 	header.Set(share.HeaderContentType, ct)
-	header.Set(share.HeaderContentLength, fmt.Sprintf("%d", fi.Size()))
-	if r.Method == "HEAD" {
+	header.Set(share.HeaderEtag, etag(fi))
+	err = h.setDigestHeaders(w, r, f)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	if gf := h.openPrecompressed(r, f.Name(), fi); gf != nil {
+		defer share.Doretlog42(gf.Close)
+		setGzipEncoded(header)
+		header.Add(headerVary, headerAcceptEncoding)
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), gf)
 		return
 	}
-	io.Copy(w, f)
+	if cw, ok := w.(*compressWriter); ok && cw.compressesFile(ct, fi.Size()) {
+		header.Set(share.HeaderEtag, gzipEtag(etag(fi)))
+	}
+
+	// handles range, if-range, if-none-match and if-modified-since, and skips the body on HEAD
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
 }
 
 func (h *handler) putf(w http.ResponseWriter, r *http.Request) {
 	p, err := h.getPath(r.URL.Path)
-	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) || !checkPreconditions(w, r, p) {
+		return
+	}
+	p, fi, err := prepareTarget(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	rr, ok := requestBody(w, r)
+	if !ok {
 		return
 	}
-	err = os.MkdirAll(path.Dir(p), os.ModePerm)
+	var mr *share.MaxReader
+	if h.maxRequestBody > 0 {
+		mr = &share.MaxReader{Reader: rr, Count: h.maxRequestBody}
+		rr = mr
+	}
+	tfi, err := h.replaceFile(p, fi, r, func(f *os.File) error {
+		_, err := io.Copy(f, rr)
+		return err
+	})
+	if !share.CheckHandle(w, err == io.EOF || mr == nil || mr.Count > 0, http.StatusRequestEntityTooLarge) ||
+		!share.CheckHandle(w, err != preconditionFailed, http.StatusPreconditionFailed) ||
+		!share.CheckOsError(w, err) {
+		return
+	}
+	w.Header().Set(share.HeaderEtag, etag(tfi))
+}
+
+// writes the request body at offset, or appends it when offset is negative. When length is not negative,
+// the body needs to be exactly that long. With versioning, the previous content of an existing file is
+// saved first, when it gets overwritten. Appending keeps the previous content.
+func (h *handler) writePart(w http.ResponseWriter, r *http.Request, p string, offset, length int64) {
+	if !share.CheckHandle(w, h.maxRequestBody <= 0 || r.ContentLength <= h.maxRequestBody && length <= h.maxRequestBody,
+		http.StatusRequestEntityTooLarge) ||
+		!share.CheckBadReq(w, length < 0 || r.ContentLength < 0 || r.ContentLength == length) {
+		return
+	}
+	p, pfi, err := prepareTarget(p)
 	if !share.CheckOsError(w, err) {
 		return
 	}
-	f, err := os.Create(p)
+	flag := os.O_WRONLY | os.O_CREATE
+	if offset < 0 {
+		flag |= os.O_APPEND
+	}
+	f, err := os.OpenFile(p, flag, 0666)
 	if !share.CheckOsError(w, err) {
 		return
 	}
 	defer share.Doretlog42(f.Close)
-	if !share.CheckOsError(w, err) {
+
+	// concurrent writes are serialized, so that a failed write can be reverted
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	fi, err := f.Stat()
+	if !share.CheckOsError(w, err) ||
+		!share.CheckHandle(w, offset <= fi.Size(), http.StatusRequestedRangeNotSatisfiable) {
 		return
 	}
+	if pfi != nil && offset >= 0 && offset < fi.Size() && h.versioningEnabled() {
+		err = h.saveVersion(p, true)
+		if !share.CheckOsError(w, err) {
+			return
+		}
+	}
+	size := fi.Size()
+	if offset < 0 {
+		offset = size
+	} else {
+		_, err = f.Seek(offset, os.SEEK_SET)
+		if !share.CheckOsError(w, err) {
+			return
+		}
+	}
+
 	var rr io.Reader = r.Body
 	var mr *share.MaxReader
-	if h.maxRequestBody > 0 {
+	switch {
+	case length >= 0:
+		rr = io.LimitReader(rr, length)
+	case h.maxRequestBody > 0:
 		mr = &share.MaxReader{Reader: rr, Count: h.maxRequestBody}
 		rr = mr
 	}
-	_, err = io.Copy(f, rr)
-	if share.CheckHandle(w, err == io.EOF || mr == nil || mr.Count > 0, http.StatusRequestEntityTooLarge) {
-		share.CheckOsError(w, err)
+	n, err := io.Copy(f, rr)
+	if err == nil && length >= 0 {
+		if n < length {
+			err = invalidRange
+		} else if _, perr := io.ReadFull(r.Body, make([]byte, 1)); perr != io.EOF {
+			err = invalidRange
+		}
+	}
+	if err != nil {
+		if offset+n > size {
+			share.Doretlog42(func() error { return f.Truncate(size) })
+		}
+		if share.CheckHandle(w, mr == nil || mr.Count > 0, http.StatusRequestEntityTooLarge) &&
+			share.CheckBadReq(w, err != invalidRange) {
+			share.CheckOsError(w, err)
+		}
+		return
+	}
+	if h.fsyncFiles {
+		err = f.Sync()
+		if !share.CheckOsError(w, err) {
+			return
+		}
+	}
+	fi, err = f.Stat()
+	if share.CheckOsError(w, err) {
+		w.Header().Set(share.HeaderEtag, etag(fi))
+	}
+}
+
+func (h *handler) appendf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) || !checkPreconditions(w, r, p) {
+		return
+	}
+	offset, ok, err := getQryNum64(qry, appendOffsetKey)
+	if !share.CheckBadReq(w, err == nil && offset >= 0) {
+		return
+	}
+	if !ok {
+		offset = -1
+	}
+	h.writePart(w, r, p, offset, -1)
+}
+
+func (h *handler) writeRangef(w http.ResponseWriter, r *http.Request) {
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) || !checkPreconditions(w, r, p) {
+		return
+	}
+	offset, length, err := parseContentRange(r.Header.Get(headerContentRange))
+	if !share.CheckBadReq(w, err == nil) {
+		return
 	}
+	h.writePart(w, r, p, offset, length)
 }
 
 func (h *handler) copyRename(w http.ResponseWriter, r *http.Request,
@@ -543,7 +1086,9 @@ func (h *handler) copyRename(w http.ResponseWriter, r *http.Request,
 	if !share.CheckBadReq(w, ok && (multi || len(tos) == 1)) {
 		return
 	}
-	from, err := h.getPath(r.URL.Path)
+
+	// the source is not resolved, a symlink is handled according to the symlink policy
+	from, err := h.getLinkPath(r.URL.Path)
 	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
 		return
 	}
@@ -561,18 +1106,32 @@ func (h *handler) copyRename(w http.ResponseWriter, r *http.Request,
 }
 
 func (h *handler) copyf(w http.ResponseWriter, r *http.Request, qry url.Values) {
-	h.copyRename(w, r, qry, true, copyTree)
+	o, err := getQryPreserve(qry)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	o.follow = h.followLink
+	h.copyRename(w, r, qry, true, func(from, to string) error { return copyAtomic(from, to, o) })
 }
 
 func (h *handler) renamef(w http.ResponseWriter, r *http.Request, qry url.Values) {
-	h.copyRename(w, r, qry, false, os.Rename)
+	p, err := h.getLinkPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) || !checkPreconditions(w, r, p) {
+		return
+	}
+	h.copyRename(w, r, qry, false, moveTree)
 }
 
 func (h *handler) deletef(w http.ResponseWriter, r *http.Request) {
-	p, err := h.getPath(r.URL.Path)
-	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+	p, err := h.getLinkPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) || !checkPreconditions(w, r, p) {
+		return
+	}
+	if h.trashEnabled() {
+		h.trashf(w, r, p)
 		return
 	}
+	h.removeMetaTree(p)
 	err = os.RemoveAll(p)
 	if os.IsNotExist(err) {
 		return
@@ -617,25 +1176,111 @@ func New(o Options) http.Handler {
 	h.dn = o.Root()
 	h.maxRequestBody = o.MaxRequestBody()
 	h.maxSearchResults = o.MaxSearchResults()
+	h.fsyncFiles = o.FsyncFiles()
+	h.fsyncDirs = o.FsyncDirs()
+	h.cachedir = o.Cachedir()
+	h.uploadExpiry = o.UploadExpiry()
+	h.maxUploadSize = o.MaxUploadSize()
+	h.trash = o.Trash()
+	h.trashExpiry = o.TrashExpiry()
+	h.trashMaxSize = o.TrashMaxSize()
+	h.maxVersions = o.MaxVersions()
+	h.versionExpiry = o.VersionExpiry()
+	h.symlinks = o.Symlinks()
+	if h.symlinks == "" {
+		h.symlinks = symlinksFollow
+	}
+	h.searchTypes = parseSearchTypes(o.SearchTypes())
+	if h.cachedir != "" {
+		h.du = &duCache{h: h}
+	}
+	h.compressMinSize = int64(o.CompressMinSize())
+	if h.compressMinSize == 0 {
+		h.compressMinSize = defaultCompressMinSize
+	}
+	h.mimeTypes = &mimeTypes{}
+
+	// the file is expected to be checked at startup with CheckMimeTypes
+	share.Dolog(func() error {
+		mts, err := readMimeTypes(o.MimeTypes())
+		if err == nil {
+			h.mimeTypes = mts
+		}
+		return err
+	})
+
+	// the indexer reads the handler settings, so it is started when they are set
+	if h.cachedir != "" && o.SearchIndex() > 0 {
+		h.index = newSearchIndex(h, time.Duration(o.SearchIndex())*time.Second)
+		go h.index.run()
+	}
 	return h
 }
 
+// stops the background work of the handler, the search index, and persists the pending changes of the
+// disk usage cache
+func (h *handler) Close() {
+	if h.index != nil {
+		h.index.close()
+	}
+	h.du.save()
+}
+
 func (h *handler) options(w http.ResponseWriter, r *http.Request)  { noCmd(w, r, nil) }
 func (h *handler) props(w http.ResponseWriter, r *http.Request)    { noCmd(w, r, h.propsf) }
 func (h *handler) modprops(w http.ResponseWriter, r *http.Request) { noCmd(w, r, h.modpropsf) }
-func (h *handler) put(w http.ResponseWriter, r *http.Request)      { noCmd(w, r, h.putf) }
-func (h *handler) delete(w http.ResponseWriter, r *http.Request)   { noCmd(w, r, h.deletef) }
 func (h *handler) mkdir(w http.ResponseWriter, r *http.Request)    { noCmd(w, r, h.mkdirf) }
 func (h *handler) search(w http.ResponseWriter, r *http.Request)   { queryNoCmd(w, r, h.searchf) }
 func (h *handler) copy(w http.ResponseWriter, r *http.Request)     { queryNoCmd(w, r, h.copyf) }
 func (h *handler) rename(w http.ResponseWriter, r *http.Request)   { queryNoCmd(w, r, h.renamef) }
+func (h *handler) lock(w http.ResponseWriter, r *http.Request)     { queryNoCmd(w, r, h.lockf) }
+func (h *handler) unlock(w http.ResponseWriter, r *http.Request)   { queryNoCmd(w, r, h.unlockf) }
+
+func (h *handler) put(w http.ResponseWriter, r *http.Request) {
+	qry, err := url.ParseQuery(r.URL.RawQuery)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	cmd, ok := share.CheckQryValuesCmd(w, qry, share.HttpCmdExtract)
+	if !ok {
+		return
+	}
+	switch cmd {
+	case share.HttpCmdExtract:
+		h.extractf(w, r, qry)
+	default:
+		h.putf(w, r)
+	}
+}
+
+func (h *handler) patch(w http.ResponseWriter, r *http.Request) {
+	queryNoCmd(w, r, func(w http.ResponseWriter, r *http.Request, qry url.Values) {
+		if _, ok := qry[uploadKey]; ok {
+			h.uploadChunkf(w, r, qry)
+			return
+		}
+		h.writeRangef(w, r)
+	})
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request) {
+	queryNoCmd(w, r, func(w http.ResponseWriter, r *http.Request, qry url.Values) {
+		if _, ok := qry[uploadKey]; ok {
+			h.cancelUploadf(w, r, qry)
+			return
+		}
+		h.deletef(w, r)
+	})
+}
 
 func (h *handler) get(w http.ResponseWriter, r *http.Request) {
 	qry, err := url.ParseQuery(r.URL.RawQuery)
 	if !share.CheckBadReq(w, err == nil) {
 		return
 	}
-	cmd, ok := share.CheckQryValuesCmd(w, qry, share.HttpCmdProps, share.HttpCmdSearch)
+	cmd, ok := share.CheckQryValuesCmd(w, qry,
+		share.HttpCmdProps, share.HttpCmdSearch, share.HttpCmdArchive, share.HttpCmdVerify, share.HttpCmdTrash,
+		share.HttpCmdVersions, share.HttpCmdIndex, share.HttpCmdDu)
 	if !ok {
 		return
 	}
@@ -644,7 +1289,27 @@ func (h *handler) get(w http.ResponseWriter, r *http.Request) {
 		h.propsf(w, r)
 	case share.HttpCmdSearch:
 		h.searchf(w, r, qry)
+	case share.HttpCmdArchive:
+		h.archivef(w, r, qry)
+	case share.HttpCmdVerify:
+		h.verifyf(w, r, qry)
+	case share.HttpCmdTrash:
+		h.listTrashf(w, r)
+	case share.HttpCmdVersions:
+		h.versionsf(w, r)
+	case share.HttpCmdIndex:
+		h.indexStatusf(w, r)
+	case share.HttpCmdDu:
+		h.duf(w, r, qry)
 	default:
+		if _, ok := qry[uploadKey]; ok {
+			h.uploadStatusf(w, r, qry)
+			return
+		}
+		if _, ok := qry[versionKey]; ok {
+			h.getVersionf(w, r, qry)
+			return
+		}
 		p, err := h.getPath(r.URL.Path)
 		if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
 			return
@@ -659,6 +1324,7 @@ func (h *handler) get(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if fi.IsDir() {
+			w.Header().Set(share.HeaderEtag, etag(fi))
 			h.getDir(w, r, f)
 			return
 
@@ -673,7 +1339,9 @@ func (h *handler) post(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	cmd, ok := share.CheckQryValuesCmd(w, qry,
-		share.HttpCmdModprops, share.HttpCmdDelete, share.HttpCmdMkdir, share.HttpCmdCopy, share.HttpCmdRename)
+		share.HttpCmdModprops, share.HttpCmdDelete, share.HttpCmdMkdir, share.HttpCmdCopy, share.HttpCmdRename,
+		share.HttpCmdUpload, share.HttpCmdAppend, share.HttpCmdExtract, share.HttpCmdRestore, share.HttpCmdPurge,
+		share.HttpCmdSymlink)
 	if !ok {
 		return
 	}
@@ -688,12 +1356,51 @@ func (h *handler) post(w http.ResponseWriter, r *http.Request) {
 		h.copyf(w, r, qry)
 	case share.HttpCmdRename:
 		h.renamef(w, r, qry)
+	case share.HttpCmdUpload:
+		h.createUploadf(w, r)
+	case share.HttpCmdAppend:
+		h.appendf(w, r, qry)
+	case share.HttpCmdExtract:
+		h.extractf(w, r, qry)
+	case share.HttpCmdRestore:
+		if _, ok := qry[versionKey]; ok {
+			h.restoreVersionf(w, r, qry)
+			return
+		}
+		h.restoref(w, r, qry)
+	case share.HttpCmdPurge:
+		h.purgef(w, r, qry)
+	case share.HttpCmdSymlink:
+		h.symlinkf(w, r, qry)
 	default:
 		h.putf(w, r)
 	}
 }
 
+// notifies the search index and the disk usage cache about the paths changed by a request
+func (h *handler) pathsChanged(ps []string) {
+	h.indexChanged(ps)
+	h.du.invalidate(ps)
+}
+
+func (h *handler) requestChanged(r *http.Request) {
+	qry, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return
+	}
+	ps, _ := lockedPaths(r, qry)
+	h.pathsChanged(ps)
+}
+
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w, done := h.compressResponse(w, r)
+	defer done()
+	if !h.checkLocks(w, r) {
+		return
+	}
+	if h.index != nil || h.du != nil {
+		defer h.requestChanged(r)
+	}
 	switch r.Method {
 	case "OPTIONS":
 		h.options(w, r)
@@ -719,6 +1426,12 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.mkdir(w, r)
 	case "POST":
 		h.post(w, r)
+	case "PATCH":
+		h.patch(w, r)
+	case "LOCK":
+		h.lock(w, r)
+	case "UNLOCK":
+		h.unlock(w, r)
 	default:
 		share.ErrorResponse(w, http.StatusMethodNotAllowed)
 	}
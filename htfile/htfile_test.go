@@ -12,6 +12,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -28,16 +30,47 @@ const testMaxRequestBody = 1 << 30
 
 type testOptions struct {
 	root             string
+	cachedir         string
 	maxRequestBody   int64
 	maxSearchResults int
+	fsyncFiles       bool
+	fsyncDirs        bool
+	uploadExpiry     int
+	maxUploadSize    int64
+	trash            bool
+	trashExpiry      int
+	trashMaxSize     int64
+	maxVersions      int
+	versionExpiry    int
+	symlinks         string
+	searchTypes      string
+	searchIndex      int
+	compressMinSize  int
+	mimeTypes        string
 }
 
 func (ts *testOptions) Root() string          { return ts.root }
+func (ts *testOptions) Cachedir() string      { return ts.cachedir }
 func (ts *testOptions) MaxRequestBody() int64 { return ts.maxRequestBody }
 func (ts *testOptions) MaxSearchResults() int { return ts.maxSearchResults }
+func (ts *testOptions) FsyncFiles() bool      { return ts.fsyncFiles }
+func (ts *testOptions) FsyncDirs() bool       { return ts.fsyncDirs }
+func (ts *testOptions) UploadExpiry() int     { return ts.uploadExpiry }
+func (ts *testOptions) MaxUploadSize() int64  { return ts.maxUploadSize }
+func (ts *testOptions) Trash() bool           { return ts.trash }
+func (ts *testOptions) TrashExpiry() int      { return ts.trashExpiry }
+func (ts *testOptions) TrashMaxSize() int64   { return ts.trashMaxSize }
+func (ts *testOptions) MaxVersions() int      { return ts.maxVersions }
+func (ts *testOptions) VersionExpiry() int    { return ts.versionExpiry }
+func (ts *testOptions) Symlinks() string      { return ts.symlinks }
+func (ts *testOptions) SearchTypes() string   { return ts.searchTypes }
+func (ts *testOptions) SearchIndex() int      { return ts.searchIndex }
+func (ts *testOptions) CompressMinSize() int  { return ts.compressMinSize }
+func (ts *testOptions) MimeTypes() string     { return ts.mimeTypes }
 
 var (
 	dn           string
+	cachedir     string
 )
 
 func init() {
@@ -46,6 +79,11 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	cachedir = path.Join(tst.Testdir, "http-cache")
+	err = share.EnsureDir(cachedir)
+	if err != nil {
+		panic(err)
+	}
 }
 
 type fileInfoT struct {
@@ -199,6 +237,48 @@ func verifyHeader(expect, have map[string][]string) bool {
 	return true
 }
 
+// recreates a directory in the root, with the files and their content, and removes the state of the
+// tests from the cachedir
+func initTestDir(t *testing.T, name string, files map[string]string, cacheDirs ...string) string {
+	dir := path.Join(dn, name)
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	for n, c := range files {
+		p := path.Join(dir, n)
+		tst.EnsureDirF(t, path.Dir(p))
+		tst.WithNewFileF(t, p, func(f *os.File) error {
+			_, err := f.Write([]byte(c))
+			return err
+		})
+	}
+	for _, cd := range cacheDirs {
+		tst.RemoveIfExistsF(t, path.Join(cachedir, cd))
+	}
+	return dir
+}
+
+func checkStatus(t *testing.T, s int) func(*http.Response) {
+	return func(rsp *http.Response) {
+		if rsp.StatusCode != s {
+			t.Log(rsp.Request.Method, rsp.Request.URL, rsp.StatusCode)
+			t.Fail()
+		}
+	}
+}
+
+func expectHeaderStatus(t *testing.T, method, url string, header map[string]string, s int) {
+	r, err := http.NewRequest(method, tst.S.URL+url, nil)
+	tst.ErrFatal(t, err)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	tst.Htreqr(t, r, checkStatus(t, s))
+}
+
+func expectStatus(t *testing.T, method, url string, s int) {
+	expectHeaderStatus(t, method, url, nil, s)
+}
+
 func TestToPropertyMap(t *testing.T) {
 	var (
 		defaultTime time.Time
@@ -437,6 +517,21 @@ func TestDetectContentType(t *testing.T) {
 	}
 }
 
+// collects the entries accepted by qry, walking the tree until max entries are found
+func walkFiles(dirs []*fileInfo, max int, qry func(fi *fileInfo) bool) []*fileInfo {
+	if max <= 0 {
+		return nil
+	}
+	var res []*fileInfo
+	walkTree(dirs, func(fi *fileInfo) bool {
+		if qry(fi) {
+			res = append(res, fi)
+		}
+		return len(res) < max
+	}, nil, nil)
+	return res
+}
+
 func TestSearchFiles(t *testing.T) {
 	p := path.Join(tst.Testdir, "search")
 	tst.RemoveIfExistsF(t, p)
@@ -448,23 +543,45 @@ func TestSearchFiles(t *testing.T) {
 	tst.WithNewFileF(t, path.Join(p, "file1"), nil)
 
 	// 0 max
-	if len(searchFiles([]*fileInfo{dii}, 0, func(_ *fileInfo) bool { return true })) != 0 {
+	if len(walkFiles([]*fileInfo{dii}, 0, func(_ *fileInfo) bool { return true })) != 0 {
 		t.Fail()
 	}
 
 	// negative max
-	if len(searchFiles([]*fileInfo{dii}, -1, func(_ *fileInfo) bool { return true })) != 0 {
+	if len(walkFiles([]*fileInfo{dii}, -1, func(_ *fileInfo) bool { return true })) != 0 {
+		t.Fail()
+	}
+
+	// stopped by visit
+	var visited int
+	walkTree([]*fileInfo{dii}, func(_ *fileInfo) bool {
+		visited++
+		return false
+	}, nil, nil)
+	if visited != 1 {
+		t.Fail()
+	}
+
+	// canceled
+	done := make(chan struct{})
+	close(done)
+	visited = 0
+	walkTree([]*fileInfo{dii}, func(_ *fileInfo) bool {
+		visited++
+		return true
+	}, nil, done)
+	if visited != 0 {
 		t.Fail()
 	}
 
 	// no root dirs
-	if len(searchFiles(nil, 1, func(_ *fileInfo) bool { return true })) != 0 {
+	if len(walkFiles(nil, 1, func(_ *fileInfo) bool { return true })) != 0 {
 		t.Fail()
 	}
 
 	// not existing root dirs
 	tst.RemoveIfExistsF(t, p)
-	if len(searchFiles([]*fileInfo{dii}, 1, func(_ *fileInfo) bool { return true })) != 0 {
+	if len(walkFiles([]*fileInfo{dii}, 1, func(_ *fileInfo) bool { return true })) != 0 {
 		t.Fail()
 	}
 
@@ -475,12 +592,12 @@ func TestSearchFiles(t *testing.T) {
 	dii = &fileInfo{sys: di, dirname: tst.Testdir}
 	tst.WithNewFileF(t, path.Join(p, "file0"), nil)
 	tst.WithNewFileF(t, path.Join(p, "file1"), nil)
-	if len(searchFiles([]*fileInfo{dii}, 42, func(_ *fileInfo) bool { return false })) != 0 {
+	if len(walkFiles([]*fileInfo{dii}, 42, func(_ *fileInfo) bool { return false })) != 0 {
 		t.Fail()
 	}
 
 	// predicate always true
-	result := searchFiles([]*fileInfo{dii}, 42, func(_ *fileInfo) bool { return true })
+	result := walkFiles([]*fileInfo{dii}, 42, func(_ *fileInfo) bool { return true })
 	if len(result) != 2 {
 		t.Fail()
 	}
@@ -488,7 +605,7 @@ func TestSearchFiles(t *testing.T) {
 	// root is a file
 	fi, err := os.Lstat(path.Join(p, "file0"))
 	tst.ErrFatal(t, err)
-	if len(searchFiles([]*fileInfo{&fileInfo{sys: fi, dirname: p}}, 42,
+	if len(walkFiles([]*fileInfo{&fileInfo{sys: fi, dirname: p}}, 42,
 		func(_ *fileInfo) bool { return true })) != 0 {
 		t.Fail()
 	}
@@ -504,7 +621,7 @@ func TestSearchFiles(t *testing.T) {
 	tst.EnsureDirF(t, p0)
 	tst.WithNewFileF(t, path.Join(p0, "file0"), nil)
 	tst.WithNewFileF(t, path.Join(p0, "file1"), nil)
-	result = searchFiles([]*fileInfo{dii}, 42, func(_ *fileInfo) bool { return true })
+	result = walkFiles([]*fileInfo{dii}, 42, func(_ *fileInfo) bool { return true })
 	if len(result) != 5 {
 		t.Fail()
 	}
@@ -517,7 +634,7 @@ func TestSearchFiles(t *testing.T) {
 	}
 
 	// find max, breadth first
-	result = searchFiles([]*fileInfo{dii}, 4, func(_ *fileInfo) bool { return true })
+	result = walkFiles([]*fileInfo{dii}, 4, func(_ *fileInfo) bool { return true })
 	if len(result) != 4 {
 		t.Fail()
 	}
@@ -533,12 +650,12 @@ func TestSearchFiles(t *testing.T) {
 	}
 
 	// find all, filtered
-	if len(searchFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool {
+	if len(walkFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool {
 		return fi.Name() == "file0"
 	})) != 2 {
 		t.Fail()
 	}
-	if len(searchFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool {
+	if len(walkFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool {
 		return strings.Index(fi.Name(), "file") == 0
 	})) != 4 {
 		t.Fail()
@@ -549,7 +666,7 @@ func TestSearchFiles(t *testing.T) {
 	// (failure was: Readdir(max))
 	p1 := path.Join(p, "dir1")
 	tst.EnsureDirF(t, p1)
-	if len(searchFiles([]*fileInfo{dii}, 2, func(fi *fileInfo) bool {
+	if len(walkFiles([]*fileInfo{dii}, 2, func(fi *fileInfo) bool {
 		if fi.Name() == "dir0" {
 			err = os.Rename(path.Join(p0, "file0"), path.Join(p1, "file0"))
 			tst.ErrFatal(t, err)
@@ -569,7 +686,7 @@ func TestSearchFiles(t *testing.T) {
 	tst.EnsureDirF(t, p1)
 	p2 := path.Join(p0, "dir2")
 	tst.EnsureDirF(t, p2)
-	if len(searchFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool {
+	if len(walkFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool {
 		return strings.Index(fi.Name(), "dir") == 0
 	})) != 3 {
 		t.Fail()
@@ -621,7 +738,7 @@ func TestSearchFiles(t *testing.T) {
 			"dirname": p0,
 			"isDir":   false,
 			"size":    int64(0)}}
-	result = searchFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool { return true })
+	result = walkFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool { return true })
 	for _, fi := range result {
 		fp := path.Join(fi.dirname, fi.Name())
 		if fi.Name() != vm[fp]["name"].(string) ||
@@ -639,14 +756,14 @@ func TestSearchFiles(t *testing.T) {
 			t.Fail()
 		}
 	}
-	result = searchFiles([]*fileInfo{dii}, 5, func(fi *fileInfo) bool { return true })
+	result = walkFiles([]*fileInfo{dii}, 5, func(fi *fileInfo) bool { return true })
 	level0 = result[:3]
 	for _, fi := range level0 {
 		if fi.dirname != p {
 			t.Fail()
 		}
 	}
-	result = searchFiles([]*fileInfo{dii}, 2, func(fi *fileInfo) bool { return true })
+	result = walkFiles([]*fileInfo{dii}, 2, func(fi *fileInfo) bool { return true })
 	for _, fi := range result {
 		if fi.dirname != p {
 			t.Fail()
@@ -677,7 +794,7 @@ func TestSearchFilesNotRoot(t *testing.T) {
 		err = os.Chmod(p0, os.ModePerm)
 		tst.ErrFatal(t, err)
 	}()
-	if len(searchFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool { return true })) != 3 {
+	if len(walkFiles([]*fileInfo{dii}, 42, func(fi *fileInfo) bool { return true })) != 3 {
 		t.Fail()
 	}
 }
@@ -690,7 +807,7 @@ func TestCopyTree(t *testing.T) {
 	// no copy of the same path
 	fi0, err := os.Lstat(dir)
 	tst.ErrFatal(t, err)
-	err = copyTree(dir, dir)
+	err = copyTreeOpts(dir, dir, new(copyOptions))
 	if err != nil {
 		t.Fail()
 	}
@@ -705,7 +822,7 @@ func TestCopyTree(t *testing.T) {
 	err = tst.RemoveIfExists(dir0)
 	dir1 := path.Join(dir, "dir1")
 	tst.RemoveIfExistsF(t, dir1)
-	err = copyTree(dir0, dir1)
+	err = copyTreeOpts(dir0, dir1, new(copyOptions))
 	if err == nil || !os.IsNotExist(err) {
 		t.Fail()
 	}
@@ -715,7 +832,7 @@ func TestCopyTree(t *testing.T) {
 	fp := path.Join(dir0, "some")
 	tst.WithNewFileF(t, fp, nil)
 	tst.RemoveIfExistsF(t, dir1)
-	err = copyTree(dir0, dir1)
+	err = copyTreeOpts(dir0, dir1, new(copyOptions))
 	if err != nil {
 		t.Fail()
 	}
@@ -731,7 +848,7 @@ func TestCopyTree(t *testing.T) {
 		return err
 	})
 	tst.RemoveIfExistsF(t, f1)
-	err = copyTree(f0, f1)
+	err = copyTreeOpts(f0, f1, new(copyOptions))
 	if err != nil {
 		t.Fail()
 	}
@@ -761,7 +878,7 @@ func TestCopyTreeNotRoot(t *testing.T) {
 	tst.RemoveIfExistsF(t, dir1)
 	err := os.Chmod(dir, 0600)
 	tst.ErrFatal(t, err)
-	err = copyTree(dir0, dir1)
+	err = copyTreeOpts(dir0, dir1, new(copyOptions))
 	if !isPermission(err) {
 		t.Fail()
 	}
@@ -774,7 +891,7 @@ func TestCopyTreeNotRoot(t *testing.T) {
 	tst.WithNewFileF(t, fp, nil)
 	err = os.Chmod(fp, 0000)
 	tst.RemoveIfExistsF(t, dir1)
-	err = copyTree(dir0, dir1)
+	err = copyTreeOpts(dir0, dir1, new(copyOptions))
 	if !isPermission(err) {
 		t.Fail()
 	}
@@ -795,7 +912,7 @@ func TestCopyTreeNotRoot(t *testing.T) {
 	tst.RemoveIfExistsF(t, f1)
 	err = os.Chmod(dir, 0600)
 	tst.ErrFatal(t, err)
-	err = copyTree(f0, f1)
+	err = copyTreeOpts(f0, f1, new(copyOptions))
 	if !isPermission(err) {
 		t.Fail()
 	}
@@ -807,7 +924,7 @@ func TestCopyTreeNotRoot(t *testing.T) {
 	err = os.Chmod(f0, 0400)
 	tst.ErrFatal(t, err)
 	tst.RemoveIfExistsF(t, f1)
-	err = copyTree(f0, f1)
+	err = copyTreeOpts(f0, f1, new(copyOptions))
 	if err != nil {
 		t.Fail()
 	}
@@ -821,7 +938,7 @@ func TestCopyTreeNotRoot(t *testing.T) {
 	p0, p1 := path.Join(dir, "dir0"), path.Join(dir, "dir1")
 	tst.EnsureDirF(t, p0)
 	tst.RemoveIfExistsF(t, p1)
-	err = copyTree(p0, p1)
+	err = copyTreeOpts(p0, p1, new(copyOptions))
 	if err != nil {
 		t.Fail()
 	}
@@ -830,7 +947,7 @@ func TestCopyTreeNotRoot(t *testing.T) {
 	f0, f1 = path.Join(dir, "file0"), path.Join(dir, "file1")
 	tst.WithNewFileF(t, f0, nil)
 	tst.WithNewFileF(t, f1, nil)
-	err = copyTree(f0, f1)
+	err = copyTreeOpts(f0, f1, new(copyOptions))
 	if err != nil {
 		t.Fail()
 	}
@@ -1591,6 +1708,216 @@ func TestGetFile(t *testing.T) {
 	// ff(tst.Htrex)
 }
 
+func TestGetFileRange(t *testing.T) {
+	var (
+		f   *os.File
+		fi  os.FileInfo
+		err error
+		c   = []byte("0123456789abcdefghij")
+	)
+	ht := New(&testOptions{root: dn}).(*handler)
+	tst.Thnd.Sh = func(w http.ResponseWriter, r *http.Request) {
+		ht.getFile(w, r, f, fi)
+	}
+	fn := "some-file"
+	p := path.Join(dn, fn)
+	url := tst.S.URL + "/" + fn
+	tst.WithNewFileF(t, p, func(f *os.File) error {
+		_, err := f.Write(c)
+		return err
+	})
+	open := func() {
+		f, err = os.Open(p)
+		tst.ErrFatal(t, err)
+		fi, err = f.Stat()
+		tst.ErrFatal(t, err)
+	}
+	req := func(method string, h map[string]string, clb func(rsp *http.Response)) {
+		open()
+		defer f.Close()
+		r, err := http.NewRequest(method, url, nil)
+		tst.ErrFatal(t, err)
+		for k, v := range h {
+			r.Header.Set(k, v)
+		}
+		tst.Htreqr(t, r, clb)
+	}
+
+	// validators and range support advertised
+	req("GET", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK ||
+			rsp.Header.Get("Accept-Ranges") != "bytes" ||
+			rsp.Header.Get(share.HeaderEtag) != etag(fi) ||
+			rsp.Header.Get("Last-Modified") != fi.ModTime().UTC().Format(http.TimeFormat) {
+			t.Fail()
+		}
+	})
+
+	// single range
+	req("GET", map[string]string{"Range": "bytes=2-5"}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusPartialContent ||
+			rsp.Header.Get("Content-Range") != fmt.Sprintf("bytes 2-5/%d", len(c)) {
+			t.Fail()
+		}
+		b, err := ioutil.ReadAll(rsp.Body)
+		tst.ErrFatal(t, err)
+		if !bytes.Equal(b, c[2:6]) {
+			t.Fail()
+		}
+	})
+
+	// suffix range, HEAD
+	req("HEAD", map[string]string{"Range": "bytes=-4"}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusPartialContent ||
+			rsp.Header.Get(share.HeaderContentLength) != "4" {
+			t.Fail()
+		}
+		b, err := ioutil.ReadAll(rsp.Body)
+		tst.ErrFatal(t, err)
+		if len(b) != 0 {
+			t.Fail()
+		}
+	})
+
+	// multiple ranges
+	req("GET", map[string]string{"Range": "bytes=0-1,4-5"}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusPartialContent {
+			t.Fail()
+			return
+		}
+		mt, params, err := mime.ParseMediaType(rsp.Header.Get(share.HeaderContentType))
+		if err != nil || mt != "multipart/byteranges" {
+			t.Fail()
+			return
+		}
+		mr := multipart.NewReader(rsp.Body, params["boundary"])
+		var parts [][]byte
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			tst.ErrFatal(t, err)
+			b, err := ioutil.ReadAll(p)
+			tst.ErrFatal(t, err)
+			parts = append(parts, b)
+		}
+		if len(parts) != 2 || !bytes.Equal(parts[0], c[0:2]) || !bytes.Equal(parts[1], c[4:6]) {
+			t.Fail()
+		}
+	})
+
+	// unsatisfiable range
+	req("GET", map[string]string{"Range": "bytes=42-"}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fail()
+		}
+	})
+
+	// if-range matching
+	open()
+	et := etag(fi)
+	f.Close()
+	req("GET", map[string]string{"Range": "bytes=0-3", "If-Range": et}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusPartialContent {
+			t.Fail()
+		}
+	})
+
+	// if-range not matching
+	req("GET", map[string]string{"Range": "bytes=0-3", "If-Range": "\"other\""}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fail()
+		}
+		b, err := ioutil.ReadAll(rsp.Body)
+		tst.ErrFatal(t, err)
+		if !bytes.Equal(b, c) {
+			t.Fail()
+		}
+	})
+}
+
+func TestGetFileConditional(t *testing.T) {
+	var (
+		f   *os.File
+		fi  os.FileInfo
+		err error
+	)
+	ht := New(&testOptions{root: dn}).(*handler)
+	tst.Thnd.Sh = func(w http.ResponseWriter, r *http.Request) {
+		ht.getFile(w, r, f, fi)
+	}
+	fn := "some-file"
+	p := path.Join(dn, fn)
+	url := tst.S.URL + "/" + fn
+	tst.WithNewFileF(t, p, func(f *os.File) error {
+		_, err := f.Write([]byte("some content"))
+		return err
+	})
+	req := func(method string, h map[string]string, clb func(rsp *http.Response)) {
+		f, err = os.Open(p)
+		tst.ErrFatal(t, err)
+		defer f.Close()
+		fi, err = f.Stat()
+		tst.ErrFatal(t, err)
+		r, err := http.NewRequest(method, url, nil)
+		tst.ErrFatal(t, err)
+		for k, v := range h {
+			r.Header.Set(k, v)
+		}
+		tst.Htreqr(t, r, clb)
+	}
+	fi, err = os.Stat(p)
+	tst.ErrFatal(t, err)
+	et := etag(fi)
+
+	// if-none-match
+	for _, method := range []string{"GET", "HEAD"} {
+		req(method, map[string]string{"If-None-Match": et}, func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusNotModified {
+				t.Fail()
+			}
+		})
+		req(method, map[string]string{"If-None-Match": "\"other\", " + et}, func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusNotModified {
+				t.Fail()
+			}
+		})
+		req(method, map[string]string{"If-None-Match": "\"other\""}, func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK {
+				t.Fail()
+			}
+		})
+	}
+
+	// if-modified-since
+	req("GET", map[string]string{
+		"If-Modified-Since": fi.ModTime().Add(time.Second).UTC().Format(http.TimeFormat)},
+		func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusNotModified {
+				t.Fail()
+			}
+		})
+	req("GET", map[string]string{
+		"If-Modified-Since": fi.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat)},
+		func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK {
+				t.Fail()
+			}
+		})
+
+	// etag changes with content
+	tst.WithNewFileF(t, p, func(f *os.File) error {
+		_, err := f.Write([]byte("other content"))
+		return err
+	})
+	req("GET", map[string]string{"If-None-Match": et}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fail()
+		}
+	})
+}
+
 func TestPutf(t *testing.T) {
 	ht := New(&testOptions{root: dn, maxRequestBody: testMaxRequestBody}).(*handler)
 	tst.Thnd.Sh = func(w http.ResponseWriter, r *http.Request) {
@@ -1719,6 +2046,432 @@ func TestPutf(t *testing.T) {
 	f(tst.Htrex)
 }
 
+func TestPutfAtomic(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxRequestBody: 8}).(*handler)
+	tst.Thnd.Sh = func(w http.ResponseWriter, r *http.Request) {
+		ht.putf(w, r)
+	}
+	dir := path.Join(dn, "atomic")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	p := path.Join(dir, "file")
+	checkDir := func(names ...string) {
+		d, err := os.Open(dir)
+		tst.ErrFatal(t, err)
+		defer d.Close()
+		dnames, err := d.Readdirnames(0)
+		tst.ErrFatal(t, err)
+		if len(dnames) != len(names) {
+			t.Fail()
+			return
+		}
+		for i, n := range names {
+			if dnames[i] != n {
+				t.Fail()
+			}
+		}
+	}
+
+	// failed upload keeps old content, no leftovers
+	f := func(htr func(tst.Fataler, string, string, io.Reader, func(rsp *http.Response))) {
+		tst.WithNewFileF(t, p, func(f *os.File) error {
+			_, err := f.Write([]byte("old"))
+			return err
+		})
+		htr(t, "PUT", tst.S.URL+"/atomic/file", io.LimitReader(rand.Reader, 16), func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fail()
+			}
+			b, err := ioutil.ReadFile(p)
+			tst.ErrFatal(t, err)
+			if string(b) != "old" {
+				t.Fail()
+			}
+			checkDir("file")
+		})
+	}
+	f(tst.Htreq)
+	f(tst.Htrex)
+
+	// failed upload of a new file leaves nothing
+	tst.RemoveIfExistsF(t, p)
+	tst.Htreqx(t, "PUT", tst.S.URL+"/atomic/file", tst.NewByteReaderString("too long content"),
+		func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fail()
+			}
+			checkDir()
+		})
+
+	// overwrite keeps mode, replaces content
+	ht = New(&testOptions{root: dn, maxRequestBody: 8, fsyncFiles: true, fsyncDirs: true}).(*handler)
+	f = func(htr func(tst.Fataler, string, string, io.Reader, func(rsp *http.Response))) {
+		tst.WithNewFileF(t, p, func(f *os.File) error {
+			_, err := f.Write([]byte("old content"))
+			return err
+		})
+		err := os.Chmod(p, 0751)
+		tst.ErrFatal(t, err)
+		htr(t, "PUT", tst.S.URL+"/atomic/file", bytes.NewBufferString("new"), func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK {
+				t.Fail()
+			}
+			b, err := ioutil.ReadFile(p)
+			tst.ErrFatal(t, err)
+			if string(b) != "new" {
+				t.Fail()
+			}
+			fi, err := os.Lstat(p)
+			tst.ErrFatal(t, err)
+			if fi.Mode() != os.FileMode(0751) || rsp.Header.Get(share.HeaderEtag) != etag(fi) {
+				t.Fail()
+			}
+			checkDir("file")
+		})
+	}
+	f(tst.Htreq)
+	f(tst.Htrex)
+
+	// writes through symlinks
+	tst.WithNewFileF(t, p, nil)
+	lp := path.Join(dir, "link")
+	err := os.Symlink("file", lp)
+	tst.ErrFatal(t, err)
+	tst.Htreqx(t, "PUT", tst.S.URL+"/atomic/link", tst.NewByteReaderString("content"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fail()
+		}
+		fi, err := os.Lstat(lp)
+		tst.ErrFatal(t, err)
+		if fi.Mode()&os.ModeSymlink == 0 {
+			t.Fail()
+		}
+		b, err := ioutil.ReadFile(p)
+		tst.ErrFatal(t, err)
+		if string(b) != "content" {
+			t.Fail()
+		}
+	})
+}
+
+func TestParseContentRange(t *testing.T) {
+	for _, c := range []struct {
+		cr     string
+		offset int64
+		length int64
+		fail   bool
+	}{
+		{"bytes 0-4/12", 0, 5, false},
+		{"bytes 3-3/*", 3, 1, false},
+		{"bytes 3-3", 0, 0, true},
+		{"bytes 3-2/*", 0, 0, true},
+		{"bytes -3/*", 0, 0, true},
+		{"bytes 3-/*", 0, 0, true},
+		{"bytes 0-4/x", 0, 0, true},
+		{"items 0-4/*", 0, 0, true},
+		{"", 0, 0, true},
+	} {
+		offset, length, err := parseContentRange(c.cr)
+		if c.fail && err == nil || !c.fail && (err != nil || offset != c.offset || length != c.length) {
+			t.Fail()
+		}
+	}
+}
+
+func TestAppendf(t *testing.T) {
+	var qry url.Values
+	ht := New(&testOptions{root: dn, maxRequestBody: 8}).(*handler)
+	tst.Thnd.Sh = func(w http.ResponseWriter, r *http.Request) {
+		ht.appendf(w, r, qry)
+	}
+	dir := path.Join(dn, "append")
+	tst.RemoveIfExistsF(t, dir)
+	p := path.Join(dir, "log")
+	aurl := tst.S.URL + "/append/log"
+	check := func(expect string) {
+		b, err := ioutil.ReadFile(p)
+		tst.ErrFatal(t, err)
+		if string(b) != expect {
+			t.Fail()
+		}
+	}
+
+	// creates
+	qry = make(url.Values)
+	tst.Htreqx(t, "POST", aurl, tst.NewByteReaderString("line0\n"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fail()
+		}
+	})
+	check("line0\nline0\n")
+
+	// appends
+	tst.Htreqx(t, "POST", aurl, tst.NewByteReaderString("line1\n"), func(rsp *http.Response) {
+		fi, err := os.Lstat(p)
+		tst.ErrFatal(t, err)
+		if rsp.StatusCode != http.StatusOK || rsp.Header.Get(share.HeaderEtag) != etag(fi) {
+			t.Fail()
+		}
+	})
+	check("line0\nline0\nline1\nline1\n")
+
+	// too large, reverted
+	tst.Htreq(t, "POST", aurl, io.LimitReader(rand.Reader, 16), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fail()
+		}
+	})
+	check("line0\nline0\nline1\nline1\n")
+
+	// at offset
+	qry.Set("offset", "4")
+	tst.Htreq(t, "POST", aurl, bytes.NewBufferString("X"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fail()
+		}
+	})
+	check("lineX\nline0\nline1\nline1\n")
+
+	// at the end
+	qry.Set("offset", "24")
+	tst.Htreq(t, "POST", aurl, bytes.NewBufferString("end"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fail()
+		}
+	})
+	check("lineX\nline0\nline1\nline1\nend")
+
+	// after the end
+	qry.Set("offset", "42")
+	tst.Htreq(t, "POST", aurl, bytes.NewBufferString("X"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fail()
+		}
+	})
+
+	// invalid offset
+	qry.Set("offset", "-1")
+	tst.Htreq(t, "POST", aurl, bytes.NewBufferString("X"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusBadRequest {
+			t.Fail()
+		}
+	})
+
+	// directory
+	qry = make(url.Values)
+	tst.Htreq(t, "POST", tst.S.URL+"/append", bytes.NewBufferString("X"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusNotFound {
+			t.Fail()
+		}
+	})
+	check("lineX\nline0\nline1\nline1\nend")
+}
+
+func TestWriteRange(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxRequestBody: 8})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "append")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	p := path.Join(dir, "file")
+	url := tst.S.URL + "/append/file"
+	tst.WithNewFileF(t, p, func(f *os.File) error {
+		_, err := f.Write([]byte("some content"))
+		return err
+	})
+	req := func(cr, body string, clb func(rsp *http.Response)) {
+		r, err := http.NewRequest("PATCH", url, bytes.NewBufferString(body))
+		tst.ErrFatal(t, err)
+		if cr != "" {
+			r.Header.Set("Content-Range", cr)
+		}
+		tst.Htreqr(t, r, clb)
+	}
+	check := func(expect string) {
+		b, err := ioutil.ReadFile(p)
+		tst.ErrFatal(t, err)
+		if string(b) != expect {
+			t.Fail()
+		}
+	}
+	expectStatus := func(s int) func(*http.Response) {
+		return func(rsp *http.Response) {
+			if rsp.StatusCode != s {
+				t.Fail()
+			}
+		}
+	}
+
+	req("", "other", expectStatus(http.StatusBadRequest))
+	req("bytes 0-4/*", "other", expectStatus(http.StatusOK))
+	check("othercontent")
+	req("bytes 12-17/18", " again", expectStatus(http.StatusOK))
+	check("othercontent again")
+	req("bytes 0-4/*", "too long", expectStatus(http.StatusBadRequest))
+	req("bytes 18-21/*", "abc", expectStatus(http.StatusBadRequest))
+	check("othercontent again")
+	req("bytes 20-20/*", "X", expectStatus(http.StatusRequestedRangeNotSatisfiable))
+	req("bytes 0-15/*", "too long content", expectStatus(http.StatusRequestEntityTooLarge))
+	check("othercontent again")
+}
+
+func TestPreconditions(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxRequestBody: testMaxRequestBody})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "preconditions")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	p := path.Join(dir, "file")
+	url := tst.S.URL + "/preconditions/file"
+	req := func(method, url string, body string, h map[string]string, clb func(rsp *http.Response)) {
+		r, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		tst.ErrFatal(t, err)
+		for k, v := range h {
+			r.Header.Set(k, v)
+		}
+		tst.Htreqr(t, r, clb)
+	}
+	currentEtag := func() string {
+		fi, err := os.Lstat(p)
+		tst.ErrFatal(t, err)
+		return etag(fi)
+	}
+	expectStatus := func(s int) func(*http.Response) {
+		return func(rsp *http.Response) {
+			if rsp.StatusCode != s {
+				t.Fail()
+			}
+		}
+	}
+
+	// create only
+	tst.RemoveIfExistsF(t, p)
+	req("PUT", url, "some content", map[string]string{"If-None-Match": "*"}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK || rsp.Header.Get(share.HeaderEtag) != currentEtag() {
+			t.Fail()
+		}
+	})
+	req("PUT", url, "other content", map[string]string{"If-None-Match": "*"},
+		expectStatus(http.StatusPreconditionFailed))
+	b, err := ioutil.ReadFile(p)
+	tst.ErrFatal(t, err)
+	if string(b) != "some content" {
+		t.Fail()
+	}
+
+	// compare and swap
+	et := currentEtag()
+	req("PUT", url, "other content", map[string]string{"If-Match": "\"other\""},
+		expectStatus(http.StatusPreconditionFailed))
+	req("PUT", url, "other content", map[string]string{"If-Match": et}, expectStatus(http.StatusOK))
+	req("PUT", url, "more content", map[string]string{"If-Match": et}, expectStatus(http.StatusPreconditionFailed))
+	b, err = ioutil.ReadFile(p)
+	tst.ErrFatal(t, err)
+	if string(b) != "other content" {
+		t.Fail()
+	}
+
+	// checked again when the new content is moved in place
+	cp := path.Join(dir, "concurrent")
+	commit := func(h map[string]string) error {
+		r, err := http.NewRequest("PUT", tst.S.URL+"/preconditions/concurrent", nil)
+		tst.ErrFatal(t, err)
+		for k, v := range h {
+			r.Header.Set(k, v)
+		}
+		f, err := createTemp(cp, 0666)
+		tst.ErrFatal(t, err)
+		defer f.Close()
+		defer os.Remove(f.Name())
+		_, err = f.Write([]byte("temp content"))
+		tst.ErrFatal(t, err)
+		return ht.(*handler).commitTemp(f, cp, r)
+	}
+	tst.RemoveIfExistsF(t, cp)
+	err = ioutil.WriteFile(cp, []byte("created in the meantime"), os.ModePerm)
+	tst.ErrFatal(t, err)
+	if err := commit(map[string]string{"If-None-Match": "*"}); err != preconditionFailed {
+		t.Fail()
+	}
+	if err := commit(map[string]string{"If-Match": "\"other\""}); err != preconditionFailed {
+		t.Fail()
+	}
+	checkFileContent(t, cp, "created in the meantime")
+	fi, err := os.Stat(cp)
+	tst.ErrFatal(t, err)
+	if err := commit(map[string]string{"If-Match": etag(fi)}); err != nil {
+		t.Fail()
+	}
+	checkFileContent(t, cp, "temp content")
+
+	// through a symlink, by the etag of the target
+	lp := path.Join(dir, "link")
+	tst.RemoveIfExistsF(t, lp)
+	err = os.Symlink("file", lp)
+	tst.ErrFatal(t, err)
+	req("GET", tst.S.URL+"/preconditions/link", "", nil, func(rsp *http.Response) {
+		et = rsp.Header.Get(share.HeaderEtag)
+	})
+	req("PUT", tst.S.URL+"/preconditions/link", "other content", map[string]string{"If-Match": et},
+		expectStatus(http.StatusOK))
+	tst.RemoveIfExistsF(t, lp)
+
+	// if-match on not existing
+	req("PUT", tst.S.URL+"/preconditions/not-existing", "", map[string]string{"If-Match": "*"},
+		expectStatus(http.StatusPreconditionFailed))
+	if _, err := os.Lstat(path.Join(dir, "not-existing")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	// etag of props and directories
+	req("PROPS", url, "", nil, func(rsp *http.Response) {
+		if rsp.Header.Get(share.HeaderEtag) != currentEtag() {
+			t.Fail()
+		}
+	})
+	req("GET", tst.S.URL+"/preconditions", "", nil, func(rsp *http.Response) {
+		fi, err := os.Lstat(dir)
+		tst.ErrFatal(t, err)
+		if rsp.Header.Get(share.HeaderEtag) != etag(fi) {
+			t.Fail()
+		}
+	})
+
+	// modprops
+	req("MODPROPS", url, "{\"mode\": 420}", map[string]string{"If-Match": "\"other\""},
+		expectStatus(http.StatusPreconditionFailed))
+	req("MODPROPS", url, "{\"mode\": 420}", map[string]string{"If-Match": currentEtag()},
+		expectStatus(http.StatusOK))
+	fi, err = os.Lstat(p)
+	tst.ErrFatal(t, err)
+	if fi.Mode() != os.FileMode(0644) {
+		t.Fail()
+	}
+
+	// rename
+	req("RENAME", url+"?to=/preconditions/file0", "", map[string]string{"If-Match": "\"other\""},
+		expectStatus(http.StatusPreconditionFailed))
+	req("RENAME", url+"?to=/preconditions/file0", "", map[string]string{"If-None-Match": currentEtag()},
+		expectStatus(http.StatusPreconditionFailed))
+	et = currentEtag()
+	req("RENAME", url+"?to=/preconditions/file0", "", map[string]string{"If-Match": et},
+		expectStatus(http.StatusOK))
+	req("RENAME", tst.S.URL+"/preconditions/file0?to=/preconditions/file", "", nil, expectStatus(http.StatusOK))
+
+	// delete
+	req("DELETE", url, "", map[string]string{"If-Match": "\"other\""}, expectStatus(http.StatusPreconditionFailed))
+	req("POST", url+"?cmd=delete", "", map[string]string{"If-Match": "\"other\""},
+		expectStatus(http.StatusPreconditionFailed))
+	if _, err := os.Lstat(p); err != nil {
+		t.Fail()
+	}
+	req("DELETE", url, "", map[string]string{"If-Match": "\"other\", " + currentEtag()}, expectStatus(http.StatusOK))
+	if _, err := os.Lstat(p); !os.IsNotExist(err) {
+		t.Fail()
+	}
+	req("DELETE", url, "", map[string]string{"If-Match": "*"}, expectStatus(http.StatusPreconditionFailed))
+}
+
 func TestPutfNotRoot(t *testing.T) {
 	if tst.IsRoot {
 		t.Skip()
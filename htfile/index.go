@@ -0,0 +1,531 @@
+package htfile
+
+import (
+	"bufio"
+	"encoding/gob"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	indexDir           = "index"
+	indexFileExt       = ".gob"
+	maxIndexedFileSize = 1 << 20
+	maxFileTokens      = 1 << 14
+	minTokenLength     = 2
+	maxTokenLength     = 64
+	indexUpdateQueue   = 1 << 10
+	indexPersistPeriod = time.Minute
+	searchQueryText    = "text"
+	indexStateBuilding = "building"
+	indexStateReady    = "ready"
+)
+
+// an entry of the index. The paths are relative to the root. Only the tokens of the searchable files are
+// stored, up to maxIndexedFileSize.
+type indexedFile struct {
+	IsDir   bool
+	Size    int64
+	ModTime int64
+	Tokens  []string
+}
+
+// the persisted form of the index
+type indexData struct {
+	Files     map[string]*indexedFile
+	Rescanned time.Time
+}
+
+// a name and full text index of the root, kept in memory and persisted in the cachedir. It is updated
+// after the mutating requests, and rebuilt periodically, to pick up the changes made by others. The maps
+// are changed only by the goroutine started by run.
+type searchIndex struct {
+	h         *handler
+	interval  time.Duration
+	mx        sync.RWMutex
+	files     map[string]*indexedFile
+	tokens    map[string]map[string]bool
+	ready     bool
+	rescanned time.Time
+	updated   time.Time
+	dirty     bool
+	missed    bool
+	updates   chan []string
+	stop      chan struct{}
+}
+
+// a path split once into its names, for sorting
+type walkKey struct {
+	rel   string
+	names []string
+}
+
+type byWalkOrder []walkKey
+
+func (ks byWalkOrder) Len() int           { return len(ks) }
+func (ks byWalkOrder) Less(i, j int) bool { return namesAfter(ks[j].names, ks[i].names) }
+func (ks byWalkOrder) Swap(i, j int)      { ks[i], ks[j] = ks[j], ks[i] }
+
+// calls add with the lowercase words of the text, until add returns false
+func tokenize(r io.Reader, add func(string) bool) error {
+	br := bufio.NewReader(r)
+	var token []rune
+	flush := func() bool {
+		t := token
+		token = token[:0]
+		if len(t) < minTokenLength || len(t) > maxTokenLength {
+			return true
+		}
+		return add(string(t))
+	}
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			flush()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if len(token) <= maxTokenLength {
+				token = append(token, unicode.ToLower(c))
+			}
+			continue
+		}
+		if !flush() {
+			return nil
+		}
+	}
+}
+
+// the distinct tokens of the query terms, sorted
+func tokenizeTerms(terms []string) []string {
+	m := make(map[string]bool)
+	for _, t := range terms {
+		tokenize(strings.NewReader(t), func(token string) bool {
+			m[token] = true
+			return true
+		})
+	}
+	var tokens []string
+	for t := range m {
+		tokens = append(tokens, t)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// the distinct tokens of a searchable file, sorted
+func (h *handler) fileTokens(p string, fi os.FileInfo) []string {
+	if !fi.Mode().IsRegular() || fi.Size() > maxIndexedFileSize {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer share.Doretlog42(f.Close)
+	ct, err := h.contentType(fi.Name(), f)
+	if err != nil || !h.searchable(ct) {
+		return nil
+	}
+	r := textReader(f, ct)
+	if r == nil {
+		return nil
+	}
+	m := make(map[string]bool)
+	tokenize(r, func(t string) bool {
+		m[t] = true
+		return len(m) < maxFileTokens
+	})
+	tokens := make([]string, 0, len(m))
+	for t := range m {
+		tokens = append(tokens, t)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func hasTokens(tokens, of []string) bool {
+	for _, t := range of {
+		i := sort.SearchStrings(tokens, t)
+		if i == len(tokens) || tokens[i] != t {
+			return false
+		}
+	}
+	return true
+}
+
+func newSearchIndex(h *handler, interval time.Duration) *searchIndex {
+	return &searchIndex{
+		h:        h,
+		interval: interval,
+		files:    make(map[string]*indexedFile),
+		tokens:   make(map[string]map[string]bool),
+		updates:  make(chan []string, indexUpdateQueue),
+		stop:     make(chan struct{})}
+}
+
+// the index is kept per user, because it contains the content of the files
+func (ix *searchIndex) filename() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(ix.h.cachedir, indexDir, u.Uid+indexFileExt), nil
+}
+
+func (ix *searchIndex) load() error {
+	fn, err := ix.filename()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(f.Close)
+	var d indexData
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&d)
+	if err != nil || d.Files == nil {
+		return err
+	}
+	ix.swap(d.Files, d.Rescanned)
+	return nil
+}
+
+func (ix *searchIndex) persist() error {
+	fn, err := ix.filename()
+	if err != nil {
+		return err
+	}
+	err = ix.h.ensureSharedDir(path.Dir(fn))
+	if err != nil {
+		return err
+	}
+	f, err := createTemp(fn, 0600)
+	if err != nil {
+		return err
+	}
+
+	// cleared before encoding, so that the changes made in the meantime are persisted the next time
+	ix.mx.Lock()
+	ix.dirty = false
+	ix.mx.Unlock()
+
+	ix.mx.RLock()
+	bw := bufio.NewWriter(f)
+	err = gob.NewEncoder(bw).Encode(&indexData{Files: ix.files, Rescanned: ix.rescanned})
+	ix.mx.RUnlock()
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fn)
+	}
+	if err != nil {
+		share.Doretlog42(func() error { return os.Remove(f.Name()) })
+		ix.mx.Lock()
+		ix.dirty = true
+		ix.mx.Unlock()
+	}
+	return err
+}
+
+// creates the entry of a file, reusing the tokens of the previous entry when the file didn't change
+func (ix *searchIndex) entry(rel string, fi os.FileInfo) *indexedFile {
+	e := &indexedFile{IsDir: fi.IsDir(), Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	if prev, ok := ix.files[rel]; ok && !e.IsDir && prev.Size == e.Size && prev.ModTime == e.ModTime {
+		e.Tokens = prev.Tokens
+		return e
+	}
+	e.Tokens = ix.h.fileTokens(path.Join(ix.h.dn, rel), fi)
+	return e
+}
+
+// collects the entries of a subtree, the directory itself included
+func (ix *searchIndex) scan(rel string, fi os.FileInfo, files map[string]*indexedFile) {
+	if rel != "." {
+		files[rel] = ix.entry(rel, fi)
+	}
+	if !fi.IsDir() {
+		return
+	}
+	p := path.Join(ix.h.dn, rel)
+	walkTree([]*fileInfo{&fileInfo{sys: fi, dirname: path.Dir(p)}}, func(fi *fileInfo) bool {
+		frel, err := filepath.Rel(ix.h.dn, path.Join(fi.dirname, fi.Name()))
+		if err == nil {
+			files[frel] = ix.entry(frel, fi)
+		}
+		return true
+	}, nil, nil)
+}
+
+func (ix *searchIndex) addTokens(rel string, e *indexedFile) {
+	for _, t := range e.Tokens {
+		ps, ok := ix.tokens[t]
+		if !ok {
+			ps = make(map[string]bool)
+			ix.tokens[t] = ps
+		}
+		ps[rel] = true
+	}
+}
+
+func (ix *searchIndex) remove(rel string) {
+	e, ok := ix.files[rel]
+	if !ok {
+		return
+	}
+	for _, t := range e.Tokens {
+		delete(ix.tokens[t], rel)
+		if len(ix.tokens[t]) == 0 {
+			delete(ix.tokens, t)
+		}
+	}
+	delete(ix.files, rel)
+}
+
+func (ix *searchIndex) swap(files map[string]*indexedFile, rescanned time.Time) {
+	tokens := make(map[string]map[string]bool)
+	ix.mx.Lock()
+	defer ix.mx.Unlock()
+	ix.files = files
+	ix.tokens = tokens
+	for rel, e := range files {
+		ix.addTokens(rel, e)
+	}
+	ix.ready = true
+	ix.rescanned = rescanned
+	ix.updated = time.Now()
+}
+
+func (ix *searchIndex) rescan() error {
+	fi, err := os.Lstat(ix.h.dn)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]*indexedFile)
+	ix.scan(".", fi, files)
+	ix.swap(files, time.Now())
+	return ix.persist()
+}
+
+// reindexes the changed paths, and their subtrees
+func (ix *searchIndex) update(rels []string) {
+	for _, rel := range rels {
+		if rel == "." {
+			ix.mx.Lock()
+			ix.missed = true
+			ix.mx.Unlock()
+			continue
+		}
+		files := make(map[string]*indexedFile)
+		fi, err := os.Lstat(path.Join(ix.h.dn, rel))
+		if err == nil {
+			ix.scan(rel, fi, files)
+		}
+
+		// the parent directories may have been created, too
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			ix.mx.RLock()
+			_, ok := ix.files[dir]
+			ix.mx.RUnlock()
+			if ok {
+				break
+			}
+			if dfi, err := os.Lstat(path.Join(ix.h.dn, dir)); err == nil {
+				files[dir] = ix.entry(dir, dfi)
+			}
+		}
+
+		ix.mx.Lock()
+		if prev, ok := ix.files[rel]; ok && prev.IsDir || fi != nil && fi.IsDir() {
+			for frel := range ix.files {
+				if strings.HasPrefix(frel, rel+"/") {
+					ix.remove(frel)
+				}
+			}
+		}
+		ix.remove(rel)
+		for frel, e := range files {
+			ix.remove(frel)
+			ix.files[frel] = e
+			ix.addTokens(frel, e)
+		}
+		ix.dirty = true
+		ix.updated = time.Now()
+		ix.mx.Unlock()
+	}
+}
+
+// queues the changed paths without blocking. When the queue is full, the changes are picked up by an
+// early rescan.
+func (ix *searchIndex) changed(rels []string) {
+	select {
+	case ix.updates <- rels:
+	default:
+		ix.mx.Lock()
+		ix.missed = true
+		ix.mx.Unlock()
+	}
+}
+
+// maintains the index until close is called
+func (ix *searchIndex) run() {
+	share.Dolog(ix.load)
+	share.Dolog(ix.rescan)
+	rescan := time.NewTicker(ix.interval)
+	persist := time.NewTicker(indexPersistPeriod)
+	defer rescan.Stop()
+	defer persist.Stop()
+	for {
+		select {
+		case <-ix.stop:
+			return
+		case rels := <-ix.updates:
+			ix.update(rels)
+		case <-rescan.C:
+			share.Dolog(ix.rescan)
+		case <-persist.C:
+			ix.mx.RLock()
+			missed, dirty := ix.missed, ix.dirty
+			ix.mx.RUnlock()
+			switch {
+			case missed:
+				ix.mx.Lock()
+				ix.missed = false
+				ix.mx.Unlock()
+				share.Dolog(ix.rescan)
+			case dirty:
+				share.Dolog(ix.persist)
+			}
+		}
+	}
+}
+
+func (ix *searchIndex) close() { close(ix.stop) }
+
+func (ix *searchIndex) isReady() bool {
+	ix.mx.RLock()
+	defer ix.mx.RUnlock()
+	return ix.ready
+}
+
+// returns the indexed paths under a directory, having all the tokens, relative to the directory, in the
+// walk order
+func (ix *searchIndex) candidates(dir string, tokens []string) []string {
+	ix.mx.RLock()
+	defer ix.mx.RUnlock()
+	prefix := dir + "/"
+	if dir == "." {
+		prefix = ""
+	}
+	var ks []walkKey
+	add := func(rel string) {
+		if strings.HasPrefix(rel, prefix) {
+			rel = rel[len(prefix):]
+			ks = append(ks, walkKey{rel: rel, names: strings.Split(rel, "/")})
+		}
+	}
+	if len(tokens) == 0 {
+		for rel := range ix.files {
+			add(rel)
+		}
+	} else {
+		smallest := ix.tokens[tokens[0]]
+		for _, t := range tokens[1:] {
+			if len(ix.tokens[t]) < len(smallest) {
+				smallest = ix.tokens[t]
+			}
+		}
+		for rel := range smallest {
+			if hasTokens(ix.files[rel].Tokens, tokens) {
+				add(rel)
+			}
+		}
+	}
+	sort.Sort(byWalkOrder(ks))
+	ps := make([]string, len(ks))
+	for i, k := range ks {
+		ps[i] = k.rel
+	}
+	return ps
+}
+
+func (ix *searchIndex) status() map[string]interface{} {
+	ix.mx.RLock()
+	defer ix.mx.RUnlock()
+	state := indexStateBuilding
+	if ix.ready {
+		state = indexStateReady
+	}
+	return map[string]interface{}{
+		"state":     state,
+		"files":     len(ix.files),
+		"tokens":    len(ix.tokens),
+		"rescanned": ix.rescanned.Unix(),
+		"updated":   ix.updated.Unix(),
+		"queued":    len(ix.updates)}
+}
+
+// returns the path relative to the root, when it can be served from the index, because it doesn't
+// contain symlinks
+func (h *handler) indexRel(p string) (string, bool) {
+	if h.index == nil || !h.index.isReady() {
+		return "", false
+	}
+	rel, err := filepath.Rel(h.dn, p)
+	if err != nil {
+		return "", false
+	}
+	root, err := filepath.EvalSymlinks(h.dn)
+	if err != nil {
+		return "", false
+	}
+	rp, err := filepath.EvalSymlinks(p)
+	if err != nil || rp != path.Join(root, rel) {
+		return "", false
+	}
+	return rel, true
+}
+
+// queues the paths changed by a request for reindexing
+func (h *handler) indexChanged(ps []string) {
+	if h.index == nil || len(ps) == 0 {
+		return
+	}
+	rels := make([]string, len(ps))
+	for i, p := range ps {
+		rels[i] = path.Clean(strings.TrimPrefix(p, "/"))
+		if rels[i] == "" {
+			rels[i] = "."
+		}
+	}
+	h.index.changed(rels)
+}
+
+func (h *handler) indexStatusf(w http.ResponseWriter, r *http.Request) {
+	if !share.CheckHandle(w, h.index != nil, http.StatusNotFound) {
+		return
+	}
+	_, err := share.WriteJsonResponse(w, r, h.index.status())
+	share.CheckServerError(w, err != share.MarshalError)
+}
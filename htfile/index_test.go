@@ -0,0 +1,128 @@
+package htfile
+
+import (
+	"bytes"
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func initIndex(t *testing.T) {
+	initTestDir(t, "index", map[string]string{
+		"a.txt":     "Hello, world!",
+		"b.txt":     "hello there",
+		"sub/c.txt": "the world",
+		"binary":    "hello\x00\x01\x02\x03"})
+}
+
+func indexSearch(t *testing.T, qry string) []string {
+	var names []string
+	tst.Htreq(t, "SEARCH", tst.S.URL+"/index"+qry, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(qry, rsp.StatusCode)
+		}
+		var ms []map[string]interface{}
+		err := json.NewDecoder(rsp.Body).Decode(&ms)
+		tst.ErrFatal(t, err)
+		for _, m := range ms {
+			names = append(names, m["name"].(string))
+		}
+	})
+	sort.Strings(names)
+	return names
+}
+
+func waitIndexSearch(t *testing.T, qry string, expect ...string) {
+	var names []string
+	for i := 0; i < 100; i++ {
+		names = indexSearch(t, qry)
+		if strings.Join(names, ",") == strings.Join(expect, ",") {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Log(qry, names)
+	t.Fail()
+}
+
+func indexStatus(t *testing.T) map[string]interface{} {
+	var status map[string]interface{}
+	tst.Htreq(t, "GET", tst.S.URL+"?cmd=index", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		err := json.NewDecoder(rsp.Body).Decode(&status)
+		tst.ErrFatal(t, err)
+	})
+	return status
+}
+
+func TestSearchText(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxSearchResults: 30})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initIndex(t)
+	expectStatus(t, "SEARCH", "/index?text=!", http.StatusBadRequest)
+	expectStatus(t, "GET", "?cmd=index", http.StatusNotFound)
+	if names := indexSearch(t, "?text=hello"); strings.Join(names, ",") != "a.txt,b.txt" {
+		t.Log(names)
+		t.Fail()
+	}
+	if names := indexSearch(t, "?text=World+HELLO"); strings.Join(names, ",") != "a.txt" {
+		t.Log(names)
+		t.Fail()
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	initIndex(t)
+	tst.RemoveIfExistsF(t, path.Join(cachedir, indexDir))
+	ht := New(&testOptions{root: dn, cachedir: cachedir, maxSearchResults: 30, searchIndex: 3600})
+	defer ht.(*handler).Close()
+	tst.Thnd.Sh = ht.ServeHTTP
+	for i := 0; i < 500; i++ {
+		if indexStatus(t)["state"] == indexStateReady {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	status := indexStatus(t)
+	if status["state"] != indexStateReady || status["files"].(float64) < 5 {
+		t.Fatal(status)
+	}
+	fis, err := ioutil.ReadDir(path.Join(cachedir, indexDir))
+	if err != nil || len(fis) != 1 {
+		t.Fail()
+	}
+
+	waitIndexSearch(t, "?text=hello", "a.txt", "b.txt")
+	waitIndexSearch(t, "?text=world&name=txt", "a.txt", "c.txt")
+	waitIndexSearch(t, "?text=world&exclude=sub", "a.txt")
+
+	tst.Htreq(t, "PUT", tst.S.URL+"/index/sub/d.txt", bytes.NewBufferString("world peace"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+	})
+	waitIndexSearch(t, "?text=peace", "d.txt")
+	expectStatus(t, "DELETE", "/index/a.txt", http.StatusOK)
+	waitIndexSearch(t, "?text=world", "c.txt", "d.txt")
+	expectStatus(t, "RENAME", "/index/sub?to=/index/moved", http.StatusOK)
+	waitIndexSearch(t, "?text=world&glob=moved/*", "c.txt", "d.txt")
+}
+
+func TestTokenize(t *testing.T) {
+	tokens := tokenizeTerms([]string{"Árvíztűrő a tükörfúrógép, 42 x" + strings.Repeat("y", maxTokenLength)})
+	if strings.Join(tokens, ",") != "42,tükörfúrógép,árvíztűrő" {
+		t.Log(tokens)
+		t.Fail()
+	}
+	if !hasTokens([]string{"a", "b", "c"}, []string{"c", "a"}) || hasTokens([]string{"a", "c"}, []string{"b"}) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,372 @@
+package htfile
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/aryszka/tasked/share"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	listQrySort   = "sort"
+	listQryOrder  = "order"
+	listQryName   = "name"
+	listQryGlob   = "glob"
+	listQryHidden = "hidden"
+	listQryOffset = "offset"
+	listQryLimit  = "limit"
+	listQryCursor = "cursor"
+	listQryFormat = "format"
+
+	listSortName    = "name"
+	listSortSize    = "size"
+	listSortModTime = "modTime"
+
+	listOrderAsc  = "asc"
+	listOrderDesc = "desc"
+
+	listFormatJson   = "json"
+	listFormatNdjson = "ndjson"
+	listFormatHtml   = "html"
+
+	htmlContentType = "text/html; charset=utf-8"
+	listTimeFormat  = "2006-01-02 15:04:05"
+
+	// the directory is read in chunks of this size
+	listReadChunk = 1 << 10
+)
+
+var (
+	headerTotalCount = http.CanonicalHeaderKey("x-total-count")
+	headerListCursor = http.CanonicalHeaderKey("x-list-cursor")
+	headerVary       = http.CanonicalHeaderKey("vary")
+)
+
+var listFormats = map[string]string{
+	"text/html":        listFormatHtml,
+	"application/json": listFormatJson,
+	ndjsonContentType:  listFormatNdjson}
+
+var listTemplate = template.Must(template.New("list").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if .Parent}}<tr><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.ModTime}}</td></tr>
+{{end}}</table>
+{{if .Next}}<p><a href="{{.Next}}">next</a></p>
+{{end}}</body>
+</html>
+`))
+
+type listPage struct {
+	Path    string
+	Parent  string
+	Entries []*listPageEntry
+	Next    string
+}
+
+type listPageEntry struct {
+	Name    string
+	Href    string
+	Size    string
+	ModTime string
+}
+
+// the options of a directory listing. The entries are always sorted, by name by default, and the ties are
+// broken by name, so the pages are stable.
+type listOptions struct {
+	sortKey string
+	desc    bool
+	rx      *regexp.Regexp
+	globs   []string
+	hidden  bool
+	offset  int
+	limit   int
+	after   *listEntry
+}
+
+// an entry of the listing, with the value of the sort key
+type listEntry struct {
+	value int64
+	name  string
+	fi    os.FileInfo
+}
+
+func getQryListOptions(qry url.Values) (*listOptions, error) {
+	o := &listOptions{sortKey: listSortName, hidden: true}
+	if vs, ok := qry[listQrySort]; ok {
+		if len(vs) != 1 {
+			return nil, invalidQueryString
+		}
+		switch vs[0] {
+		case listSortName, listSortSize, listSortModTime:
+			o.sortKey = vs[0]
+		default:
+			return nil, invalidQueryString
+		}
+	}
+	if vs, ok := qry[listQryOrder]; ok {
+		if len(vs) != 1 {
+			return nil, invalidQueryString
+		}
+		switch vs[0] {
+		case listOrderAsc:
+		case listOrderDesc:
+			o.desc = true
+		default:
+			return nil, invalidQueryString
+		}
+	}
+	var err error
+	if o.rx, err = getQryExpression(qry, listQryName); err != nil {
+		return nil, invalidQueryString
+	}
+	if o.globs, err = getQryGlobs(qry, listQryGlob); err != nil {
+		return nil, invalidQueryString
+	}
+	if vs, ok := qry[listQryHidden]; ok {
+		if len(vs) != 1 {
+			return nil, invalidQueryString
+		}
+		if o.hidden, err = strconv.ParseBool(vs[0]); err != nil {
+			return nil, invalidQueryString
+		}
+	}
+	if o.offset, err = getQryNum(qry, listQryOffset); err != nil || o.offset < 0 {
+		return nil, invalidQueryString
+	}
+	if o.limit, err = getQryNum(qry, listQryLimit); err != nil || o.limit < 0 {
+		return nil, invalidQueryString
+	}
+	if o.after, err = getQryListCursor(qry); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// the cursor is the encoded sort value and name of the last returned entry
+func getQryListCursor(qry url.Values) (*listEntry, error) {
+	cs, ok := qry[listQryCursor]
+	if !ok {
+		return nil, nil
+	}
+	if len(cs) != 1 {
+		return nil, invalidQueryString
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cs[0])
+	if err != nil {
+		return nil, invalidQueryString
+	}
+	parts := strings.SplitN(string(b), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, invalidQueryString
+	}
+	v, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, invalidQueryString
+	}
+	return &listEntry{value: v, name: parts[1]}, nil
+}
+
+func (e *listEntry) cursor() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(e.value, 10) + "/" + e.name))
+}
+
+func (o *listOptions) entry(fi os.FileInfo) *listEntry {
+	e := &listEntry{name: fi.Name(), fi: fi}
+	switch o.sortKey {
+	case listSortSize:
+		e.value = fi.Size()
+	case listSortModTime:
+		e.value = fi.ModTime().UnixNano()
+	}
+	return e
+}
+
+func (o *listOptions) less(a, b *listEntry) bool {
+	if a.value == b.value {
+		return a.name < b.name != o.desc
+	}
+	return a.value < b.value != o.desc
+}
+
+func (o *listOptions) match(name string) bool {
+	if !o.hidden && strings.HasPrefix(name, ".") {
+		return false
+	}
+	if o.rx != nil && !o.rx.MatchString(name) {
+		return false
+	}
+	return len(o.globs) == 0 || matchGlobs(o.globs, name, name)
+}
+
+// keeps the first n entries in the listing order, with the last one on top
+type listHeap struct {
+	o       *listOptions
+	entries []*listEntry
+}
+
+func (lh *listHeap) Len() int           { return len(lh.entries) }
+func (lh *listHeap) Less(i, j int) bool { return lh.o.less(lh.entries[j], lh.entries[i]) }
+func (lh *listHeap) Swap(i, j int)      { lh.entries[i], lh.entries[j] = lh.entries[j], lh.entries[i] }
+func (lh *listHeap) Push(e interface{}) { lh.entries = append(lh.entries, e.(*listEntry)) }
+func (lh *listHeap) Pop() interface{} {
+	e := lh.entries[len(lh.entries)-1]
+	lh.entries = lh.entries[:len(lh.entries)-1]
+	return e
+}
+
+// reads the directory in chunks, and returns the entries of the requested page, the total number of the
+// matching entries, and whether there are more entries after the page. When a limit is set, only the
+// entries up to the end of the page are kept in memory.
+func listDir(d *os.File, o *listOptions) ([]*listEntry, int, bool, error) {
+	var (
+		total int
+		rest  int
+	)
+	keep := o.offset + o.limit
+	lh := &listHeap{o: o}
+	for {
+		fis, err := d.Readdir(listReadChunk)
+		for _, fi := range fis {
+			if !o.match(fi.Name()) {
+				continue
+			}
+			total++
+			e := o.entry(fi)
+			if o.after != nil && !o.less(o.after, e) {
+				continue
+			}
+			rest++
+			if o.limit == 0 || lh.Len() < keep {
+				heap.Push(lh, e)
+				continue
+			}
+			if o.less(e, lh.entries[0]) {
+				lh.entries[0] = e
+				heap.Fix(lh, 0)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+	page := make([]*listEntry, lh.Len())
+	for i := len(page) - 1; i >= 0; i-- {
+		page[i] = heap.Pop(lh).(*listEntry)
+	}
+	if o.offset >= len(page) {
+		return nil, total, false, nil
+	}
+	return page[o.offset:], total, o.limit > 0 && rest > keep, nil
+}
+
+// the format set in the query overrides the Accept header. From the Accept header, the supported type with
+// the highest quality is selected, and the first one from those with equal quality. The default is JSON.
+func getListFormat(r *http.Request, qry url.Values) (string, error) {
+	if fs, ok := qry[listQryFormat]; ok {
+		if len(fs) != 1 {
+			return "", invalidQueryString
+		}
+		switch fs[0] {
+		case listFormatJson, listFormatNdjson, listFormatHtml:
+			return fs[0], nil
+		default:
+			return "", invalidQueryString
+		}
+	}
+	format := listFormatJson
+	var q float64
+	for _, a := range strings.Split(r.Header.Get(headerAccept), ",") {
+		parts := strings.Split(a, ";")
+		f, ok := listFormats[strings.ToLower(strings.TrimSpace(parts[0]))]
+		if !ok {
+			continue
+		}
+		aq := 1.0
+		for _, p := range parts[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					aq = v
+				}
+			}
+		}
+		if aq > q {
+			format, q = f, aq
+		}
+	}
+	return format, nil
+}
+
+func writeNdjson(w http.ResponseWriter, r *http.Request, prs []map[string]interface{}) {
+	w.Header().Set(share.HeaderContentType, ndjsonContentType)
+	if r.Method == "HEAD" {
+		return
+	}
+	enc := json.NewEncoder(w)
+	for _, pr := range prs {
+		if enc.Encode(pr) != nil {
+			return
+		}
+	}
+}
+
+// the links are relative, so they work behind a proxy, too
+func writeListHtml(w http.ResponseWriter, r *http.Request, qry url.Values, entries []*listEntry, next string) {
+	w.Header().Set(share.HeaderContentType, htmlContentType)
+	if r.Method == "HEAD" {
+		return
+	}
+	up := path.Clean("/" + r.URL.Path)
+	prefix, parent := "./", "../"
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		prefix, parent = "./"+url.PathEscape(path.Base(up))+"/", "./"
+	}
+	page := &listPage{Path: up}
+	if up != "/" {
+		page.Parent = parent
+	}
+	for _, e := range entries {
+		fi := e.fi
+		pe := &listPageEntry{
+			Name:    fi.Name(),
+			Href:    prefix + url.PathEscape(fi.Name()),
+			ModTime: fi.ModTime().UTC().Format(listTimeFormat)}
+		if fi.IsDir() {
+			pe.Name += "/"
+			pe.Href += "/"
+		} else {
+			pe.Size = strconv.FormatInt(fi.Size(), 10)
+		}
+		page.Entries = append(page.Entries, pe)
+	}
+	if next != "" {
+		nq := make(url.Values)
+		for k, v := range qry {
+			nq[k] = v
+		}
+		nq.Set(listQryCursor, next)
+		page.Next = "?" + nq.Encode()
+	}
+	share.Dolog(func() error { return listTemplate.Execute(w, page) })
+}
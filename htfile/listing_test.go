@@ -0,0 +1,175 @@
+package htfile
+
+import (
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func initListing(t *testing.T) {
+	dir := path.Join(dn, "listing")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, path.Join(dir, "dir"))
+	now := time.Now()
+	for i, n := range []string{"c.txt", "a.log", "b.txt", ".hidden", "d.txt"} {
+		p := path.Join(dir, n)
+		err := ioutil.WriteFile(p, []byte(strings.Repeat("x", (i+1)*10)), os.ModePerm)
+		tst.ErrFatal(t, err)
+		mt := now.Add(time.Duration(i) * time.Minute)
+		err = os.Chtimes(p, mt, mt)
+		tst.ErrFatal(t, err)
+	}
+}
+
+func checkListing(t *testing.T, qry string, total, cursor string, expect ...string) string {
+	var next string
+	tst.Htreq(t, "GET", tst.S.URL+"/listing"+qry, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(qry, rsp.StatusCode)
+		}
+		var ms []map[string]interface{}
+		err := json.NewDecoder(rsp.Body).Decode(&ms)
+		tst.ErrFatal(t, err)
+		var names []string
+		for _, m := range ms {
+			names = append(names, m["name"].(string))
+		}
+		if strings.Join(names, ",") != strings.Join(expect, ",") || rsp.Header.Get(headerTotalCount) != total {
+			t.Log(qry, names, rsp.Header.Get(headerTotalCount))
+			t.Fail()
+		}
+		next = rsp.Header.Get(headerListCursor)
+		if (next != "") != (cursor != "") {
+			t.Log(qry, next)
+			t.Fail()
+		}
+	})
+	return next
+}
+
+func TestListDir(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initListing(t)
+	for _, qry := range []string{
+		"?sort=owner",
+		"?order=up",
+		"?name=[",
+		"?glob=[",
+		"?hidden=maybe",
+		"?offset=-1",
+		"?limit=x",
+		"?cursor=not-base64!",
+		"?cursor=Zm9v",
+	} {
+		expectStatus(t, "GET", "/listing"+qry, http.StatusBadRequest)
+	}
+
+	checkListing(t, "", "6", "", ".hidden", "a.log", "b.txt", "c.txt", "d.txt", "dir")
+	checkListing(t, "?hidden=false&order=desc", "5", "", "dir", "d.txt", "c.txt", "b.txt", "a.log")
+	checkListing(t, "?sort=size&glob=*.txt", "3", "", "c.txt", "b.txt", "d.txt")
+	checkListing(t, "?sort=modTime&order=desc&name=^[a-c]", "3", "", "b.txt", "a.log", "c.txt")
+	checkListing(t, "?hidden=false&offset=1&limit=2", "5", "more", "b.txt", "c.txt")
+	checkListing(t, "?offset=10", "6", "")
+
+	var all []string
+	cursor := ""
+	for i := 0; i < 5; i++ {
+		qry := "?sort=size&limit=2&glob=*.*"
+		if cursor != "" {
+			qry += "&cursor=" + cursor
+		}
+		var page []string
+		tst.Htreq(t, "GET", tst.S.URL+"/listing"+qry, nil, func(rsp *http.Response) {
+			var ms []map[string]interface{}
+			err := json.NewDecoder(rsp.Body).Decode(&ms)
+			tst.ErrFatal(t, err)
+			for _, m := range ms {
+				page = append(page, m["name"].(string))
+			}
+			cursor = rsp.Header.Get(headerListCursor)
+		})
+		all = append(all, page...)
+		if cursor == "" {
+			break
+		}
+	}
+	if strings.Join(all, ",") != "c.txt,a.log,b.txt,.hidden,d.txt" {
+		t.Log(all)
+		t.Fail()
+	}
+}
+
+func TestListFormat(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initListing(t)
+	expectStatus(t, "GET", "/listing?format=xml", http.StatusBadRequest)
+
+	get := func(qry, accept string) (string, string) {
+		var ct, body string
+		r, err := http.NewRequest("GET", tst.S.URL+"/listing"+qry, nil)
+		tst.ErrFatal(t, err)
+		if accept != "" {
+			r.Header.Set(headerAccept, accept)
+		}
+		tst.Htreqr(t, r, func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatal(qry, rsp.StatusCode)
+			}
+			b, err := ioutil.ReadAll(rsp.Body)
+			tst.ErrFatal(t, err)
+			ct, body = rsp.Header.Get("Content-Type"), string(b)
+		})
+		return ct, body
+	}
+
+	for _, c := range []struct{ qry, accept, ct string }{
+		{"", "", "application/json; charset=utf-8"},
+		{"", "text/html,application/xhtml+xml,*/*;q=0.8", htmlContentType},
+		{"", "application/json;q=0.5, application/x-ndjson", ndjsonContentType},
+		{"", "text/html;q=0.1, application/json", "application/json; charset=utf-8"},
+		{"?format=json", "text/html", "application/json; charset=utf-8"},
+		{"?format=html", "", htmlContentType},
+	} {
+		if ct, _ := get(c.qry, c.accept); ct != c.ct {
+			t.Log(c.qry, c.accept, ct)
+			t.Fail()
+		}
+	}
+
+	_, body := get("?format=ndjson&hidden=false", "")
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if len(lines) != 5 {
+		t.Fatal(lines)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil || m["name"] != "a.log" {
+		t.Fail()
+	}
+
+	_, body = get("?format=html&limit=2", "")
+	for _, s := range []string{
+		"<title>Index of /listing</title>",
+		`<a href="./">../</a>`,
+		`<a href="./listing/.hidden">.hidden</a>`,
+		`<a href="./listing/a.log">a.log</a></td><td>20</td>`,
+		`<a href="?cursor=`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Log(body)
+			t.Fail()
+		}
+	}
+	if _, body = get("/?format=html", ""); !strings.Contains(body, `<a href="./dir/">dir/</a>`) ||
+		!strings.Contains(body, `<a href="../">../</a>`) {
+		t.Log(body)
+		t.Fail()
+	}
+}
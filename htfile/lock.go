@@ -0,0 +1,444 @@
+package htfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	locksDir           = "locks"
+	lockMutexFile      = ".mutex"
+	lockInfoExt        = ".json"
+	lockScopeKey       = "scope"
+	lockTokenScheme    = "opaquelocktoken:"
+	scopeExclusive     = "exclusive"
+	scopeShared        = "shared"
+	depthZero          = "0"
+	depthInfinity      = "infinity"
+	defaultLockTimeout = 60 * 10
+	maxLockTimeout     = 60 * 60 * 24
+)
+
+// the locks are stored in the cachedir, shared by the processes of all users. The lock directory is sticky,
+// so only the owners can remove the locks.
+type lock struct {
+	Token   string `json:"token"`
+	Path    string `json:"path"`
+	Owner   string `json:"owner"`
+	Scope   string `json:"scope"`
+	Depth   string `json:"depth"`
+	Timeout int    `json:"timeout"`
+	Expires int64  `json:"expires"`
+}
+
+var (
+	headerLockToken = http.CanonicalHeaderKey("lock-token")
+	headerTimeout   = http.CanonicalHeaderKey("timeout")
+	headerDepth     = http.CanonicalHeaderKey("depth")
+	headerIf        = http.CanonicalHeaderKey("if")
+	lockTokenExp    = regexp.MustCompile("<(" + lockTokenScheme + "[0-9a-f-]+)>")
+	invalidLock     = errors.New("Invalid lock.")
+	resourceLocked  = errors.New("Resource locked.")
+	lockNotFound    = errors.New("Lock not found.")
+)
+
+func lockToken(id string) string {
+	return fmt.Sprintf("%s%s-%s-%s-%s-%s", lockTokenScheme, id[:8], id[8:12], id[12:16], id[16:20], id[20:])
+}
+
+func lockId(token string) (string, bool) {
+	if !strings.HasPrefix(token, lockTokenScheme) {
+		return "", false
+	}
+	id := strings.Replace(token[len(lockTokenScheme):], "-", "", -1)
+	return id, idExp.MatchString(id)
+}
+
+// a simplified parsing of the If header, only collecting the lock tokens
+func parseIfTokens(h string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, m := range lockTokenExp.FindAllStringSubmatch(h, -1) {
+		tokens[m[1]] = true
+	}
+	return tokens
+}
+
+// parses the Timeout header, e.g. Second-3600 or Infinite, taking the first valid value
+func parseTimeout(h string) int {
+	for _, v := range strings.Split(h, ",") {
+		v = strings.TrimSpace(v)
+		if v == "Infinite" {
+			return maxLockTimeout
+		}
+		if !strings.HasPrefix(v, "Second-") {
+			continue
+		}
+		s, err := strconv.Atoi(v[len("Second-"):])
+		if err != nil || s <= 0 {
+			continue
+		}
+		if s > maxLockTimeout {
+			return maxLockTimeout
+		}
+		return s
+	}
+	return defaultLockTimeout
+}
+
+func (l *lock) covers(p string) bool {
+	return l.Path == p || l.Depth == depthInfinity && isUnder(l.Path, p)
+}
+
+func (l *lock) conflicts(ol *lock) bool {
+	return (l.Scope == scopeExclusive || ol.Scope == scopeExclusive) && (l.covers(ol.Path) || ol.covers(l.Path))
+}
+
+func (h *handler) lockDir() string {
+	return path.Join(h.cachedir, locksDir)
+}
+
+func (h *handler) ensureLockDir() error {
+	return h.ensureSharedDir(h.lockDir())
+}
+
+// creates a directory in the cachedir, shared by the processes of all users
+func (h *handler) ensureSharedDir(dir string) error {
+	err := share.EnsureDir(h.cachedir)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dir, os.ModePerm)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, os.ModePerm|os.ModeSticky)
+}
+
+// runs a function while holding an exclusive lock on the lock directory, shared by all processes
+func (h *handler) withLockDir(f func() error) error {
+	err := h.ensureLockDir()
+	if err != nil {
+		return err
+	}
+	mp := path.Join(h.lockDir(), lockMutexFile)
+	m, err := os.OpenFile(mp, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(m.Close)
+
+	// best effort, only the creator can change the mode
+	m.Chmod(0666)
+
+	err = syscall.Flock(int(m.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	return f()
+}
+
+func readLock(p string) (*lock, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	l := new(lock)
+	err = json.Unmarshal(b, l)
+	return l, err
+}
+
+func writeLock(dir, id string, l *lock) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	f, err := createTemp(path.Join(dir, id+lockInfoExt), 0644)
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(f.Close)
+	err = f.Chmod(0644)
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path.Join(dir, id+lockInfoExt))
+	}
+	if err != nil {
+		share.Doretlog42(func() error { return os.Remove(f.Name()) })
+	}
+	return err
+}
+
+// returns the active locks. The expired ones are removed, when the process has the permission.
+func (h *handler) readLocks() ([]*lock, error) {
+	d, err := os.Open(h.lockDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fis, err := d.Readdir(0)
+	share.Doretlog42(d.Close)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	var locks []*lock
+	for _, fi := range fis {
+		n := fi.Name()
+		if !strings.HasSuffix(n, lockInfoExt) || !idExp.MatchString(strings.TrimSuffix(n, lockInfoExt)) {
+			continue
+		}
+		lp := path.Join(h.lockDir(), n)
+		l, err := readLock(lp)
+		if err != nil {
+			continue
+		}
+		if l.Expires < now {
+			os.Remove(lp)
+			continue
+		}
+		locks = append(locks, l)
+	}
+	return locks, nil
+}
+
+func currentUsername() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+// returns the affected paths, relative to the root, and whether the operation affects the subtree
+func lockedPaths(r *http.Request, qry url.Values) ([]string, bool) {
+	cmd := r.Method
+	if r.Method == "POST" {
+		cmd = ""
+		if cmds := qry[share.HttpCmdKey]; len(cmds) == 1 {
+			cmd = cmds[0]
+		}
+	}
+	if _, ok := qry[uploadKey]; ok && cmd == "DELETE" {
+		return nil, false
+	}
+	var ps []string
+	switch cmd {
+	case "GET", "HEAD", "OPTIONS", "SEARCH", "PROPS", "LOCK", "UNLOCK", share.HttpCmdUpload, share.HttpCmdPurge:
+		return nil, false
+	case "COPY", share.HttpCmdCopy:
+	default:
+		ps = append(ps, path.Clean("/"+r.URL.Path))
+	}
+	switch cmd {
+	case "COPY", "RENAME", share.HttpCmdCopy, share.HttpCmdRename:
+		for _, to := range qry[copyRenameToKey] {
+			ps = append(ps, path.Clean("/"+to))
+		}
+	}
+	return ps, cmd != "MODPROPS" && cmd != share.HttpCmdModprops
+}
+
+func (h *handler) checkLocks(w http.ResponseWriter, r *http.Request) bool {
+	if h.cachedir == "" {
+		return true
+	}
+	qry, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return true
+	}
+	ps, deep := lockedPaths(r, qry)
+	return h.checkPathLocks(w, r, ps, deep)
+}
+
+// checks that the modified paths are either not locked, or the request submits the lock tokens, and the
+// locks belong to the current user. When the operation affects a subtree, the locks in it are checked,
+// too.
+func (h *handler) checkPathLocks(w http.ResponseWriter, r *http.Request, ps []string, deep bool) bool {
+	if h.cachedir == "" || len(ps) == 0 {
+		return true
+	}
+	locks, err := h.readLocks()
+	if !share.CheckServerError(w, err == nil) {
+		return false
+	}
+	if len(locks) == 0 {
+		return true
+	}
+	un, err := currentUsername()
+	if !share.CheckServerError(w, err == nil) {
+		return false
+	}
+	tokens := parseIfTokens(r.Header.Get(headerIf))
+	for _, p := range ps {
+		// from the locks on the same path, one is enough to be submitted
+		submitted := make(map[string]bool)
+		for _, l := range locks {
+			if l.covers(p) || deep && isUnder(p, l.Path) {
+				submitted[l.Path] = submitted[l.Path] || tokens[l.Token] && l.Owner == un
+			}
+		}
+		for _, s := range submitted {
+			if !share.CheckHandle(w, s, http.StatusLocked) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (h *handler) createLock(nl *lock) error {
+	locks, err := h.readLocks()
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		if nl.conflicts(l) {
+			return resourceLocked
+		}
+	}
+	id, err := newId()
+	if err != nil {
+		return err
+	}
+	nl.Token = lockToken(id)
+	return writeLock(h.lockDir(), id, nl)
+}
+
+func (h *handler) refreshLock(tokens map[string]bool, p, un string, timeout int) (*lock, error) {
+	for t := range tokens {
+		id, ok := lockId(t)
+		if !ok {
+			continue
+		}
+		l, err := readLock(path.Join(h.lockDir(), id+lockInfoExt))
+		if err != nil || l.Expires < time.Now().Unix() || l.Owner != un || !l.covers(p) {
+			continue
+		}
+		l.Timeout = timeout
+		l.Expires = time.Now().Unix() + int64(timeout)
+		return l, writeLock(h.lockDir(), id, l)
+	}
+	return nil, lockNotFound
+}
+
+// creates or, when a lock token is submitted in the If header, refreshes a lock
+func (h *handler) acquireLock(w http.ResponseWriter, r *http.Request, scope string) (*lock, bool) {
+	depth := strings.ToLower(r.Header.Get(headerDepth))
+	if depth == "" {
+		depth = depthInfinity
+	}
+	if !share.CheckBadReq(w, depth == depthZero || depth == depthInfinity) {
+		return nil, false
+	}
+	un, err := currentUsername()
+	if !share.CheckServerError(w, err == nil) {
+		return nil, false
+	}
+	timeout := parseTimeout(r.Header.Get(headerTimeout))
+	p := path.Clean("/" + r.URL.Path)
+	tokens := parseIfTokens(r.Header.Get(headerIf))
+
+	var l *lock
+	err = h.withLockDir(func() error {
+		if len(tokens) > 0 {
+			var err error
+			l, err = h.refreshLock(tokens, p, un, timeout)
+			return err
+		}
+		l = &lock{
+			Path:    p,
+			Owner:   un,
+			Scope:   scope,
+			Depth:   depth,
+			Timeout: timeout,
+			Expires: time.Now().Unix() + int64(timeout)}
+		return h.createLock(l)
+	})
+	if !share.CheckHandle(w, err != resourceLocked, http.StatusLocked) ||
+		!share.CheckHandle(w, err != lockNotFound, http.StatusPreconditionFailed) ||
+		!share.CheckOsError(w, err) {
+		return nil, false
+	}
+	header := w.Header()
+	header.Set(headerLockToken, "<"+l.Token+">")
+	header.Set(headerTimeout, "Second-"+strconv.Itoa(l.Timeout))
+	return l, true
+}
+
+func (h *handler) lockf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	if !share.CheckHandle(w, h.cachedir != "", http.StatusMethodNotAllowed) {
+		return
+	}
+	_, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	scope := scopeExclusive
+	if scopes, ok := qry[lockScopeKey]; ok {
+		if !share.CheckBadReq(w, len(scopes) == 1 && (scopes[0] == scopeExclusive || scopes[0] == scopeShared)) {
+			return
+		}
+		scope = scopes[0]
+	}
+	l, ok := h.acquireLock(w, r, scope)
+	if !ok {
+		return
+	}
+	_, err = share.WriteJsonResponse(w, r, l)
+	share.CheckServerError(w, err != share.MarshalError)
+}
+
+func (h *handler) unlockf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	if !share.CheckHandle(w, h.cachedir != "", http.StatusMethodNotAllowed) {
+		return
+	}
+	_, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	m := lockTokenExp.FindStringSubmatch(r.Header.Get(headerLockToken))
+	if !share.CheckBadReq(w, len(m) == 2) {
+		return
+	}
+	id, ok := lockId(m[1])
+	if !share.CheckBadReq(w, ok) {
+		return
+	}
+	un, err := currentUsername()
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	p := path.Clean("/" + r.URL.Path)
+	err = h.withLockDir(func() error {
+		lp := path.Join(h.lockDir(), id+lockInfoExt)
+		l, err := readLock(lp)
+		if err != nil || l.Expires < time.Now().Unix() || l.Owner != un || !l.covers(p) {
+			return invalidLock
+		}
+		return os.Remove(lp)
+	})
+	if !share.CheckHandle(w, err != invalidLock, http.StatusConflict) || !share.CheckOsError(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
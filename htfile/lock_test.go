@@ -0,0 +1,188 @@
+package htfile
+
+import (
+	"bytes"
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func initLocks(t *testing.T) string {
+	return initTestDir(t, "locks", map[string]string{"file": "content", "sub/file": "content"}, locksDir)
+}
+
+func lockReq(t *testing.T, method, url string, header map[string]string, body []byte) *http.Response {
+	r, err := http.NewRequest(method, tst.S.URL+url, bytes.NewBuffer(body))
+	tst.ErrFatal(t, err)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	var rsp *http.Response
+	tst.Htreqr(t, r, func(r *http.Response) { rsp = r })
+	return rsp
+}
+
+func ifToken(token string) map[string]string {
+	if token == "" {
+		return nil
+	}
+	return map[string]string{"If": "(<" + token + ">)"}
+}
+
+func createLock(t *testing.T, url string, header map[string]string) *lock {
+	r, err := http.NewRequest("LOCK", tst.S.URL+url, nil)
+	tst.ErrFatal(t, err)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	l := new(lock)
+	tst.Htreqr(t, r, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		err := json.NewDecoder(rsp.Body).Decode(l)
+		tst.ErrFatal(t, err)
+		if rsp.Header.Get("Lock-Token") != "<"+l.Token+">" {
+			t.Fail()
+		}
+	})
+	return l
+}
+
+func TestLockDisabled(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initLocks(t)
+	expectStatus(t, "LOCK", "/locks/file", http.StatusMethodNotAllowed)
+	expectStatus(t, "UNLOCK", "/locks/file", http.StatusMethodNotAllowed)
+}
+
+func TestLock(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initLocks(t)
+	expectStatus(t, "LOCK", "/locks/file?scope=invalid", http.StatusBadRequest)
+	rsp := lockReq(t, "LOCK", "/locks/file", map[string]string{"Depth": "1"}, nil)
+	if rsp.StatusCode != http.StatusBadRequest {
+		t.Fail()
+	}
+
+	l := createLock(t, "/locks/file", map[string]string{"Timeout": "Second-60"})
+	if _, ok := lockId(l.Token); !ok || l.Path != "/locks/file" || l.Scope != scopeExclusive ||
+		l.Depth != depthInfinity || l.Timeout != 60 || l.Expires > time.Now().Unix()+60 {
+		t.Fail()
+	}
+	fi, err := os.Lstat(path.Join(cachedir, locksDir))
+	if err != nil || fi.Mode()&os.ModeSticky == 0 {
+		t.Fail()
+	}
+
+	// conflicting
+	expectStatus(t, "LOCK", "/locks/file", http.StatusLocked)
+	expectStatus(t, "LOCK", "/locks/file?scope=shared", http.StatusLocked)
+
+	// refresh
+	rsp = lockReq(t, "LOCK", "/locks/file", map[string]string{
+		"If":      "(<" + l.Token + ">)",
+		"Timeout": "Infinite, Second-30"}, nil)
+	if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Timeout") != "Second-86400" {
+		t.Fail()
+	}
+	rsp = lockReq(t, "LOCK", "/locks/file", map[string]string{
+		"If": "(<opaquelocktoken:01234567-89ab-cdef-0123-456789abcdef>)"}, nil)
+	if rsp.StatusCode != http.StatusPreconditionFailed {
+		t.Fail()
+	}
+
+	// shared
+	createLock(t, "/locks/sub/file?scope=shared", nil)
+	createLock(t, "/locks/sub/file?scope=shared", nil)
+	expectStatus(t, "LOCK", "/locks/sub/file", http.StatusLocked)
+
+	// depth
+	expectStatus(t, "LOCK", "/locks", http.StatusLocked)
+	createLock(t, "/locks", map[string]string{"Depth": "0"})
+}
+
+func TestLockEnforced(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initLocks(t)
+	l := createLock(t, "/locks/file", nil)
+
+	// reading is allowed
+	expectStatus(t, "GET", "/locks/file", http.StatusOK)
+	expectStatus(t, "PROPS", "/locks/file", http.StatusOK)
+
+	expectHeaderStatus(t, "PUT", "/locks/file", nil, http.StatusLocked)
+	expectHeaderStatus(t, "MODPROPS", "/locks/file", nil, http.StatusLocked)
+	expectHeaderStatus(t, "POST", "/locks/file?cmd=delete", nil, http.StatusLocked)
+	expectHeaderStatus(t, "RENAME", "/locks/file?to=/locks/other", nil, http.StatusLocked)
+	expectHeaderStatus(t, "RENAME", "/locks/sub/file?to=/locks/file", nil, http.StatusLocked)
+	expectHeaderStatus(t, "COPY", "/locks/sub/file?to=/locks/file", nil, http.StatusLocked)
+	expectHeaderStatus(t, "DELETE", "/locks", nil, http.StatusLocked)
+	checkFileContent(t, path.Join(dir, "file"), "content")
+
+	// copying from is allowed
+	expectHeaderStatus(t, "COPY", "/locks/file?to=/locks/copy", nil, http.StatusOK)
+
+	// with the token
+	expectHeaderStatus(t, "PUT", "/locks/file", ifToken(l.Token), http.StatusOK)
+	expectHeaderStatus(t, "COPY", "/locks/sub/file?to=/locks/file", ifToken(l.Token), http.StatusOK)
+
+	// locking a directory with depth
+	dl := createLock(t, "/locks/sub", nil)
+	expectHeaderStatus(t, "PUT", "/locks/sub/new", nil, http.StatusLocked)
+	expectHeaderStatus(t, "MKDIR", "/locks/sub/dir", nil, http.StatusLocked)
+	expectHeaderStatus(t, "PUT", "/locks/sub/new", ifToken(dl.Token), http.StatusOK)
+	expectHeaderStatus(t, "DELETE", "/locks", ifToken(dl.Token), http.StatusLocked)
+	rsp := lockReq(t, "DELETE", "/locks", map[string]string{
+		"If": "(<" + dl.Token + ">) (<" + l.Token + ">)"}, nil)
+	if rsp.StatusCode != http.StatusOK {
+		t.Fail()
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initLocks(t)
+	l := createLock(t, "/locks/sub", nil)
+	expectStatus(t, "UNLOCK", "/locks/sub", http.StatusBadRequest)
+	expectHeaderStatus(t, "UNLOCK", "/locks/sub", nil, http.StatusBadRequest)
+	rsp := lockReq(t, "UNLOCK", "/locks/file", map[string]string{"Lock-Token": "<" + l.Token + ">"}, nil)
+	if rsp.StatusCode != http.StatusConflict {
+		t.Fail()
+	}
+	rsp = lockReq(t, "UNLOCK", "/locks/sub/file", map[string]string{"Lock-Token": "<" + l.Token + ">"}, nil)
+	if rsp.StatusCode != http.StatusNoContent {
+		t.Fail()
+	}
+	expectHeaderStatus(t, "PUT", "/locks/sub/file", nil, http.StatusOK)
+	rsp = lockReq(t, "UNLOCK", "/locks/sub", map[string]string{"Lock-Token": "<" + l.Token + ">"}, nil)
+	if rsp.StatusCode != http.StatusConflict {
+		t.Fail()
+	}
+}
+
+func TestLockExpired(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initLocks(t)
+	l := createLock(t, "/locks/file", nil)
+	id, _ := lockId(l.Token)
+	l.Expires = time.Now().Add(-time.Minute).Unix()
+	b, err := json.Marshal(l)
+	tst.ErrFatal(t, err)
+	err = ioutil.WriteFile(path.Join(cachedir, locksDir, id+lockInfoExt), b, 0644)
+	tst.ErrFatal(t, err)
+	expectHeaderStatus(t, "PUT", "/locks/file", nil, http.StatusOK)
+	if _, err := os.Lstat(path.Join(cachedir, locksDir, id+lockInfoExt)); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
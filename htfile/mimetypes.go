@@ -0,0 +1,145 @@
+package htfile
+
+import (
+	"errors"
+	"github.com/aryszka/tasked/keyval"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	mimeDefaultCharsetKey = "default-charset"
+	mimeTextFlag          = "text"
+	mimeCharsetParam      = "charset"
+)
+
+var invalidMimeTypes = errors.New("Invalid mime types.")
+
+// the configured media types by the file extensions, and the media types treated as text, e.g. for
+// searching by content. The mapping file contains entries like:
+//
+//	md = text/markdown; charset=utf-8; text
+//	log = text/plain; text
+//	default-charset = utf-8
+//
+// where the default charset is set for the text types without an explicit charset.
+type mimeTypes struct {
+	byExt map[string]string
+	text  map[string]bool
+}
+
+// parses a mapping entry to the content type, and whether it is text
+func parseMimeType(v string) (string, bool, error) {
+	parts := strings.Split(v, ";")
+	mt := strings.ToLower(strings.TrimSpace(parts[0]))
+	if _, _, err := mime.ParseMediaType(mt); err != nil || !strings.Contains(mt, "/") {
+		return "", false, invalidMimeTypes
+	}
+	params := make(map[string]string)
+	var text bool
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if p == mimeTextFlag {
+			text = true
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return "", false, invalidMimeTypes
+		}
+		params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	ct := mime.FormatMediaType(mt, params)
+	if ct == "" {
+		return "", false, invalidMimeTypes
+	}
+	return ct, text, nil
+}
+
+func parseMimeTypes(entries []*keyval.Entry) (*mimeTypes, error) {
+	mts := &mimeTypes{byExt: make(map[string]string), text: make(map[string]bool)}
+	var charset string
+	for _, e := range entries {
+		if e.Key == mimeDefaultCharsetKey {
+			charset = e.Val
+			continue
+		}
+		ext := strings.ToLower(e.Key)
+		if ext == "" {
+			return nil, invalidMimeTypes
+		}
+		if ext[0] != '.' {
+			ext = "." + ext
+		}
+		ct, text, err := parseMimeType(e.Val)
+		if err != nil {
+			return nil, err
+		}
+		mts.byExt[ext] = ct
+		if text {
+			mt, _, _ := mime.ParseMediaType(ct)
+			mts.text[mt] = true
+		}
+	}
+	if charset == "" {
+		return mts, nil
+	}
+	for ext, ct := range mts.byExt {
+		mt, params, _ := mime.ParseMediaType(ct)
+		if _, ok := params[mimeCharsetParam]; ok || !mts.text[mt] && !strings.HasPrefix(mt, "text/") {
+			continue
+		}
+		params[mimeCharsetParam] = charset
+		mts.byExt[ext] = mime.FormatMediaType(mt, params)
+	}
+	return mts, nil
+}
+
+// reads the mapping file. Without a file, the mapping is empty, but a configured file needs to exist.
+func readMimeTypes(fn string) (*mimeTypes, error) {
+	if fn == "" {
+		return &mimeTypes{}, nil
+	}
+
+	// keyval takes a missing file as empty
+	if _, err := os.Stat(fn); err != nil {
+		return nil, err
+	}
+	entries, err := keyval.ParseFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return parseMimeTypes(entries)
+}
+
+// CheckMimeTypes reads the mapping file, so that a missing or invalid file can be reported at startup.
+func CheckMimeTypes(fn string) error {
+	_, err := readMimeTypes(fn)
+	return err
+}
+
+func (mts *mimeTypes) isText(ct string) bool {
+	if mts == nil {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	return err == nil && mts.text[mt]
+}
+
+func (mts *mimeTypes) byName(name string) (string, bool) {
+	if mts == nil {
+		return "", false
+	}
+	ct, ok := mts.byExt[strings.ToLower(filepath.Ext(name))]
+	return ct, ok
+}
+
+// the configured mapping takes precedence over the system types and the detection by the content
+func (h *handler) contentType(name string, f *os.File) (string, error) {
+	if ct, ok := h.mimeTypes.byName(name); ok {
+		return ct, nil
+	}
+	return detectContentType(name, f)
+}
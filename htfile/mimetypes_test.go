@@ -0,0 +1,101 @@
+package htfile
+
+import (
+	"github.com/aryszka/tasked/keyval"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseMimeTypes(t *testing.T) {
+	for _, v := range []string{"", "markdown", "text/markdown; charset", "text/markdown; =utf-8"} {
+		if _, err := parseMimeTypes([]*keyval.Entry{&keyval.Entry{Key: "md", Val: v}}); err == nil {
+			t.Log(v)
+			t.Fail()
+		}
+	}
+	if _, err := parseMimeTypes([]*keyval.Entry{&keyval.Entry{Key: "", Val: "text/plain"}}); err == nil {
+		t.Fail()
+	}
+
+	mts, err := parseMimeTypes([]*keyval.Entry{
+		&keyval.Entry{Key: "md", Val: "Text/Markdown; text"},
+		&keyval.Entry{Key: ".LOG", Val: "text/plain; charset=us-ascii"},
+		&keyval.Entry{Key: "cfg", Val: "application/x-config; text"},
+		&keyval.Entry{Key: "bin", Val: "application/octet-stream"},
+		&keyval.Entry{Key: mimeDefaultCharsetKey, Val: "utf-8"}})
+	tst.ErrFatal(t, err)
+	for name, expect := range map[string]string{
+		"README.md":  "text/markdown; charset=utf-8",
+		"server.log": "text/plain; charset=us-ascii",
+		"app.cfg":    "application/x-config; charset=utf-8",
+		"data.bin":   "application/octet-stream"} {
+		if ct, ok := mts.byName(name); !ok || ct != expect {
+			t.Log(name, ct)
+			t.Fail()
+		}
+	}
+	if _, ok := mts.byName("other.txt"); ok {
+		t.Fail()
+	}
+	if !mts.isText("text/markdown") || !mts.isText("application/x-config; charset=utf-8") ||
+		mts.isText("application/octet-stream") || mts.isText("text/plain") {
+		t.Fail()
+	}
+}
+
+func TestMimeTypes(t *testing.T) {
+	dir := path.Join(dn, "mimetypes")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	for n, c := range map[string]string{
+		"notes.md":  "some match",
+		"app.cfg":   "other match",
+		"data.bin":  "binary match",
+		"plain.txt": "plain match"} {
+		err := ioutil.WriteFile(path.Join(dir, n), []byte(c), os.ModePerm)
+		tst.ErrFatal(t, err)
+	}
+	fn := path.Join(tst.Testdir, "mime.types")
+	err := ioutil.WriteFile(fn, []byte(
+		"# extensions\n"+
+			"md = text/markdown; text\n"+
+			"cfg = application/x-config; text\n"+
+			"bin = application/x-tasked-binary\n"+
+			"default-charset = utf-8\n"), os.ModePerm)
+	tst.ErrFatal(t, err)
+	if CheckMimeTypes(fn) != nil || CheckMimeTypes(path.Join(tst.Testdir, "no-such-file")) == nil {
+		t.Fail()
+	}
+
+	ht := New(&testOptions{root: dn, maxSearchResults: 30, mimeTypes: fn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	for n, ct := range map[string]string{
+		"notes.md": "text/markdown; charset=utf-8",
+		"app.cfg":  "application/x-config; charset=utf-8",
+		"data.bin": "application/x-tasked-binary"} {
+		tst.Htreq(t, "GET", tst.S.URL+"/mimetypes/"+n, nil, func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Content-Type") != ct {
+				t.Log(n, rsp.Header.Get("Content-Type"))
+				t.Fail()
+			}
+		})
+	}
+	result := grepSearchIn(t, "/mimetypes", "?content=match")
+	if len(result) != 3 || result["notes.md"] == nil || result["app.cfg"] == nil || result["plain.txt"] == nil {
+		t.Log(result)
+		t.Fail()
+	}
+
+	// invalid mapping files are ignored
+	ht = New(&testOptions{root: dn, maxSearchResults: 30, mimeTypes: path.Join(tst.Testdir, "no-such-file")})
+	tst.Thnd.Sh = ht.ServeHTTP
+	tst.Htreq(t, "GET", tst.S.URL+"/mimetypes/data.bin", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Content-Type") == "application/x-tasked-binary" {
+			t.Fail()
+		}
+	})
+}
@@ -0,0 +1,444 @@
+package htfile
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/aryszka/tasked/share"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	searchQueryMinSize    = "minSize"
+	searchQueryMaxSize    = "maxSize"
+	searchQueryMinModTime = "minModTime"
+	searchQueryMaxModTime = "maxModTime"
+	searchQueryType       = "type"
+	searchQueryOwner      = "owner"
+	searchQueryMaxDepth   = "maxDepth"
+	searchQueryGlob       = "glob"
+	searchQueryExclude    = "exclude"
+	searchQueryCursor     = "cursor"
+
+	searchTypeFile = "file"
+	searchTypeDir  = "dir"
+	searchTypeLink = "link"
+
+	ndjsonContentType = "application/x-ndjson"
+)
+
+var (
+	headerAccept       = http.CanonicalHeaderKey("accept")
+	headerSearchCursor = http.CanonicalHeaderKey("x-search-cursor")
+)
+
+// the filters of a search, besides the name and the content expressions. The zero values mean no
+// filtering.
+type searchFilter struct {
+	root       string
+	minSize    int64
+	maxSize    int64
+	minModTime time.Time
+	maxModTime time.Time
+	types      []string
+	uid        *uint32
+	maxDepth   int
+	globs      []string
+	excludes   []string
+}
+
+// accepts unix seconds, RFC3339 times, or durations meaning the time before now, e.g. 24h
+func parseSearchTime(s string, now time.Time) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, invalidQueryString
+	}
+	return t, nil
+}
+
+func getQrySearchTime(qry url.Values, key string, now time.Time) (time.Time, error) {
+	vs, ok := qry[key]
+	if !ok {
+		return time.Time{}, nil
+	}
+	if len(vs) != 1 {
+		return time.Time{}, invalidQueryString
+	}
+	return parseSearchTime(vs[0], now)
+}
+
+func getQryGlobs(qry url.Values, key string) ([]string, error) {
+	globs := qry[key]
+	for _, g := range globs {
+		if g == "" {
+			return nil, invalidQueryString
+		}
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, err
+		}
+	}
+	return globs, nil
+}
+
+func getQrySearchFilter(qry url.Values, root string) (*searchFilter, error) {
+	f := &searchFilter{root: root}
+	var (
+		err error
+		set bool
+	)
+	if f.minSize, set, err = getQryNum64(qry, searchQueryMinSize); err != nil || f.minSize < 0 {
+		return nil, invalidQueryString
+	}
+	if f.maxSize, set, err = getQryNum64(qry, searchQueryMaxSize); err != nil || set && f.maxSize < 0 {
+		return nil, invalidQueryString
+	}
+	if !set {
+		f.maxSize = -1
+	}
+	now := time.Now()
+	if f.minModTime, err = getQrySearchTime(qry, searchQueryMinModTime, now); err != nil {
+		return nil, err
+	}
+	if f.maxModTime, err = getQrySearchTime(qry, searchQueryMaxModTime, now); err != nil {
+		return nil, err
+	}
+	for _, t := range qry[searchQueryType] {
+		switch t {
+		case searchTypeFile, searchTypeDir, searchTypeLink:
+			f.types = append(f.types, t)
+		default:
+			return nil, invalidQueryString
+		}
+	}
+	if owners, ok := qry[searchQueryOwner]; ok {
+		if len(owners) != 1 {
+			return nil, invalidQueryString
+		}
+		u, err := user.Lookup(owners[0])
+		if err != nil {
+			return nil, invalidQueryString
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		uuid := uint32(uid)
+		f.uid = &uuid
+	}
+	if f.maxDepth, err = getQryNum(qry, searchQueryMaxDepth); err != nil || f.maxDepth < 0 {
+		return nil, invalidQueryString
+	}
+	if f.globs, err = getQryGlobs(qry, searchQueryGlob); err != nil {
+		return nil, invalidQueryString
+	}
+	if f.excludes, err = getQryGlobs(qry, searchQueryExclude); err != nil {
+		return nil, invalidQueryString
+	}
+	return f, nil
+}
+
+// the path relative to the root of the search
+func (f *searchFilter) relPath(fi *fileInfo) string {
+	rel, err := filepath.Rel(f.root, path.Join(fi.dirname, fi.Name()))
+	if err != nil {
+		return fi.Name()
+	}
+	return rel
+}
+
+// patterns containing a slash are matched against the path relative to the root of the search, the
+// others against the name
+func matchGlobs(globs []string, name, rel string) bool {
+	for _, g := range globs {
+		n := name
+		if strings.Contains(g, "/") {
+			n = rel
+		}
+		if m, _ := path.Match(g, n); m {
+			return true
+		}
+	}
+	return false
+}
+
+func depth(rel string) int {
+	return strings.Count(rel, "/") + 1
+}
+
+func fileType(fi os.FileInfo) string {
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		return searchTypeLink
+	case fi.IsDir():
+		return searchTypeDir
+	default:
+		return searchTypeFile
+	}
+}
+
+func (f *searchFilter) match(fi *fileInfo) bool {
+	if fi.Size() < f.minSize || f.maxSize >= 0 && fi.Size() > f.maxSize {
+		return false
+	}
+	if !f.minModTime.IsZero() && fi.ModTime().Before(f.minModTime) ||
+		!f.maxModTime.IsZero() && fi.ModTime().After(f.maxModTime) {
+		return false
+	}
+	if len(f.types) > 0 {
+		t := fileType(fi)
+		found := false
+		for _, ft := range f.types {
+			if ft == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.uid != nil {
+		sstat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || sstat.Uid != *f.uid {
+			return false
+		}
+	}
+	rel := f.relPath(fi)
+	if f.maxDepth > 0 && depth(rel) > f.maxDepth {
+		return false
+	}
+	if len(f.globs) > 0 && !matchGlobs(f.globs, fi.Name(), rel) {
+		return false
+	}
+	return !matchGlobs(f.excludes, fi.Name(), rel)
+}
+
+// excluded directories and directories at the maximum depth are not searched
+func (f *searchFilter) descend(fi *fileInfo) bool {
+	rel := f.relPath(fi)
+	if f.maxDepth > 0 && depth(rel) >= f.maxDepth {
+		return false
+	}
+	return !matchGlobs(f.excludes, fi.Name(), rel)
+}
+
+// tells whether a relative path would be reached by the walk, i.e. none of its parent directories is
+// excluded
+func (f *searchFilter) within(rel string) bool {
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if matchGlobs(f.excludes, path.Base(dir), dir) {
+			return false
+		}
+	}
+	return true
+}
+
+func readDirSorted(p string) ([]os.FileInfo, error) {
+	d, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer share.Doretlog42(d.Close)
+	fis, err := d.Readdir(0)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byName(fis))
+	return fis, nil
+}
+
+func canceled(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// walks the directories breadth first, in the order of the names, calling visit for every entry. Stops
+// when visit returns false, or when done is closed. Only the directories accepted by descend are walked,
+// when descend is not nil.
+func walkTree(dirs []*fileInfo, visit, descend func(fi *fileInfo) bool, done <-chan struct{}) {
+	for len(dirs) > 0 {
+		di := dirs[0]
+		dirs = dirs[1:]
+		p := path.Join(di.dirname, di.Name())
+		fis, err := readDirSorted(p)
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			if canceled(done) {
+				return
+			}
+			fii := &fileInfo{sys: withLink(path.Join(p, fi.Name()), fi), dirname: p}
+			if !visit(fii) {
+				return
+			}
+			if fii.IsDir() && (descend == nil || descend(fii)) {
+				dirs = append(dirs, fii)
+			}
+		}
+	}
+}
+
+// the cursor is the encoded relative path of the last returned entry. Since the walk order is stable, a
+// search can be continued after it.
+func getQryCursor(qry url.Values) (string, error) {
+	cs, ok := qry[searchQueryCursor]
+	if !ok {
+		return "", nil
+	}
+	if len(cs) != 1 {
+		return "", invalidQueryString
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cs[0])
+	if err != nil || len(b) == 0 {
+		return "", invalidQueryString
+	}
+	return string(b), nil
+}
+
+// tells whether a relative path comes after the cursor in the walk order: first by depth, then by the
+// path elements
+func afterCursor(rel, cursor string) bool {
+	if cursor == "" {
+		return true
+	}
+	return namesAfter(strings.Split(rel, "/"), strings.Split(cursor, "/"))
+}
+
+// tells whether a path, split into its names, comes after another one in the walk order
+func namesAfter(rs, cs []string) bool {
+	if len(rs) != len(cs) {
+		return len(rs) > len(cs)
+	}
+	for i := range rs {
+		if rs[i] != cs[i] {
+			return rs[i] > cs[i]
+		}
+	}
+	return false
+}
+
+// a page of search results. When indexed, only the candidates are checked, instead of walking the roots.
+// The candidates are relative to the root of the search, in the walk order.
+type searchPage struct {
+	roots      []*fileInfo
+	filter     *searchFilter
+	after      string
+	max        int
+	match      func(*fileInfo) (bool, []*contentMatch)
+	done       <-chan struct{}
+	indexed    bool
+	candidates []string
+}
+
+func (sp *searchPage) walkCandidates(visit func(*fileInfo) bool) {
+	for _, rel := range sp.candidates {
+		if canceled(sp.done) {
+			return
+		}
+		if !afterCursor(rel, sp.after) || !sp.filter.within(rel) {
+			continue
+		}
+		p := path.Join(sp.filter.root, rel)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			continue
+		}
+		if !visit(&fileInfo{sys: withLink(p, fi), dirname: path.Dir(p)}) {
+			return
+		}
+	}
+}
+
+// calls emit for the matching entries after the cursor, at most max times, or until emit returns false.
+// When there are more results, returns the cursor for the next page.
+func (sp *searchPage) walk(emit func(*fileInfo, []*contentMatch) bool) string {
+	var (
+		n    int
+		last string
+		next string
+	)
+	visit := func(fi *fileInfo) bool {
+		rel := sp.filter.relPath(fi)
+		if !afterCursor(rel, sp.after) {
+			return true
+		}
+		ok, matches := sp.match(fi)
+		if !ok {
+			return true
+		}
+		if n == sp.max {
+			next = base64.RawURLEncoding.EncodeToString([]byte(last))
+			return false
+		}
+		n++
+		last = rel
+		return emit(fi, matches)
+	}
+	if sp.indexed {
+		sp.walkCandidates(visit)
+	} else {
+		walkTree(sp.roots, visit, sp.filter.descend, sp.done)
+	}
+	return next
+}
+
+func (h *handler) searchProps(fi *fileInfo, matches []*contentMatch) map[string]interface{} {
+	pm := toPropertyMap(fi, false)
+	if len(matches) > 0 {
+		pm["matches"] = matches
+	}
+	share.Dolog(func() error { return h.addMeta(pm, path.Join(fi.dirname, fi.Name()), fi) })
+	return pm
+}
+
+func acceptsNdjson(r *http.Request) bool {
+	for _, a := range strings.Split(r.Header.Get(headerAccept), ",") {
+		if strings.TrimSpace(strings.Split(a, ";")[0]) == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// writes the results as newline delimited JSON, as they are found, flushing after each. When there are
+// more results, the last line contains only the cursor.
+func (h *handler) streamSearch(w http.ResponseWriter, r *http.Request, sp *searchPage) {
+	w.Header().Set(share.HeaderContentType, ndjsonContentType)
+	if r.Method == "HEAD" {
+		return
+	}
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	next := sp.walk(func(fi *fileInfo, matches []*contentMatch) bool {
+		if enc.Encode(h.searchProps(fi, matches)) != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	})
+	if next != "" {
+		share.Dolog(func() error { return enc.Encode(map[string]string{searchQueryCursor: next}) })
+	}
+}
@@ -0,0 +1,229 @@
+package htfile
+
+import (
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func initSearch(t *testing.T) string {
+	dir := path.Join(dn, "search")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, path.Join(dir, "logs/deep/deeper"))
+	tst.EnsureDirF(t, path.Join(dir, "logs/tmp"))
+	for n, size := range map[string]int{
+		"logs/big.log":              200,
+		"logs/small.log":            10,
+		"logs/old.log":              200,
+		"logs/deep/file.log":        200,
+		"logs/deep/deeper/file.log": 200,
+		"logs/tmp/big.log":          200,
+		"logs/notes.txt":            200,
+		"readme.txt":                10} {
+		tst.WithNewFileF(t, path.Join(dir, n), func(f *os.File) error {
+			_, err := f.Write([]byte(strings.Repeat("x", size)))
+			return err
+		})
+	}
+	old := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	err := os.Chtimes(path.Join(dir, "logs/old.log"), old, old)
+	tst.ErrFatal(t, err)
+	err = os.Lchown(path.Join(dir, "readme.txt"), 1, 1)
+	tst.ErrFatal(t, err)
+	err = os.Symlink("readme.txt", path.Join(dir, "link"))
+	tst.ErrFatal(t, err)
+	return dir
+}
+
+func checkSearch(t *testing.T, qry string, expect ...string) {
+	var names []string
+	tst.Htreq(t, "SEARCH", tst.S.URL+"/search"+qry, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(qry, rsp.StatusCode)
+		}
+		var ms []map[string]interface{}
+		err := json.NewDecoder(rsp.Body).Decode(&ms)
+		tst.ErrFatal(t, err)
+		for _, m := range ms {
+			names = append(names, path.Join(m["dirname"].(string), m["name"].(string)))
+		}
+	})
+	sort.Strings(names)
+	sort.Strings(expect)
+	if len(names) != len(expect) {
+		t.Log(qry, names)
+		t.Fail()
+		return
+	}
+	for i, n := range names {
+		if n != path.Join(dn, "search", expect[i]) {
+			t.Log(qry, names)
+			t.Fail()
+			return
+		}
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxSearchResults: 30})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initSearch(t)
+
+	for _, qry := range []string{
+		"?minSize=-1",
+		"?maxSize=x",
+		"?minModTime=yesterday",
+		"?type=fifo",
+		"?owner=no-such-user",
+		"?maxDepth=-1",
+		"?glob=[",
+		"?exclude=",
+	} {
+		expectStatus(t, "SEARCH", "/search"+qry, http.StatusBadRequest)
+	}
+
+	checkSearch(t, "?minSize=100&type=file&glob=*.log",
+		"logs/big.log", "logs/old.log", "logs/deep/file.log", "logs/deep/deeper/file.log", "logs/tmp/big.log")
+	checkSearch(t, "?minSize=100&type=file&glob=*.log&minModTime=24h",
+		"logs/big.log", "logs/deep/file.log", "logs/deep/deeper/file.log", "logs/tmp/big.log")
+	checkSearch(t, "?type=file&maxModTime=2002-01-01T00:00:00Z", "logs/old.log")
+	checkSearch(t, "?type=file&maxSize=10", "logs/small.log", "readme.txt")
+	checkSearch(t, "?maxDepth=1", "logs", "readme.txt", "link")
+	checkSearch(t, "?type=dir", "logs", "logs/deep", "logs/deep/deeper", "logs/tmp")
+	checkSearch(t, "?type=link", "link")
+	checkSearch(t, "?type=file&glob=logs/*.log", "logs/big.log", "logs/small.log", "logs/old.log")
+	checkSearch(t, "?glob=*.log&exclude=tmp&exclude=deeper",
+		"logs/big.log", "logs/small.log", "logs/old.log", "logs/deep/file.log")
+	checkSearch(t, "?owner=root&type=file&glob=*.txt", "logs/notes.txt")
+}
+
+func TestSearchCursor(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxSearchResults: 30})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initSearch(t)
+	expectStatus(t, "SEARCH", "/search?cursor=not-base64!", http.StatusBadRequest)
+
+	var (
+		all    []string
+		cursor string
+		pages  int
+	)
+	for {
+		url := tst.S.URL + "/search?type=file&max=3"
+		if cursor != "" {
+			url += "&cursor=" + cursor
+		}
+		tst.Htreq(t, "SEARCH", url, nil, func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatal(rsp.StatusCode)
+			}
+			var ms []map[string]interface{}
+			err := json.NewDecoder(rsp.Body).Decode(&ms)
+			tst.ErrFatal(t, err)
+			if len(ms) > 3 {
+				t.Fail()
+			}
+			for _, m := range ms {
+				all = append(all, path.Join(m["dirname"].(string), m["name"].(string)))
+			}
+			cursor = rsp.Header.Get(headerSearchCursor)
+		})
+		pages++
+		if cursor == "" || pages > 5 {
+			break
+		}
+	}
+	if pages != 3 || len(all) != 8 {
+		t.Log(pages, all)
+		t.Fail()
+	}
+	found := make(map[string]bool)
+	for _, p := range all {
+		found[p] = true
+	}
+	if len(found) != len(all) {
+		t.Fail()
+	}
+}
+
+func TestSearchStream(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxSearchResults: 30})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initSearch(t)
+	r, err := http.NewRequest("SEARCH", tst.S.URL+"/search?type=file&max=5", nil)
+	tst.ErrFatal(t, err)
+	r.Header.Set(headerAccept, "application/json;q=0.5, application/x-ndjson")
+	tst.Htreqr(t, r, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Content-Type") != ndjsonContentType {
+			t.Fatal(rsp.StatusCode)
+		}
+		dec := json.NewDecoder(rsp.Body)
+		var lines []map[string]interface{}
+		for {
+			var m map[string]interface{}
+			err := dec.Decode(&m)
+			if err == io.EOF {
+				break
+			}
+			tst.ErrFatal(t, err)
+			lines = append(lines, m)
+		}
+		if len(lines) != 6 {
+			t.Fatal(len(lines))
+		}
+		for _, m := range lines[:5] {
+			if _, ok := m["name"]; !ok {
+				t.Fail()
+			}
+		}
+		if c, ok := lines[5]["cursor"].(string); !ok || c == "" {
+			t.Fail()
+		}
+	})
+}
+
+func TestSearchCanceled(t *testing.T) {
+	dir := initSearch(t)
+	di, err := os.Lstat(dir)
+	tst.ErrFatal(t, err)
+	done := make(chan struct{})
+	var visited int
+	walkTree([]*fileInfo{&fileInfo{sys: di, dirname: dn}}, func(fi *fileInfo) bool {
+		visited++
+		if visited == 2 {
+			close(done)
+		}
+		return true
+	}, nil, done)
+	if visited != 2 {
+		t.Fail()
+	}
+}
+
+func TestAfterCursor(t *testing.T) {
+	for _, c := range []struct {
+		rel, cursor string
+		after       bool
+	}{
+		{"a", "", true},
+		{"a", "a", false},
+		{"b", "a", true},
+		{"a", "b", false},
+		{"a/a", "b", true},
+		{"b", "a/a", false},
+		{"a/b", "b/a", false},
+		{"b/a", "a/b", true},
+	} {
+		if afterCursor(c.rel, c.cursor) != c.after {
+			t.Log(c.rel, c.cursor)
+			t.Fail()
+		}
+	}
+}
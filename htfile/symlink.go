@@ -0,0 +1,190 @@
+package htfile
+
+import (
+	"github.com/aryszka/tasked/share"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	symlinksFollow   = "follow"
+	symlinksNever    = "never"
+	symlinksPreserve = "preserve"
+	linkTargetKey    = "target"
+)
+
+// a file info carrying the target of a symlink
+type linkInfo struct {
+	os.FileInfo
+	link string
+}
+
+func withLink(p string, fi os.FileInfo) os.FileInfo {
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return fi
+	}
+	link, err := os.Readlink(p)
+	if err != nil {
+		return fi
+	}
+	return &linkInfo{fi, link}
+}
+
+// resolves the symlinks in the longest existing part of a path. Fails when the existing part ends in a
+// dangling symlink.
+func resolveExisting(p string) (string, error) {
+	var rest string
+	for {
+		rp, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return path.Join(rp, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, err := os.Lstat(p); err == nil || p == "/" || p == "." {
+			return "", invalidPath
+		}
+		rest = path.Join(path.Base(p), rest)
+		p = path.Dir(p)
+	}
+}
+
+// checks whether a resolved path is in the resolved root
+func (h *handler) withinRoot(rp string) (bool, error) {
+	root, err := filepath.EvalSymlinks(h.dn)
+	if err != nil {
+		return false, err
+	}
+	return pathIntersect(root, rp) >= leftContains, nil
+}
+
+// checks that a path is in the root after resolving the symlinks, or, when the symlinks are never
+// followed, that the path doesn't contain any. The last element is checked only when last is true.
+func (h *handler) checkPath(p string, last bool) (string, error) {
+	p = path.Join(h.dn, p)
+	if pathIntersect(h.dn, p) < leftContains {
+		return "", invalidPath
+	}
+	if p == h.dn {
+		return p, nil
+	}
+	cp := p
+	if !last {
+		cp = path.Dir(p)
+	}
+	if h.symlinks == symlinksNever {
+		for ; pathIntersect(h.dn, cp) == leftContains; cp = path.Dir(cp) {
+			fi, err := os.Lstat(cp)
+			if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				return "", invalidPath
+			}
+		}
+		return p, nil
+	}
+	rp, err := resolveExisting(cp)
+	if err != nil {
+		return "", invalidPath
+	}
+	in, err := h.withinRoot(rp)
+	if err != nil || !in {
+		return "", invalidPath
+	}
+	return p, nil
+}
+
+// checks whether a path resolves to a location in the root
+func (h *handler) resolvesWithin(p string) bool {
+	rp, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
+	}
+	in, err := h.withinRoot(rp)
+	return err == nil && in
+}
+
+// tells whether a symlink should be followed when copying
+func (h *handler) followLink(p string) bool {
+	return h.symlinks == symlinksFollow && h.resolvesWithin(p)
+}
+
+// copies according to the symlink policy. Links pointing outside of the root are copied as links.
+func (h *handler) copyTree(from, to string) error {
+	return copyAtomic(from, to, &copyOptions{follow: h.followLink})
+}
+
+// returns the file info of the target of a symlink, unless symlinks are never followed or the target is
+// outside of the root. Then it returns the info of the link itself.
+func (h *handler) statLink(p string) (os.FileInfo, error) {
+	if h.symlinks != symlinksNever && h.resolvesWithin(p) {
+		return os.Stat(p)
+	}
+	return os.Lstat(p)
+}
+
+// returns the target of a new symlink in a resolved directory, the way it is stored. Absolute targets
+// are taken relative to the root, and made relative to the directory. The target is resolved the same way
+// as the request paths, with the symlinks in its existing part followed, and it needs to be in the root.
+func (h *handler) linkTarget(dir, target string) (string, error) {
+	if path.IsAbs(target) {
+		root, err := filepath.EvalSymlinks(h.dn)
+		if err != nil {
+			return "", err
+		}
+		target, err = filepath.Rel(dir, path.Join(root, target))
+		if err != nil {
+			return "", invalidPath
+		}
+	}
+
+	// not joined, so that the parent references after the symlinks are resolved like by the system
+	rp, err := resolveExisting(dir + "/" + target)
+	if err != nil {
+		return "", invalidPath
+	}
+	in, err := h.withinRoot(rp)
+	if err != nil {
+		return "", err
+	}
+	if !in {
+		return "", invalidPath
+	}
+	return target, nil
+}
+
+// creates a symlink at the request path. Absolute targets are taken relative to the root, and stored as
+// relative links. The target needs to be in the root, but it doesn't need to exist.
+func (h *handler) symlinkf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	p, err := h.getLinkPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil && p != h.dn, http.StatusNotFound) {
+		return
+	}
+	targets := qry[linkTargetKey]
+	if !share.CheckBadReq(w, len(targets) == 1 && targets[0] != "") {
+		return
+	}
+
+	// the target is relative to the parent directory with the symlinks resolved, the same way as the
+	// link will be resolved when followed
+	dir, err := resolveExisting(path.Dir(p))
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	target, err := h.linkTarget(dir, targets[0])
+	if !share.CheckBadReq(w, err != invalidPath) || !share.CheckServerError(w, err == nil) {
+		return
+	}
+	_, err = os.Lstat(p)
+	if !share.CheckHandle(w, os.IsNotExist(err), http.StatusConflict) {
+		return
+	}
+	err = os.MkdirAll(path.Dir(p), os.ModePerm)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	err = os.Symlink(target, p)
+	share.CheckOsError(w, err)
+}
@@ -0,0 +1,174 @@
+package htfile
+
+import (
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func initSymlinks(t *testing.T) (string, string) {
+	dir := path.Join(dn, "symlinks")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, path.Join(dir, "sub"))
+	outside := path.Join(cachedir, "outside")
+	tst.RemoveIfExistsF(t, outside)
+	tst.EnsureDirF(t, outside)
+	for _, p := range []string{path.Join(dir, "sub/file"), path.Join(outside, "file")} {
+		tst.WithNewFileF(t, p, func(f *os.File) error {
+			_, err := f.Write([]byte("content"))
+			return err
+		})
+	}
+	for link, target := range map[string]string{
+		"file-link":    "sub/file",
+		"dir-link":     "sub",
+		"outside-link": outside,
+		"outside-file": path.Join(outside, "file")} {
+		err := os.Symlink(target, path.Join(dir, link))
+		tst.ErrFatal(t, err)
+	}
+	return dir, outside
+}
+
+func getProps(t *testing.T, url string) map[string]interface{} {
+	var m map[string]interface{}
+	tst.Htreq(t, "PROPS", tst.S.URL+url, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		err := json.NewDecoder(rsp.Body).Decode(&m)
+		tst.ErrFatal(t, err)
+	})
+	return m
+}
+
+func TestSymlinksFollow(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, outside := initSymlinks(t)
+	expectStatus(t, "GET", "/symlinks/file-link", http.StatusOK)
+	expectStatus(t, "GET", "/symlinks/dir-link/file", http.StatusOK)
+
+	// escaping
+	expectStatus(t, "GET", "/symlinks/outside-file", http.StatusNotFound)
+	expectStatus(t, "GET", "/symlinks/outside-link/file", http.StatusNotFound)
+	expectStatus(t, "PUT", "/symlinks/outside-link/new", http.StatusNotFound)
+	expectStatus(t, "MKDIR", "/symlinks/outside-link/dir", http.StatusNotFound)
+	if _, err := os.Lstat(path.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	// the link itself
+	m := getProps(t, "/symlinks/outside-link")
+	if m["link"] != outside {
+		t.Fail()
+	}
+	expectStatus(t, "DELETE", "/symlinks/outside-link", http.StatusOK)
+	if _, err := os.Lstat(path.Join(dir, "outside-link")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+	checkFileContent(t, path.Join(outside, "file"), "content")
+
+	// listing
+	tst.Htreq(t, "GET", tst.S.URL+"/symlinks", nil, func(rsp *http.Response) {
+		var ms []map[string]interface{}
+		err := json.NewDecoder(rsp.Body).Decode(&ms)
+		tst.ErrFatal(t, err)
+		links := make(map[string]interface{})
+		for _, m := range ms {
+			links[m["name"].(string)] = m["link"]
+		}
+		if links["file-link"] != "sub/file" || links["dir-link"] != "sub" || links["sub"] != nil {
+			t.Fail()
+		}
+	})
+}
+
+func TestSymlinksNever(t *testing.T) {
+	ht := New(&testOptions{root: dn, symlinks: symlinksNever})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, _ := initSymlinks(t)
+	expectStatus(t, "GET", "/symlinks/sub/file", http.StatusOK)
+	expectStatus(t, "GET", "/symlinks/file-link", http.StatusNotFound)
+	expectStatus(t, "GET", "/symlinks/dir-link/file", http.StatusNotFound)
+	expectStatus(t, "PUT", "/symlinks/dir-link/new", http.StatusNotFound)
+	if getProps(t, "/symlinks/file-link")["link"] != "sub/file" {
+		t.Fail()
+	}
+	expectStatus(t, "RENAME", "/symlinks/file-link?to=/symlinks/renamed-link", http.StatusOK)
+	if link, err := os.Readlink(path.Join(dir, "renamed-link")); err != nil || link != "sub/file" {
+		t.Fail()
+	}
+}
+
+func TestSymlinksCopy(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, _ := initSymlinks(t)
+	expectStatus(t, "COPY", "/symlinks?to=/copy-follow", http.StatusOK)
+	cdir := path.Join(dn, "copy-follow")
+	defer tst.RemoveIfExistsF(t, cdir)
+	fi, err := os.Lstat(path.Join(cdir, "file-link"))
+	if err != nil || !fi.Mode().IsRegular() {
+		t.Fail()
+	}
+	checkFileContent(t, path.Join(cdir, "file-link"), "content")
+	for _, n := range []string{"dir-link", "outside-link", "outside-file"} {
+		fi, err := os.Lstat(path.Join(cdir, n))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			t.Fail()
+		}
+	}
+
+	ht = New(&testOptions{root: dn, symlinks: symlinksPreserve})
+	tst.Thnd.Sh = ht.ServeHTTP
+	expectStatus(t, "COPY", "/symlinks/file-link?to=/symlinks/copied-link", http.StatusOK)
+	if link, err := os.Readlink(path.Join(dir, "copied-link")); err != nil || link != "sub/file" {
+		t.Fail()
+	}
+}
+
+func TestSymlinkCreate(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, _ := initSymlinks(t)
+	expectStatus(t, "POST", "/symlinks/new-link?cmd=symlink", http.StatusBadRequest)
+	expectStatus(t, "POST", "/symlinks/new-link?cmd=symlink&target=../../..", http.StatusBadRequest)
+	expectStatus(t, "POST", "/symlinks/file-link?cmd=symlink&target=sub/file", http.StatusConflict)
+	expectStatus(t, "POST", "/?cmd=symlink&target=symlinks", http.StatusNotFound)
+
+	expectStatus(t, "POST", "/symlinks/new-link?cmd=symlink&target=sub/file", http.StatusOK)
+	checkFileContent(t, path.Join(dir, "new-link"), "content")
+
+	// absolute target, relative to the root
+	expectStatus(t, "POST", "/symlinks/sub/abs-link?cmd=symlink&target=/symlinks/sub/file", http.StatusOK)
+	if link, err := os.Readlink(path.Join(dir, "sub/abs-link")); err != nil || link != "file" {
+		t.Fail()
+	}
+	b, err := ioutil.ReadFile(path.Join(dir, "sub/abs-link"))
+	if err != nil || string(b) != "content" {
+		t.Fail()
+	}
+
+	// the target is checked and made relative to the resolved parent
+	err = os.Symlink(dn, path.Join(dir, "root-link"))
+	tst.ErrFatal(t, err)
+	expectStatus(t, "POST", "/symlinks/root-link/escaping-link?cmd=symlink&target=../x", http.StatusBadRequest)
+	if _, err := os.Lstat(path.Join(dn, "escaping-link")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+	expectStatus(t, "POST", "/symlinks/root-link/abs-link?cmd=symlink&target=/symlinks/sub/file", http.StatusOK)
+	checkFileContent(t, path.Join(dn, "abs-link"), "content")
+	tst.RemoveIfExistsF(t, path.Join(dn, "abs-link"))
+	tst.RemoveIfExistsF(t, path.Join(dir, "root-link"))
+
+	// the symlinks in the target are resolved
+	expectStatus(t, "POST", "/symlinks/through-link?cmd=symlink&target=outside-link/file", http.StatusBadRequest)
+	expectStatus(t, "POST", "/symlinks/through-link?cmd=symlink&target=outside-link/..", http.StatusBadRequest)
+	expectStatus(t, "POST", "/symlinks/through-link?cmd=symlink&target=dir-link/file", http.StatusOK)
+	checkFileContent(t, path.Join(dir, "through-link"), "content")
+}
@@ -0,0 +1,311 @@
+package htfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+)
+
+const (
+	metaXattr      = "user.tasked.meta"
+	metaDir        = "meta"
+	searchQueryTag = "tag"
+)
+
+// user defined tags and key/value metadata of a file
+type fileMeta struct {
+	Tags []string          `json:"tags,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+var invalidMeta = errors.New("Invalid tags or metadata.")
+
+func (m *fileMeta) empty() bool {
+	return len(m.Tags) == 0 && len(m.Meta) == 0
+}
+
+func (m *fileMeta) hasTags(tags []string) bool {
+	for _, t := range tags {
+		i := sort.SearchStrings(m.Tags, t)
+		if i == len(m.Tags) || m.Tags[i] != t {
+			return false
+		}
+	}
+	return true
+}
+
+// reads the tags property of a MODPROPS request. The tags are stored sorted and without duplicates.
+func getTagsProp(v interface{}) ([]string, error) {
+	vs, ok := v.([]interface{})
+	if !ok {
+		return nil, invalidMeta
+	}
+	tags := make([]string, 0, len(vs))
+	for _, vi := range vs {
+		t, ok := vi.(string)
+		if !ok || t == "" {
+			return nil, invalidMeta
+		}
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	unique := make([]string, 0, len(tags))
+	for i, t := range tags {
+		if i == 0 || t != tags[i-1] {
+			unique = append(unique, t)
+		}
+	}
+	return unique, nil
+}
+
+// reads the meta property of a MODPROPS request. A string value sets a key, null removes it.
+func getMetaProp(v interface{}) (map[string]*string, error) {
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, invalidMeta
+	}
+	m := make(map[string]*string)
+	for k, vi := range mv {
+		if k == "" {
+			return nil, invalidMeta
+		}
+		switch vv := vi.(type) {
+		case nil:
+			m[k] = nil
+		case string:
+			m[k] = &vv
+		default:
+			return nil, invalidMeta
+		}
+	}
+	return m, nil
+}
+
+func isXattrUnsupported(err error) bool {
+	return err == syscall.ENOTSUP || err == syscall.EPERM
+}
+
+// the meta directory is shared by the users of the cache directory, the sidecar files are kept in a
+// directory per user, only accessible by the owner
+func (h *handler) userMetaDir() string {
+	return path.Join(h.cachedir, metaDir, strconv.Itoa(os.Getuid()))
+}
+
+func ownedByUser(fi os.FileInfo) bool {
+	sstat, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(sstat.Uid) == os.Getuid()
+}
+
+// the sidecar files are named by the device and the inode, so that the metadata follows the file when
+// renamed
+func (h *handler) metaSidecar(fi os.FileInfo) (string, bool) {
+	sstat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || h.cachedir == "" {
+		return "", false
+	}
+	return path.Join(h.userMetaDir(), fmt.Sprintf("%x-%x.json", sstat.Dev, sstat.Ino)), true
+}
+
+func (h *handler) ensureMetaDir() error {
+	err := h.ensureSharedDir(path.Join(h.cachedir, metaDir))
+	if err != nil {
+		return err
+	}
+	dir := h.userMetaDir()
+	err = os.Mkdir(dir, 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	// the directory may have been created by another user
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() || !ownedByUser(fi) {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.EPERM}
+	}
+	return nil
+}
+
+// reads a sidecar file, ignoring it when it's not a regular file owned by the current user
+func readMetaSidecar(sp string, m *fileMeta) error {
+	f, err := os.OpenFile(sp, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.ELOOP {
+			return nil
+		}
+		return err
+	}
+	defer share.Doretlog42(f.Close)
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || !ownedByUser(fi) {
+		return nil
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, m)
+}
+
+// reads the metadata from the extended attributes, or, when not supported, from the sidecar file in the
+// cache directory. The metadata of symlinks is always kept in the sidecar files.
+func (h *handler) readMeta(p string, fi os.FileInfo) (*fileMeta, error) {
+	m := new(fileMeta)
+	if fi.Mode()&os.ModeSymlink == 0 {
+		b, err := getXattr(p, metaXattr)
+		if err == nil {
+			return m, json.Unmarshal(b, m)
+		}
+		if err != syscall.ENODATA && !isXattrUnsupported(err) {
+			return nil, &os.PathError{Op: "getxattr", Path: p, Err: err}
+		}
+	}
+	sp, ok := h.metaSidecar(fi)
+	if !ok {
+		return m, nil
+	}
+	err := readMetaSidecar(sp, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (h *handler) removeMetaSidecar(fi os.FileInfo) error {
+	sp, ok := h.metaSidecar(fi)
+	if !ok {
+		return nil
+	}
+	err := os.Remove(sp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// moves the sidecar file of a replaced file to the replacement
+func (h *handler) moveMetaSidecar(fi os.FileInfo, f *os.File) error {
+	sp, ok := h.metaSidecar(fi)
+	if !ok {
+		return nil
+	}
+	if _, err := os.Lstat(sp); os.IsNotExist(err) {
+		return nil
+	}
+	tfi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tp, _ := h.metaSidecar(tfi)
+	return os.Rename(sp, tp)
+}
+
+func (h *handler) writeMeta(p string, fi os.FileInfo, m *fileMeta) error {
+	isLink := fi.Mode()&os.ModeSymlink != 0
+	if m.empty() {
+		if !isLink {
+			err := syscall.Removexattr(p, metaXattr)
+			if err != nil && err != syscall.ENODATA && !isXattrUnsupported(err) {
+				return &os.PathError{Op: "removexattr", Path: p, Err: err}
+			}
+		}
+		return h.removeMetaSidecar(fi)
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if !isLink {
+		err = syscall.Setxattr(p, metaXattr, b, 0)
+		if err == nil {
+			return h.removeMetaSidecar(fi)
+		}
+		if !isXattrUnsupported(err) {
+			return &os.PathError{Op: "setxattr", Path: p, Err: err}
+		}
+	}
+
+	sp, ok := h.metaSidecar(fi)
+	if !ok {
+		return &os.PathError{Op: "setxattr", Path: p, Err: syscall.ENOTSUP}
+	}
+	err = h.ensureMetaDir()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sp, b, 0600)
+}
+
+// replaces the tags, when not nil, and merges the metadata
+func (h *handler) applyMeta(p string, fi os.FileInfo, tags []string, meta map[string]*string) error {
+	if tags == nil && len(meta) == 0 {
+		return nil
+	}
+	m, err := h.readMeta(p, fi)
+	if err != nil {
+		return err
+	}
+	if tags != nil {
+		m.Tags = tags
+	}
+	for k, v := range meta {
+		if v == nil {
+			delete(m.Meta, k)
+			continue
+		}
+		if m.Meta == nil {
+			m.Meta = make(map[string]string)
+		}
+		m.Meta[k] = *v
+	}
+	return h.writeMeta(p, fi, m)
+}
+
+// sets the tags and the metadata in a property map, when there are any
+func (h *handler) addMeta(pr map[string]interface{}, p string, fi os.FileInfo) error {
+	m, err := h.readMeta(p, fi)
+	if err != nil {
+		return err
+	}
+	if len(m.Tags) > 0 {
+		pr["tags"] = m.Tags
+	}
+	if len(m.Meta) > 0 {
+		pr["meta"] = m.Meta
+	}
+	return nil
+}
+
+// removes the sidecar files of a tree before it is deleted, so that a new file reusing an inode doesn't
+// inherit the metadata
+func (h *handler) removeMetaTree(p string) {
+	if h.cachedir == "" {
+		return
+	}
+	if _, err := os.Stat(h.userMetaDir()); err != nil {
+		return
+	}
+	filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil {
+			share.Dolog(func() error { return h.removeMetaSidecar(fi) })
+		}
+		return nil
+	})
+}
@@ -0,0 +1,210 @@
+package htfile
+
+import (
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func initTags(t *testing.T) string {
+	return initTestDir(t, "tags", map[string]string{"file0": "", "sub/file1": ""}, metaDir)
+}
+
+func getList(t *testing.T, method, url string) map[string]map[string]interface{} {
+	lm := make(map[string]map[string]interface{})
+	tst.Htreq(t, method, tst.S.URL+url, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		var ms []map[string]interface{}
+		err := json.NewDecoder(rsp.Body).Decode(&ms)
+		tst.ErrFatal(t, err)
+		for _, m := range ms {
+			lm[m["name"].(string)] = m
+		}
+	})
+	return lm
+}
+
+func checkTags(t *testing.T, m map[string]interface{}, tags ...string) {
+	ts, _ := m["tags"].([]interface{})
+	if len(ts) != len(tags) {
+		t.Log(m["tags"], tags)
+		t.Fail()
+		return
+	}
+	for i, tag := range tags {
+		if ts[i] != tag {
+			t.Log(m["tags"], tags)
+			t.Fail()
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	ht := New(&testOptions{
+		root:             dn,
+		cachedir:         cachedir,
+		maxRequestBody:   testMaxRequestBody,
+		maxSearchResults: 30})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initTags(t)
+
+	modprops(t, "/tags/file0", "{\"tags\": \"reviewed\"}", http.StatusBadRequest)
+	modprops(t, "/tags/file0", "{\"tags\": [\"\"]}", http.StatusBadRequest)
+	modprops(t, "/tags/file0", "{\"meta\": {\"build\": 1234}}", http.StatusBadRequest)
+	modprops(t, "/tags/file0", "{\"meta\": {\"\": \"1234\"}}", http.StatusBadRequest)
+
+	modprops(t, "/tags/file0", "{\"tags\": [\"reviewed\", \"docs\", \"reviewed\"], \"meta\": {\"build\": \"1234\"}}",
+		http.StatusOK)
+	modprops(t, "/tags/sub/file1", "{\"tags\": [\"reviewed\"]}", http.StatusOK)
+	m := getProps(t, "/tags/file0")
+	checkTags(t, m, "docs", "reviewed")
+	if meta, ok := m["meta"].(map[string]interface{}); !ok || len(meta) != 1 || meta["build"] != "1234" {
+		t.Fail()
+	}
+
+	// merge and remove
+	modprops(t, "/tags/file0", "{\"meta\": {\"build\": null, \"reviewer\": \"someone\"}}", http.StatusOK)
+	m = getProps(t, "/tags/file0")
+	checkTags(t, m, "docs", "reviewed")
+	if meta, ok := m["meta"].(map[string]interface{}); !ok || len(meta) != 1 || meta["reviewer"] != "someone" {
+		t.Fail()
+	}
+
+	// listing
+	lm := getList(t, "GET", "/tags")
+	checkTags(t, lm["file0"], "docs", "reviewed")
+	checkTags(t, lm["sub"])
+
+	// search
+	lm = getList(t, "SEARCH", "/tags?tag=reviewed")
+	if len(lm) != 2 || lm["file0"] == nil || lm["file1"] == nil {
+		t.Fail()
+	}
+	checkTags(t, lm["file1"], "reviewed")
+	lm = getList(t, "SEARCH", "/tags?tag=reviewed&tag=docs")
+	if len(lm) != 1 || lm["file0"] == nil {
+		t.Fail()
+	}
+	lm = getList(t, "SEARCH", "/tags?tag=missing")
+	if len(lm) != 0 {
+		t.Fail()
+	}
+
+	// clearing
+	modprops(t, "/tags/file0", "{\"tags\": [], \"meta\": {\"reviewer\": null}}", http.StatusOK)
+	m = getProps(t, "/tags/file0")
+	if _, ok := m["tags"]; ok {
+		t.Fail()
+	}
+	if _, ok := m["meta"]; ok {
+		t.Fail()
+	}
+}
+
+func TestTagsOverwrite(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, maxRequestBody: testMaxRequestBody})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initTags(t)
+	put := func(url string) {
+		tst.Htreq(t, "PUT", tst.S.URL+url, tst.NewByteReaderString("new content"), func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatal(rsp.StatusCode)
+			}
+		})
+	}
+
+	modprops(t, "/tags/file0", "{\"tags\": [\"reviewed\"], \"meta\": {\"build\": \"1234\"}}", http.StatusOK)
+	put("/tags/file0")
+	m := getProps(t, "/tags/file0")
+	checkTags(t, m, "reviewed")
+	if meta, ok := m["meta"].(map[string]interface{}); !ok || meta["build"] != "1234" {
+		t.Fail()
+	}
+
+	// the internal attribute is not exposed
+	if xattrs, ok := m["xattrs"].(map[string]interface{}); ok && xattrs[metaXattr] != nil {
+		t.Fail()
+	}
+	modprops(t, "/tags/file0", "{\"xattrs\": {\""+metaXattr+"\": \"invalid\"}}", http.StatusBadRequest)
+	modprops(t, "/tags/file0", "{\"xattrs\": {\""+metaXattr+"\": null}}", http.StatusBadRequest)
+	checkTags(t, getProps(t, "/tags/file0"), "reviewed")
+
+	// the sidecar file follows the replaced file
+	p := path.Join(dir, "sub/file1")
+	fi, err := os.Lstat(p)
+	tst.ErrFatal(t, err)
+	sp, _ := ht.(*handler).metaSidecar(fi)
+	tst.EnsureDirF(t, path.Dir(sp))
+	err = ioutil.WriteFile(sp, []byte("{\"tags\": [\"sidecar\"]}"), 0644)
+	tst.ErrFatal(t, err)
+	put("/tags/sub/file1")
+	checkTags(t, getProps(t, "/tags/sub/file1"), "sidecar")
+	if _, err := os.Lstat(sp); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestTagsSidecar(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, maxRequestBody: testMaxRequestBody})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initTags(t)
+	err := os.Symlink("file0", path.Join(dir, "link"))
+	tst.ErrFatal(t, err)
+
+	// symlinks keep their metadata in the cache directory
+	modprops(t, "/tags/link", "{\"tags\": [\"link\"]}", http.StatusOK)
+	checkTags(t, getProps(t, "/tags/link"), "link")
+	checkTags(t, getProps(t, "/tags/file0"))
+	fi, err := os.Lstat(path.Join(dir, "link"))
+	tst.ErrFatal(t, err)
+	sp, _ := ht.(*handler).metaSidecar(fi)
+	sfi, err := os.Stat(sp)
+	if err != nil || sfi.Mode().Perm() != 0600 {
+		t.Fail()
+	}
+	dfi, err := os.Stat(path.Dir(sp))
+	if err != nil || dfi.Mode().Perm() != 0700 {
+		t.Fail()
+	}
+
+	// follows the rename
+	expectStatus(t, "RENAME", "/tags/link?to=/tags/renamed-link", http.StatusOK)
+	checkTags(t, getProps(t, "/tags/renamed-link"), "link")
+
+	// removed with the file
+	expectStatus(t, "DELETE", "/tags", http.StatusOK)
+	if _, err := os.Stat(sp); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	// the sidecar files and directories of other users are not trusted
+	if os.Getuid() == 0 {
+		dir = initTags(t)
+		err = os.Symlink("file0", path.Join(dir, "link"))
+		tst.ErrFatal(t, err)
+		modprops(t, "/tags/link", "{\"tags\": [\"link\"]}", http.StatusOK)
+		fi, err = os.Lstat(path.Join(dir, "link"))
+		tst.ErrFatal(t, err)
+		sp, _ = ht.(*handler).metaSidecar(fi)
+		err = os.Chown(sp, 1, 1)
+		tst.ErrFatal(t, err)
+		checkTags(t, getProps(t, "/tags/link"))
+		err = os.Chown(path.Dir(sp), 1, 1)
+		tst.ErrFatal(t, err)
+		modprops(t, "/tags/link", "{\"tags\": [\"link\"]}", http.StatusNotFound)
+	}
+
+	// no cache directory
+	ht = New(&testOptions{root: dn, maxRequestBody: testMaxRequestBody})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir = initTags(t)
+	err = os.Symlink("file0", path.Join(dir, "link"))
+	tst.ErrFatal(t, err)
+	modprops(t, "/tags/link", "{\"tags\": [\"link\"]}", http.StatusNotFound)
+}
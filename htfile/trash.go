@@ -0,0 +1,329 @@
+package htfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	trashDir     = "trash"
+	trashInfoExt = ".json"
+	trashIdKey   = "id"
+)
+
+type trashItem struct {
+	Id      string `json:"id"`
+	Path    string `json:"path"`
+	Deleted int64  `json:"deleted"`
+	Size    int64  `json:"size"`
+	IsDir   bool   `json:"isDir"`
+}
+
+type byDeleted []*trashItem
+
+var invalidTrashId = errors.New("Invalid trash id.")
+
+func (tis byDeleted) Len() int           { return len(tis) }
+func (tis byDeleted) Less(i, j int) bool { return tis[i].Id < tis[j].Id }
+func (tis byDeleted) Swap(i, j int)      { tis[i], tis[j] = tis[j], tis[i] }
+
+// the ids start with the time of creation, and their order is the order of creation
+func newTimeId(t time.Time) (string, error) {
+	id, err := newId()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x", t.UnixNano()) + id[16:], nil
+}
+
+func treeSize(p string, fi os.FileInfo) int64 {
+	if !fi.IsDir() {
+		return fi.Size()
+	}
+	d, err := os.Open(p)
+	if err != nil {
+		return 0
+	}
+	fis, err := d.Readdir(0)
+	share.Doretlog42(d.Close)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, fii := range fis {
+		size += treeSize(path.Join(p, fii.Name()), fii)
+	}
+	return size
+}
+
+// the trash is kept per user, only accessible by the owner
+func (h *handler) userTrashDir() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	err = share.EnsureDir(path.Join(h.cachedir, trashDir))
+	if err != nil {
+		return "", err
+	}
+	dir := path.Join(h.cachedir, trashDir, u.Uid)
+	err = os.Mkdir(dir, 0700)
+	if os.IsExist(err) {
+		return dir, nil
+	}
+	return dir, err
+}
+
+func readTrashItem(dir, id string) (*trashItem, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, id+trashInfoExt))
+	if err != nil {
+		return nil, err
+	}
+	ti := new(trashItem)
+	err = json.Unmarshal(b, ti)
+	if err != nil {
+		return nil, err
+	}
+	ti.Id = id
+	return ti, nil
+}
+
+// the info is removed first, so that an item is never listed without its content
+func removeTrashItem(dir, id string) {
+	share.Dolog(func() error { return removeIfExists(path.Join(dir, id+trashInfoExt)) })
+	share.Dolog(func() error { return os.RemoveAll(path.Join(dir, id)) })
+}
+
+// returns the trash items, the oldest first. Items without info, left behind by failed operations, are
+// removed.
+func trashItems(dir string) ([]*trashItem, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	fis, err := d.Readdir(0)
+	share.Doretlog42(d.Close)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, fi := range fis {
+		names[fi.Name()] = true
+	}
+	var tis []*trashItem
+	for _, fi := range fis {
+		n := fi.Name()
+		if !idExp.MatchString(n) {
+			continue
+		}
+		if !names[n+trashInfoExt] {
+			share.Dolog(func() error { return os.RemoveAll(path.Join(dir, n)) })
+			continue
+		}
+		ti, err := readTrashItem(dir, n)
+		if err != nil {
+			continue
+		}
+		tis = append(tis, ti)
+	}
+	sort.Sort(byDeleted(tis))
+	return tis, nil
+}
+
+// removes the expired items, and the oldest ones over the maximum size
+func (h *handler) purgeTrash(dir string) error {
+	tis, err := trashItems(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	var size int64
+	for _, ti := range tis {
+		size += ti.Size
+	}
+	for _, ti := range tis {
+		if (h.trashExpiry <= 0 || now-ti.Deleted <= int64(h.trashExpiry)) &&
+			(h.trashMaxSize <= 0 || size <= h.trashMaxSize) {
+			break
+		}
+		removeTrashItem(dir, ti.Id)
+		size -= ti.Size
+	}
+	return nil
+}
+
+func (h *handler) trashEnabled() bool {
+	return h.trash && h.cachedir != ""
+}
+
+// moves a path to the trash, recording rp, the path in the root, as the original path
+func (h *handler) moveToTrash(p, rp string, fi os.FileInfo) (*trashItem, error) {
+	dir, err := h.userTrashDir()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	id, err := newTimeId(now)
+	if err != nil {
+		return nil, err
+	}
+	ti := &trashItem{
+		Id:      id,
+		Path:    rp,
+		Deleted: now.Unix(),
+		Size:    treeSize(p, fi),
+		IsDir:   fi.IsDir()}
+	b, err := json.Marshal(ti)
+	if err != nil {
+		return nil, err
+	}
+
+	// the info is written first, so that the moved item is never without it
+	err = ioutil.WriteFile(path.Join(dir, id+trashInfoExt), b, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = moveTree(p, path.Join(dir, id))
+	if err != nil {
+		share.Dolog(func() error { return os.Remove(path.Join(dir, id+trashInfoExt)) })
+		return nil, err
+	}
+	share.Dolog(func() error { return h.purgeTrash(dir) })
+	return ti, nil
+}
+
+func (h *handler) trashf(w http.ResponseWriter, r *http.Request, p string) {
+	if !share.CheckHandle(w, p != h.dn, http.StatusNotFound) {
+		return
+	}
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return
+	}
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	ti, err := h.moveToTrash(p, path.Clean("/"+r.URL.Path), fi)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	_, err = share.WriteJsonResponse(w, r, ti)
+	share.CheckServerError(w, err != share.MarshalError)
+}
+
+// the request paths are relative to the root, and pathIntersect doesn't handle "/" as the containing path
+func isUnder(dir, p string) bool {
+	return dir == "/" || pathIntersect(dir, p) >= leftContains
+}
+
+func getTrashId(qry url.Values) (string, error) {
+	ids := qry[trashIdKey]
+	if len(ids) != 1 || !idExp.MatchString(ids[0]) {
+		return "", invalidTrashId
+	}
+	return ids[0], nil
+}
+
+// lists the trash items deleted from under the request path
+func (h *handler) listTrashf(w http.ResponseWriter, r *http.Request) {
+	if !share.CheckHandle(w, h.trashEnabled(), http.StatusNotFound) {
+		return
+	}
+	dir, err := h.userTrashDir()
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	share.Dolog(func() error { return h.purgeTrash(dir) })
+	tis, err := trashItems(dir)
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	rp := path.Clean("/" + r.URL.Path)
+	items := make([]*trashItem, 0, len(tis))
+	for _, ti := range tis {
+		if isUnder(rp, ti.Path) {
+			items = append(items, ti)
+		}
+	}
+	_, err = share.WriteJsonResponse(w, r, items)
+	share.CheckServerError(w, err != share.MarshalError)
+}
+
+// restores an item to the request path, typically the original one, if nothing exists there
+func (h *handler) restoref(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	if !share.CheckHandle(w, h.trashEnabled(), http.StatusNotFound) {
+		return
+	}
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil && p != h.dn, http.StatusNotFound) {
+		return
+	}
+	id, err := getTrashId(qry)
+	if !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	dir, err := h.userTrashDir()
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	_, err = readTrashItem(dir, id)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	_, err = os.Lstat(p)
+	if !share.CheckHandle(w, os.IsNotExist(err), http.StatusConflict) {
+		return
+	}
+	err = os.MkdirAll(path.Dir(p), os.ModePerm)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	err = moveTree(path.Join(dir, id), p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	removeTrashItem(dir, id)
+}
+
+// purges a single item, or all the items deleted from under the request path
+func (h *handler) purgef(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	if !share.CheckHandle(w, h.trashEnabled(), http.StatusNotFound) {
+		return
+	}
+	dir, err := h.userTrashDir()
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	if _, ok := qry[trashIdKey]; ok {
+		id, err := getTrashId(qry)
+		if !share.CheckBadReq(w, err == nil) {
+			return
+		}
+		_, err = readTrashItem(dir, id)
+		if !share.CheckOsError(w, err) {
+			return
+		}
+		removeTrashItem(dir, id)
+		return
+	}
+	tis, err := trashItems(dir)
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	rp := path.Clean("/" + r.URL.Path)
+	for _, ti := range tis {
+		if isUnder(rp, ti.Path) {
+			removeTrashItem(dir, ti.Id)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package htfile
+
+import (
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"testing"
+	"time"
+)
+
+func initTrash(t *testing.T) (string, string) {
+	files := make(map[string]string)
+	for _, n := range []string{"file0", "sub/file1", "sub/file2"} {
+		files[n] = "content of " + n
+	}
+	dir := initTestDir(t, "trash", files, trashDir)
+	u, err := user.Current()
+	tst.ErrFatal(t, err)
+	return dir, path.Join(cachedir, trashDir, u.Uid)
+}
+
+func deleteToTrash(t *testing.T, p string) *trashItem {
+	ti := new(trashItem)
+	tst.Htreq(t, "DELETE", tst.S.URL+p, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		err := json.NewDecoder(rsp.Body).Decode(ti)
+		tst.ErrFatal(t, err)
+	})
+	return ti
+}
+
+func listTrash(t *testing.T, p string) []*trashItem {
+	var tis []*trashItem
+	tst.Htreq(t, "GET", tst.S.URL+p+"?cmd=trash", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		err := json.NewDecoder(rsp.Body).Decode(&tis)
+		tst.ErrFatal(t, err)
+	})
+	return tis
+}
+
+func TestTrashDisabled(t *testing.T) {
+	ht := New(&testOptions{root: dn, trash: true})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, _ := initTrash(t)
+	expectStatus(t, "DELETE", "/trash/file0", http.StatusOK)
+	if _, err := os.Lstat(path.Join(dir, "file0")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+	expectStatus(t, "GET", "/?cmd=trash", http.StatusNotFound)
+}
+
+func TestTrashDelete(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, trash: true})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, tdir := initTrash(t)
+	expectStatus(t, "DELETE", "/", http.StatusNotFound)
+	expectStatus(t, "DELETE", "/trash/not-existing", http.StatusOK)
+
+	ti0 := deleteToTrash(t, "/trash/file0")
+	if !idExp.MatchString(ti0.Id) || ti0.Path != "/trash/file0" || ti0.IsDir ||
+		ti0.Size != int64(len("content of file0")) {
+		t.Fail()
+	}
+	ti1 := deleteToTrash(t, "/trash/sub")
+	if ti1.Path != "/trash/sub" || !ti1.IsDir || ti1.Size != int64(2*len("content of sub/file1")) {
+		t.Fail()
+	}
+	for _, n := range []string{"file0", "sub"} {
+		if _, err := os.Lstat(path.Join(dir, n)); !os.IsNotExist(err) {
+			t.Fail()
+		}
+	}
+	checkFileContent(t, path.Join(tdir, ti1.Id, "file1"), "content of sub/file1")
+	fi, err := os.Lstat(tdir)
+	if err != nil || fi.Mode().Perm() != 0700 {
+		t.Fail()
+	}
+
+	tis := listTrash(t, "/")
+	if len(tis) != 2 || tis[0].Id != ti0.Id || tis[1].Id != ti1.Id {
+		t.Fail()
+	}
+	tis = listTrash(t, "/trash/sub")
+	if len(tis) != 1 || tis[0].Id != ti1.Id {
+		t.Fail()
+	}
+	tis = listTrash(t, "/other")
+	if len(tis) != 0 {
+		t.Fail()
+	}
+}
+
+func TestTrashRestore(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, trash: true})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir, _ := initTrash(t)
+	ti := deleteToTrash(t, "/trash/sub")
+	expectStatus(t, "POST", "/trash/sub?cmd=restore", http.StatusBadRequest)
+	expectStatus(t, "POST", "/trash/sub?cmd=restore&id=invalid", http.StatusBadRequest)
+	expectStatus(t, "POST", "/trash/sub?cmd=restore&id=0123456789abcdef0123456789abcdef",
+		http.StatusNotFound)
+	expectStatus(t, "POST", "/trash/file0?cmd=restore&id="+ti.Id, http.StatusConflict)
+	expectStatus(t, "POST", "/?cmd=restore&id="+ti.Id, http.StatusNotFound)
+
+	expectStatus(t, "POST", "/trash/sub?cmd=restore&id="+ti.Id, http.StatusOK)
+	checkFileContent(t, path.Join(dir, "sub/file1"), "content of sub/file1")
+	checkFileContent(t, path.Join(dir, "sub/file2"), "content of sub/file2")
+	if len(listTrash(t, "/")) != 0 {
+		t.Fail()
+	}
+
+	// to another path
+	ti = deleteToTrash(t, "/trash/file0")
+	expectStatus(t, "POST", "/trash/restored/file?cmd=restore&id="+ti.Id, http.StatusOK)
+	checkFileContent(t, path.Join(dir, "restored/file"), "content of file0")
+}
+
+func TestTrashPurge(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, trash: true})
+	tst.Thnd.Sh = ht.ServeHTTP
+	_, tdir := initTrash(t)
+	ti0 := deleteToTrash(t, "/trash/file0")
+	ti1 := deleteToTrash(t, "/trash/sub/file1")
+	ti2 := deleteToTrash(t, "/trash/sub/file2")
+	expectStatus(t, "POST", "/?cmd=purge&id=invalid", http.StatusBadRequest)
+	expectStatus(t, "POST", "/?cmd=purge&id=0123456789abcdef0123456789abcdef", http.StatusNotFound)
+
+	expectStatus(t, "POST", "/?cmd=purge&id="+ti1.Id, http.StatusOK)
+	if _, err := os.Lstat(path.Join(tdir, ti1.Id)); !os.IsNotExist(err) {
+		t.Fail()
+	}
+	tis := listTrash(t, "/")
+	if len(tis) != 2 || tis[0].Id != ti0.Id || tis[1].Id != ti2.Id {
+		t.Fail()
+	}
+
+	expectStatus(t, "POST", "/trash/sub?cmd=purge", http.StatusOK)
+	tis = listTrash(t, "/")
+	if len(tis) != 1 || tis[0].Id != ti0.Id {
+		t.Fail()
+	}
+	expectStatus(t, "POST", "/?cmd=purge", http.StatusOK)
+	fis, err := ioutil.ReadDir(tdir)
+	if err != nil || len(fis) != 0 {
+		t.Fail()
+	}
+}
+
+func TestTrashAutoPurge(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, trash: true, trashExpiry: 60})
+	tst.Thnd.Sh = ht.ServeHTTP
+	_, tdir := initTrash(t)
+	ti := deleteToTrash(t, "/trash/file0")
+	ti.Deleted = time.Now().Add(-2 * time.Minute).Unix()
+	b, err := json.Marshal(ti)
+	tst.ErrFatal(t, err)
+	err = ioutil.WriteFile(path.Join(tdir, ti.Id+trashInfoExt), b, 0600)
+	tst.ErrFatal(t, err)
+	if len(listTrash(t, "/")) != 0 {
+		t.Fail()
+	}
+	if _, err := os.Lstat(path.Join(tdir, ti.Id)); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	// over size, the oldest removed
+	ht = New(&testOptions{root: dn, cachedir: cachedir, trash: true, trashMaxSize: 30})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initTrash(t)
+	deleteToTrash(t, "/trash/sub/file1")
+	ti1 := deleteToTrash(t, "/trash/sub/file2")
+	tis := listTrash(t, "/")
+	if len(tis) != 1 || tis[0].Id != ti1.Id {
+		t.Fail()
+	}
+
+	// orphans removed
+	err = os.Mkdir(path.Join(tdir, "0123456789abcdef0123456789abcdef"), 0700)
+	tst.ErrFatal(t, err)
+	listTrash(t, "/")
+	if _, err := os.Lstat(path.Join(tdir, "0123456789abcdef0123456789abcdef")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
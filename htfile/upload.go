@@ -0,0 +1,346 @@
+package htfile
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	uploadKey     = "upload"
+	uploadsDir    = "uploads"
+	uploadInfoExt = ".json"
+)
+
+type upload struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+var (
+	headerUploadOffset = http.CanonicalHeaderKey("upload-offset")
+	headerUploadLength = http.CanonicalHeaderKey("upload-length")
+	headerLocation     = http.CanonicalHeaderKey("location")
+	idExp              = regexp.MustCompile("^[0-9a-f]{32}$")
+	invalidUploadId    = errors.New("Invalid upload id.")
+	uploadExpired      = errors.New("Upload expired.")
+	uploadMismatch     = errors.New("Upload path mismatch.")
+)
+
+func newId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", b), nil
+}
+
+func getHeaderNum(h http.Header, key string) (int64, bool) {
+	vs, ok := h[key]
+	if !ok || len(vs) != 1 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(vs[0], 10, 64)
+	return n, err == nil && n >= 0
+}
+
+func removeIfExists(p string) error {
+	err := os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (h *handler) uploadPath(id string) string {
+	return path.Join(h.cachedir, uploadsDir, id)
+}
+
+func (h *handler) removeUpload(id string) {
+	p := h.uploadPath(id)
+	share.Dolog(func() error { return removeIfExists(p + uploadInfoExt) })
+	share.Dolog(func() error { return removeIfExists(p) })
+}
+
+// the expiry is counted from the last received chunk
+func (h *handler) isUploadExpired(fi os.FileInfo) bool {
+	return h.uploadExpiry > 0 && time.Now().Sub(fi.ModTime()) > time.Duration(h.uploadExpiry)*time.Second
+}
+
+func (h *handler) expireUploads() error {
+	d, err := os.Open(path.Join(h.cachedir, uploadsDir))
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(d.Close)
+	fis, err := d.Readdir(0)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if idExp.MatchString(fi.Name()) && h.isUploadExpired(fi) {
+			h.removeUpload(fi.Name())
+		}
+	}
+	return nil
+}
+
+func (h *handler) getUpload(qry url.Values, p string) (string, *upload, error) {
+	ids := qry[uploadKey]
+	if len(ids) != 1 || !idExp.MatchString(ids[0]) {
+		return "", nil, invalidUploadId
+	}
+	id := ids[0]
+	fi, err := os.Lstat(h.uploadPath(id))
+	if err != nil {
+		return "", nil, err
+	}
+	if h.isUploadExpired(fi) {
+		h.removeUpload(id)
+		return "", nil, uploadExpired
+	}
+	b, err := ioutil.ReadFile(h.uploadPath(id) + uploadInfoExt)
+	if err != nil {
+		return "", nil, err
+	}
+	u := new(upload)
+	err = json.Unmarshal(b, u)
+	if err != nil {
+		return "", nil, err
+	}
+	if u.Path != p {
+		return "", nil, uploadMismatch
+	}
+	return id, u, nil
+}
+
+func (h *handler) checkUpload(w http.ResponseWriter, r *http.Request, qry url.Values) (string, *upload, bool) {
+	if !share.CheckHandle(w, h.cachedir != "", http.StatusNotFound) {
+		return "", nil, false
+	}
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return "", nil, false
+	}
+	id, u, err := h.getUpload(qry, p)
+	if !share.CheckBadReq(w, err != invalidUploadId) ||
+		!share.CheckHandle(w, err != uploadExpired && err != uploadMismatch, http.StatusNotFound) ||
+		!share.CheckOsError(w, err) {
+		return "", nil, false
+	}
+	return id, u, true
+}
+
+func writeUploadStatus(w http.ResponseWriter, r *http.Request, id string, u *upload, offset int64) {
+	header := w.Header()
+	header.Set(headerUploadOffset, strconv.FormatInt(offset, 10))
+	header.Set(headerUploadLength, strconv.FormatInt(u.Length, 10))
+	_, err := share.WriteJsonResponse(w, r, map[string]interface{}{
+		"id":     id,
+		"offset": offset,
+		"length": u.Length})
+	share.CheckServerError(w, err != share.MarshalError)
+}
+
+// moves the completed upload in place. Renames when the cachedir is on the same device as the target,
+// copies otherwise. The preconditions of the request are checked again before the rename.
+func (h *handler) finishUpload(f *os.File, p string, r *http.Request) (os.FileInfo, error) {
+	p, fi, err := prepareTarget(p)
+	if err != nil {
+		return nil, err
+	}
+	err = inheritProps(f, p, fi)
+	if err != nil {
+		return nil, err
+	}
+	ufi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// moved next to the target first, so that a different device is detected before a version is saved
+	tp, err := tempPath(p)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(f.Name(), tp)
+	if err == nil {
+		err = h.commitUpload(tp, p, r)
+		if err != nil {
+			share.Doretlog42(func() error { return os.Rename(tp, f.Name()) })
+			return nil, err
+		}
+		return ufi, nil
+	}
+	if lerr, ok := err.(*os.LinkError); !ok || lerr.Err != syscall.EXDEV {
+		return nil, err
+	}
+	_, err = f.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return nil, err
+	}
+	fi, err = h.replaceFile(p, fi, r, func(tf *os.File) error {
+		_, err := io.Copy(tf, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fi, os.Remove(f.Name())
+}
+
+func (h *handler) commitUpload(tp, p string, r *http.Request) error {
+	f, err := os.Open(tp)
+	if err != nil {
+		return err
+	}
+	defer share.Doretlog42(f.Close)
+	return h.commitTemp(f, p, r)
+}
+
+func (h *handler) createUploadf(w http.ResponseWriter, r *http.Request) {
+	if !share.CheckHandle(w, h.cachedir != "", http.StatusNotFound) {
+		return
+	}
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) || !checkPreconditions(w, r, p) {
+		return
+	}
+	length, ok := getHeaderNum(r.Header, headerUploadLength)
+	if !share.CheckBadReq(w, ok) ||
+		!share.CheckHandle(w, h.maxUploadSize <= 0 || length <= h.maxUploadSize,
+			http.StatusRequestEntityTooLarge) {
+		return
+	}
+	fi, err := os.Stat(p)
+	if !share.CheckHandle(w, err != nil || !fi.IsDir(), http.StatusNotFound) {
+		return
+	}
+	err = share.EnsureDir(path.Join(h.cachedir, uploadsDir))
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	share.Dolog(h.expireUploads)
+
+	id, err := newId()
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	u := &upload{Path: p, Length: length}
+	b, err := json.Marshal(u)
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	up := h.uploadPath(id)
+	err = ioutil.WriteFile(up+uploadInfoExt, b, 0600)
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	f, err := os.OpenFile(up, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if !share.CheckServerError(w, err == nil) {
+		h.removeUpload(id)
+		return
+	}
+	share.Doretlog42(f.Close)
+
+	w.Header().Set(headerLocation, (&url.URL{
+		Path:     r.URL.Path,
+		RawQuery: url.Values{uploadKey: []string{id}}.Encode()}).String())
+	writeUploadStatus(w, r, id, u, 0)
+}
+
+func (h *handler) uploadStatusf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	id, u, ok := h.checkUpload(w, r, qry)
+	if !ok {
+		return
+	}
+	fi, err := os.Lstat(h.uploadPath(id))
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	writeUploadStatus(w, r, id, u, fi.Size())
+}
+
+func (h *handler) uploadChunkf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	id, u, ok := h.checkUpload(w, r, qry)
+	if !ok || !checkPreconditions(w, r, u.Path) {
+		return
+	}
+	offset, ok := getHeaderNum(r.Header, headerUploadOffset)
+	if !share.CheckBadReq(w, ok) {
+		return
+	}
+	f, err := os.OpenFile(h.uploadPath(id), os.O_RDWR, 0)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	defer share.Doretlog42(f.Close)
+
+	// concurrent chunks of the same upload are rejected, also across processes
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if !share.CheckHandle(w, err != syscall.EWOULDBLOCK, http.StatusConflict) ||
+		!share.CheckServerError(w, err == nil) {
+		return
+	}
+	fi, err := f.Stat()
+	if !share.CheckOsError(w, err) ||
+		!share.CheckHandle(w, offset == fi.Size(), http.StatusConflict) {
+		return
+	}
+	_, err = f.Seek(offset, os.SEEK_SET)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+
+	// whatever was received is kept, even if the chunk failed, and the client can query the offset
+	count := u.Length - offset
+	if h.maxRequestBody > 0 && h.maxRequestBody < count {
+		count = h.maxRequestBody
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, count))
+	offset += n
+	w.Header().Set(headerUploadOffset, strconv.FormatInt(offset, 10))
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	if n == count {
+		_, err = io.ReadFull(r.Body, make([]byte, 1))
+		if !share.CheckHandle(w, err == io.EOF, http.StatusRequestEntityTooLarge) {
+			return
+		}
+	}
+	if offset < u.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ufi, err := h.finishUpload(f, u.Path, r)
+	if !share.CheckHandle(w, err != preconditionFailed, http.StatusPreconditionFailed) ||
+		!share.CheckOsError(w, err) {
+		return
+	}
+	h.removeUpload(id)
+	w.Header().Set(share.HeaderEtag, etag(ufi))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) cancelUploadf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	id, _, ok := h.checkUpload(w, r, qry)
+	if !ok {
+		return
+	}
+	h.removeUpload(id)
+}
@@ -0,0 +1,267 @@
+package htfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/aryszka/tasked/share"
+	tst "github.com/aryszka/tasked/testing"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func uploadReq(t *testing.T, method, url, body string, h map[string]string, clb func(rsp *http.Response)) {
+	r, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	tst.ErrFatal(t, err)
+	for k, v := range h {
+		r.Header.Set(k, v)
+	}
+	tst.Htreqr(t, r, clb)
+}
+
+func createUpload(t *testing.T, url, length string) (id string) {
+	uploadReq(t, "POST", url+"?cmd=upload", "", map[string]string{"Upload-Length": length},
+		func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatal(rsp.StatusCode)
+			}
+			var m map[string]interface{}
+			err := json.NewDecoder(rsp.Body).Decode(&m)
+			tst.ErrFatal(t, err)
+			id, _ = m["id"].(string)
+			if rsp.Header.Get("Location") != url[len(tst.S.URL):]+"?upload="+id ||
+				rsp.Header.Get("Upload-Offset") != "0" || rsp.Header.Get("Upload-Length") != length {
+				t.Fail()
+			}
+		})
+	return
+}
+
+func TestUploadDisabled(t *testing.T) {
+	ht := New(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	uploadReq(t, "POST", tst.S.URL+"/file?cmd=upload", "", map[string]string{"Upload-Length": "3"},
+		checkStatus(t, http.StatusNotFound))
+	uploadReq(t, "HEAD", tst.S.URL+"/file?upload=0123456789abcdef0123456789abcdef", "", nil,
+		checkStatus(t, http.StatusNotFound))
+}
+
+func TestCreateUpload(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, maxRequestBody: 4, maxUploadSize: 8})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "upload")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	url := tst.S.URL + "/upload/file"
+
+	// missing or invalid length
+	uploadReq(t, "POST", url+"?cmd=upload", "", nil, checkStatus(t, http.StatusBadRequest))
+	uploadReq(t, "POST", url+"?cmd=upload", "", map[string]string{"Upload-Length": "-1"},
+		checkStatus(t, http.StatusBadRequest))
+
+	// too large
+	uploadReq(t, "POST", url+"?cmd=upload", "", map[string]string{"Upload-Length": "9"},
+		checkStatus(t, http.StatusRequestEntityTooLarge))
+
+	// directory
+	uploadReq(t, "POST", tst.S.URL+"/upload?cmd=upload", "", map[string]string{"Upload-Length": "3"},
+		checkStatus(t, http.StatusNotFound))
+
+	// precondition
+	tst.WithNewFileF(t, path.Join(dir, "file"), nil)
+	uploadReq(t, "POST", url+"?cmd=upload", "", map[string]string{"Upload-Length": "3", "If-None-Match": "*"},
+		checkStatus(t, http.StatusPreconditionFailed))
+
+	// created
+	id := createUpload(t, url, "3")
+	if !idExp.MatchString(id) {
+		t.Fail()
+	}
+	uploadReq(t, "HEAD", url+"?upload="+id, "", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK ||
+			rsp.Header.Get("Upload-Offset") != "0" || rsp.Header.Get("Upload-Length") != "3" {
+			t.Fail()
+		}
+	})
+
+	// the request body limit applies only to the chunks
+	createUpload(t, url, "8")
+
+	// invalid id, other path
+	uploadReq(t, "HEAD", url+"?upload=invalid", "", nil, checkStatus(t, http.StatusBadRequest))
+	uploadReq(t, "HEAD", url+"0?upload="+id, "", nil, checkStatus(t, http.StatusNotFound))
+}
+
+func TestUploadChunks(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, maxRequestBody: 12})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "upload")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	p := path.Join(dir, "file")
+	url := tst.S.URL + "/upload/file"
+	tst.WithNewFileF(t, p, func(f *os.File) error {
+		_, err := f.Write([]byte("old content"))
+		return err
+	})
+	err := os.Chmod(p, 0640)
+	tst.ErrFatal(t, err)
+
+	id := createUpload(t, url, "12")
+	uurl := url + "?upload=" + id
+
+	// missing or wrong offset
+	uploadReq(t, "PATCH", uurl, "some", nil, checkStatus(t, http.StatusBadRequest))
+	uploadReq(t, "PATCH", uurl, "some", map[string]string{"Upload-Offset": "3"},
+		checkStatus(t, http.StatusConflict))
+
+	// other path
+	uploadReq(t, "PATCH", url+"0?upload="+id, "some", map[string]string{"Upload-Offset": "0"},
+		checkStatus(t, http.StatusNotFound))
+
+	// first chunk
+	uploadReq(t, "PATCH", uurl, "some ", map[string]string{"Upload-Offset": "0"}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusNoContent || rsp.Header.Get("Upload-Offset") != "5" {
+			t.Fail()
+		}
+	})
+	b, err := ioutil.ReadFile(p)
+	tst.ErrFatal(t, err)
+	if string(b) != "old content" {
+		t.Fail()
+	}
+
+	// chunk over the upload length, received part kept
+	uploadReq(t, "PATCH", uurl, "content and more", map[string]string{"Upload-Offset": "5"},
+		func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusRequestEntityTooLarge || rsp.Header.Get("Upload-Offset") != "12" {
+				t.Fail()
+			}
+		})
+	uploadReq(t, "HEAD", uurl, "", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Upload-Offset") != "12" {
+			t.Fail()
+		}
+	})
+	uploadReq(t, "PATCH", uurl, "", map[string]string{"Upload-Offset": "12"},
+		checkStatus(t, http.StatusNoContent))
+	b, err = ioutil.ReadFile(p)
+	tst.ErrFatal(t, err)
+	if string(b) != "some content" {
+		t.Fail()
+	}
+	err = os.Chmod(p, 0640)
+	tst.ErrFatal(t, err)
+
+	// last chunk completes
+	id = createUpload(t, url, "12")
+	uurl = url + "?upload=" + id
+	uploadReq(t, "PATCH", uurl, "some ", map[string]string{"Upload-Offset": "0"},
+		checkStatus(t, http.StatusNoContent))
+	uploadReq(t, "PATCH", uurl, "content", map[string]string{"Upload-Offset": "5"}, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusNoContent || rsp.Header.Get("Upload-Offset") != "12" {
+			t.Fail()
+		}
+		fi, err := os.Lstat(p)
+		tst.ErrFatal(t, err)
+		if fi.Mode() != os.FileMode(0640) || rsp.Header.Get(share.HeaderEtag) != etag(fi) {
+			t.Fail()
+		}
+	})
+	b, err = ioutil.ReadFile(p)
+	tst.ErrFatal(t, err)
+	if string(b) != "some content" {
+		t.Fail()
+	}
+	uploadReq(t, "HEAD", uurl, "", nil, checkStatus(t, http.StatusNotFound))
+	if _, err := os.Lstat(path.Join(cachedir, uploadsDir, id)); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	// empty upload
+	id = createUpload(t, tst.S.URL+"/upload/empty", "0")
+	uploadReq(t, "PATCH", tst.S.URL+"/upload/empty?upload="+id, "", map[string]string{"Upload-Offset": "0"},
+		checkStatus(t, http.StatusNoContent))
+	fi, err := os.Lstat(path.Join(dir, "empty"))
+	if err != nil || fi.Size() != 0 {
+		t.Fail()
+	}
+}
+
+func TestCancelUpload(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := path.Join(dn, "upload")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	url := tst.S.URL + "/upload/file"
+	id := createUpload(t, url, "12")
+	uploadReq(t, "PATCH", url+"?upload="+id, "some ", map[string]string{"Upload-Offset": "0"},
+		checkStatus(t, http.StatusNoContent))
+	uploadReq(t, "DELETE", url+"?upload="+id, "", nil, checkStatus(t, http.StatusOK))
+	uploadReq(t, "HEAD", url+"?upload="+id, "", nil, checkStatus(t, http.StatusNotFound))
+	for _, p := range []string{id, id + uploadInfoExt} {
+		if _, err := os.Lstat(path.Join(cachedir, uploadsDir, p)); !os.IsNotExist(err) {
+			t.Fail()
+		}
+	}
+	if _, err := os.Lstat(path.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestExpireUploads(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, uploadExpiry: 60})
+	tst.Thnd.Sh = ht.ServeHTTP
+	url := tst.S.URL + "/upload/file"
+	id0 := createUpload(t, url, "12")
+	id1 := createUpload(t, url, "12")
+	past := time.Now().Add(-2 * time.Minute)
+	err := os.Chtimes(path.Join(cachedir, uploadsDir, id0), past, past)
+	tst.ErrFatal(t, err)
+	err = os.Chtimes(path.Join(cachedir, uploadsDir, id1), past, past)
+	tst.ErrFatal(t, err)
+
+	// expired on access
+	uploadReq(t, "PATCH", url+"?upload="+id0, "some ", map[string]string{"Upload-Offset": "0"},
+		checkStatus(t, http.StatusNotFound))
+	if _, err := os.Lstat(path.Join(cachedir, uploadsDir, id0)); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	// expired on creating a new one
+	createUpload(t, url, "12")
+	if _, err := os.Lstat(path.Join(cachedir, uploadsDir, id1+uploadInfoExt)); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestFinishUpload(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir}).(*handler)
+	dir := path.Join(dn, "upload")
+	tst.RemoveIfExistsF(t, dir)
+	tst.EnsureDirF(t, dir)
+	up := path.Join(cachedir, "finish-upload")
+	tst.WithNewFileF(t, up, func(f *os.File) error {
+		_, err := f.Write([]byte("some content"))
+		return err
+	})
+	f, err := os.Open(up)
+	tst.ErrFatal(t, err)
+	defer f.Close()
+	p := path.Join(dir, "file")
+	_, err = ht.finishUpload(f, p, nil)
+	tst.ErrFatal(t, err)
+	fb, err := os.Open(p)
+	tst.ErrFatal(t, err)
+	defer fb.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(fb, 64))
+	tst.ErrFatal(t, err)
+	if string(b) != "some content" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,286 @@
+package htfile
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	versionKey            = "version"
+	versionsDir           = "versions"
+	inPlaceVersionsPeriod = time.Minute
+	inPlaceMarkerFile     = ".in-place"
+)
+
+var invalidVersionId = errors.New("Invalid version id.")
+
+type versionInfo struct {
+	Id      string `json:"id"`
+	Time    int64  `json:"time"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+}
+
+type byVersionId []os.FileInfo
+
+func (fis byVersionId) Len() int           { return len(fis) }
+func (fis byVersionId) Less(i, j int) bool { return fis[i].Name() < fis[j].Name() }
+func (fis byVersionId) Swap(i, j int)      { fis[i], fis[j] = fis[j], fis[i] }
+
+func (h *handler) versioningEnabled() bool {
+	return h.cachedir != "" && (h.maxVersions > 0 || h.versionExpiry > 0)
+}
+
+// the versions of a file are stored in a directory named by the hash of its path, with symlinks resolved
+func (h *handler) versionDir(p string) string {
+	return path.Join(h.cachedir, versionsDir, fmt.Sprintf("%x", sha256.Sum256([]byte(p))))
+}
+
+func resolvePath(p string) (string, error) {
+	fi, err := os.Lstat(p)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return p, nil
+	}
+	return filepath.EvalSymlinks(p)
+}
+
+func versionTime(id string) int64 {
+	ns, err := strconv.ParseInt(id[:16], 16, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Unix(0, ns).Unix()
+}
+
+func readVersions(dir string) ([]os.FileInfo, error) {
+	d, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fis, err := d.Readdir(0)
+	share.Doretlog42(d.Close)
+	if err != nil {
+		return nil, err
+	}
+	vfis := make([]os.FileInfo, 0, len(fis))
+	for _, fi := range fis {
+		if idExp.MatchString(fi.Name()) {
+			vfis = append(vfis, fi)
+		}
+	}
+	sort.Sort(byVersionId(vfis))
+	return vfis, nil
+}
+
+// keeps the maximum number of versions, and removes the expired ones
+func (h *handler) pruneVersions(dir string) error {
+	vfis, err := readVersions(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for i, fi := range vfis {
+		if (h.maxVersions <= 0 || len(vfis)-i <= h.maxVersions) &&
+			(h.versionExpiry <= 0 || now-versionTime(fi.Name()) <= int64(h.versionExpiry)) {
+			break
+		}
+		err = os.Remove(path.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// identifies the file modified in place. When the file is replaced, it changes.
+func inPlaceKey(fi os.FileInfo) string {
+	sstat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x", sstat.Dev, sstat.Ino)
+}
+
+// tells whether a version of the same file was saved before an in place write within
+// inPlaceVersionsPeriod
+func hasRecentInPlaceVersion(dir string, fi os.FileInfo) bool {
+	mp := path.Join(dir, inPlaceMarkerFile)
+	mfi, err := os.Lstat(mp)
+	if err != nil || time.Now().Sub(mfi.ModTime()) > inPlaceVersionsPeriod {
+		return false
+	}
+	b, err := ioutil.ReadFile(mp)
+	return err == nil && string(b) != "" && string(b) == inPlaceKey(fi)
+}
+
+// saves the current content of a file before it gets replaced or modified. The old file is linked, or,
+// when it is about to be modified in place, or the cachedir is on a different device, copied. Since the
+// in place writes copy the whole file, the subsequent writes to the same file are not versioned again
+// within inPlaceVersionsPeriod.
+func (h *handler) saveVersion(p string, inPlace bool) error {
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+	dir := h.versionDir(p)
+	if inPlace && hasRecentInPlaceVersion(dir, fi) {
+		return nil
+	}
+	err = share.EnsureDir(dir)
+	if err != nil {
+		return err
+	}
+	id, err := newTimeId(time.Now())
+	if err != nil {
+		return err
+	}
+	vp := path.Join(dir, id)
+	if !inPlace {
+		err = os.Link(p, vp)
+	}
+	if inPlace || isErrno(err, syscall.EXDEV) {
+		err = copyTreeOpts(p, vp, &copyOptions{times: true})
+	}
+	if err == nil && inPlace {
+		err = ioutil.WriteFile(path.Join(dir, inPlaceMarkerFile), []byte(inPlaceKey(fi)), 0600)
+	}
+	if err != nil {
+		return err
+	}
+	return h.pruneVersions(dir)
+}
+
+func getVersionId(qry url.Values) (string, error) {
+	ids := qry[versionKey]
+	if len(ids) != 1 || !idExp.MatchString(ids[0]) {
+		return "", invalidVersionId
+	}
+	return ids[0], nil
+}
+
+func (h *handler) checkVersions(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !share.CheckHandle(w, h.versioningEnabled(), http.StatusNotFound) {
+		return "", false
+	}
+	p, err := h.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return "", false
+	}
+	p, err = resolvePath(p)
+	if !share.CheckOsError(w, err) {
+		return "", false
+	}
+	return p, true
+}
+
+func (h *handler) openVersion(w http.ResponseWriter, p string, qry url.Values) (*os.File, bool) {
+	id, err := getVersionId(qry)
+	if !share.CheckBadReq(w, err == nil) {
+		return nil, false
+	}
+	f, err := os.Open(path.Join(h.versionDir(p), id))
+	if !share.CheckOsError(w, err) {
+		return nil, false
+	}
+	return f, true
+}
+
+// lists the previous versions of a file, the oldest first
+func (h *handler) versionsf(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.checkVersions(w, r)
+	if !ok {
+		return
+	}
+	share.Dolog(func() error { return h.pruneVersions(h.versionDir(p)) })
+	vfis, err := readVersions(h.versionDir(p))
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	vs := make([]*versionInfo, len(vfis))
+	for i, fi := range vfis {
+		vs[i] = &versionInfo{
+			Id:      fi.Name(),
+			Time:    versionTime(fi.Name()),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().Unix()}
+	}
+	_, err = share.WriteJsonResponse(w, r, vs)
+	share.CheckServerError(w, err != share.MarshalError)
+}
+
+func (h *handler) getVersionf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	p, ok := h.checkVersions(w, r)
+	if !ok {
+		return
+	}
+	f, ok := h.openVersion(w, p, qry)
+	if !ok {
+		return
+	}
+	defer share.Doretlog42(f.Close)
+	fi, err := f.Stat()
+	if !share.CheckOsError(w, err) {
+		return
+	}
+
+	// the content type is detected by the name of the current file
+	ct, err := h.contentType(path.Base(p), f)
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	header := w.Header()
+	header.Set(share.HeaderContentType, ct)
+	header.Set(share.HeaderEtag, etag(fi))
+	http.ServeContent(w, r, path.Base(p), fi.ModTime(), f)
+}
+
+// restores a version by replacing the current content, which is saved as a new version
+func (h *handler) restoreVersionf(w http.ResponseWriter, r *http.Request, qry url.Values) {
+	p, ok := h.checkVersions(w, r)
+	if !ok || !checkPreconditions(w, r, p) {
+		return
+	}
+	vf, ok := h.openVersion(w, p, qry)
+	if !ok {
+		return
+	}
+	defer share.Doretlog42(vf.Close)
+	p, fi, err := prepareTarget(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	if fi == nil {
+		fi, err = vf.Stat()
+		if !share.CheckOsError(w, err) {
+			return
+		}
+	}
+	tfi, err := h.replaceFile(p, fi, r, func(f *os.File) error {
+		_, err := io.Copy(f, vf)
+		return err
+	})
+	if !share.CheckHandle(w, err != preconditionFailed, http.StatusPreconditionFailed) ||
+		!share.CheckOsError(w, err) {
+		return
+	}
+	w.Header().Set(share.HeaderEtag, etag(tfi))
+}
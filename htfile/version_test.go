@@ -0,0 +1,207 @@
+package htfile
+
+import (
+	"bytes"
+	"encoding/json"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func initVersions(t *testing.T) string {
+	return initTestDir(t, "versions", nil, versionsDir)
+}
+
+func putVersion(t *testing.T, url, content string) {
+	tst.Htreq(t, "PUT", url, bytes.NewBufferString(content), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+	})
+}
+
+func listVersions(t *testing.T, url string) []*versionInfo {
+	var vs []*versionInfo
+	tst.Htreq(t, "GET", url+"?cmd=versions", nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		err := json.NewDecoder(rsp.Body).Decode(&vs)
+		tst.ErrFatal(t, err)
+	})
+	return vs
+}
+
+func getVersion(t *testing.T, url, id string) string {
+	var content string
+	tst.Htreq(t, "GET", url+"?version="+id, nil, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+		b, err := ioutil.ReadAll(rsp.Body)
+		tst.ErrFatal(t, err)
+		content = string(b)
+	})
+	return content
+}
+
+func TestVersionsDisabled(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxVersions: 3})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initVersions(t)
+	url := tst.S.URL + "/versions/file"
+	putVersion(t, url, "content0")
+	putVersion(t, url, "content1")
+	expectStatus(t, "GET", "/versions/file?cmd=versions", http.StatusNotFound)
+	expectStatus(t, "GET", "/versions/file?version=0123456789abcdef0123456789abcdef", http.StatusNotFound)
+}
+
+func TestVersions(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, maxVersions: 2})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initVersions(t)
+	url := tst.S.URL + "/versions/file"
+	if len(listVersions(t, url)) != 0 {
+		t.Fail()
+	}
+	putVersion(t, url, "content0")
+	if len(listVersions(t, url)) != 0 {
+		t.Fail()
+	}
+	putVersion(t, url, "content01")
+	putVersion(t, url, "content012")
+	vs := listVersions(t, url)
+	if len(vs) != 2 || vs[0].Size != 8 || vs[1].Size != 9 ||
+		vs[0].Time > time.Now().Unix() || vs[0].Id >= vs[1].Id {
+		t.Fail()
+	}
+	if getVersion(t, url, vs[0].Id) != "content0" || getVersion(t, url, vs[1].Id) != "content01" {
+		t.Fail()
+	}
+	checkFileContent(t, path.Join(dir, "file"), "content012")
+
+	// the oldest dropped
+	putVersion(t, url, "content0123")
+	nvs := listVersions(t, url)
+	if len(nvs) != 2 || nvs[0].Id != vs[1].Id {
+		t.Fail()
+	}
+
+	expectStatus(t, "GET", "/versions/file?version=invalid", http.StatusBadRequest)
+	expectStatus(t, "GET", "/versions/file?version="+vs[0].Id, http.StatusNotFound)
+	expectStatus(t, "GET", "/versions/other?version="+nvs[0].Id, http.StatusNotFound)
+}
+
+func TestVersionInPlaceWrites(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, maxVersions: 5})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initVersions(t)
+	url := tst.S.URL + "/versions/file"
+
+	// appending doesn't create a version
+	tst.Htreq(t, "POST", url+"?cmd=append", bytes.NewBufferString("content0"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+	})
+	if len(listVersions(t, url)) != 0 {
+		t.Fail()
+	}
+
+	tst.Htreq(t, "POST", url+"?cmd=append", bytes.NewBufferString("1"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fatal(rsp.StatusCode)
+		}
+	})
+	if len(listVersions(t, url)) != 0 {
+		t.Fail()
+	}
+
+	// overwriting does, but only once in a period
+	writeRange := func(content, rng string) {
+		r, err := http.NewRequest("PATCH", url, bytes.NewBufferString(content))
+		tst.ErrFatal(t, err)
+		r.Header.Set("Content-Range", rng)
+		tst.Htreqr(t, r, func(rsp *http.Response) {
+			if rsp.StatusCode != http.StatusOK {
+				t.Fatal(rsp.StatusCode)
+			}
+		})
+	}
+	writeRange("C", "bytes 0-0/*")
+	writeRange("O", "bytes 1-1/*")
+	checkFileContent(t, path.Join(dir, "file"), "COntent01")
+	vs := listVersions(t, url)
+	if len(vs) != 1 || getVersion(t, url, vs[0].Id) != "content01" {
+		t.Fail()
+	}
+
+	// but again after the file was replaced
+	putVersion(t, url, "content2")
+	writeRange("C", "bytes 0-0/*")
+	vs = listVersions(t, url)
+	if len(vs) != 3 || getVersion(t, url, vs[2].Id) != "content2" {
+		t.Fail()
+	}
+}
+
+func TestVersionExpiry(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, versionExpiry: 60})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initVersions(t)
+	url := tst.S.URL + "/versions/file"
+	putVersion(t, url, "content0")
+	putVersion(t, url, "content1")
+	vs := listVersions(t, url)
+	if len(vs) != 1 {
+		t.Fatal()
+	}
+
+	// renamed to an id two minutes older
+	vdir := ht.(*handler).versionDir(path.Join(dn, "versions/file"))
+	id, err := newTimeId(time.Now().Add(-2 * time.Minute))
+	tst.ErrFatal(t, err)
+	err = os.Rename(path.Join(vdir, vs[0].Id), path.Join(vdir, id))
+	tst.ErrFatal(t, err)
+	if len(listVersions(t, url)) != 0 {
+		t.Fail()
+	}
+}
+
+func TestRestoreVersion(t *testing.T) {
+	ht := New(&testOptions{root: dn, cachedir: cachedir, maxVersions: 5})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initVersions(t)
+	url := tst.S.URL + "/versions/file"
+	putVersion(t, url, "content0")
+	putVersion(t, url, "content1")
+	vs := listVersions(t, url)
+	expectStatus(t, "POST", "/versions/file?cmd=restore&version=invalid", http.StatusBadRequest)
+	r, err := http.NewRequest("POST", url+"?cmd=restore&version="+vs[0].Id, nil)
+	tst.ErrFatal(t, err)
+	r.Header.Set("If-Match", `"not-matching"`)
+	tst.Htreqr(t, r, func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusPreconditionFailed {
+			t.Fail()
+		}
+	})
+
+	expectStatus(t, "POST", "/versions/file?cmd=restore&version="+vs[0].Id, http.StatusOK)
+	checkFileContent(t, path.Join(dir, "file"), "content0")
+
+	// the replaced content saved as a version
+	vs = listVersions(t, url)
+	if len(vs) != 2 || getVersion(t, url, vs[1].Id) != "content1" {
+		t.Fail()
+	}
+
+	// restoring a deleted file
+	err = os.Remove(path.Join(dir, "file"))
+	tst.ErrFatal(t, err)
+	expectStatus(t, "POST", "/versions/file?cmd=restore&version="+vs[1].Id, http.StatusOK)
+	checkFileContent(t, path.Join(dir, "file"), "content1")
+}
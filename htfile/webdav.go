@@ -0,0 +1,739 @@
+package htfile
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/aryszka/tasked/share"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	davNs          = "DAV:"
+	taskedNs       = "urn:x-tasked:"
+	xmlContentType = "application/xml; charset=utf-8"
+	xmlHeader      = `<?xml version="1.0" encoding="utf-8"?>` + "\n"
+	davMethods     = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK"
+	supportedLock  = "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+		"<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>"
+)
+
+// serves the same root as the native handler, over the WebDAV protocol (RFC 4918, class 1 and 2). The
+// dead properties are not supported, only the live ones, and the mode, owner and group in the tasked
+// namespace.
+type davHandler struct {
+	*handler
+}
+
+type davProp struct {
+	name  xml.Name
+	value string
+}
+
+type davPropNames struct {
+	Props []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+type davPropfind struct {
+	XMLName  xml.Name      `xml:"DAV: propfind"`
+	Propname *struct{}     `xml:"DAV: propname"`
+	Prop     *davPropNames `xml:"DAV: prop"`
+}
+
+type davPropValues struct {
+	Props []struct {
+		XMLName xml.Name
+		Value   string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+type davPropertyupdate struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Set     []struct {
+		Prop davPropValues `xml:"DAV: prop"`
+	} `xml:"DAV: set"`
+	Remove []struct {
+		Prop davPropValues `xml:"DAV: prop"`
+	} `xml:"DAV: remove"`
+}
+
+type davLockinfo struct {
+	XMLName   xml.Name `xml:"DAV: lockinfo"`
+	Lockscope struct {
+		Shared *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+}
+
+// sets the status of successful responses, when the wrapped handler doesn't set it
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+var (
+	headerDestination = http.CanonicalHeaderKey("destination")
+	headerOverwrite   = http.CanonicalHeaderKey("overwrite")
+	headerDav         = http.CanonicalHeaderKey("dav")
+	headerAllow       = http.CanonicalHeaderKey("allow")
+	invalidDest       = errors.New("Invalid destination.")
+	foreignDest       = errors.New("Destination on another server.")
+)
+
+func davName(local string) xml.Name    { return xml.Name{Space: davNs, Local: local} }
+func taskedName(local string) xml.Name { return xml.Name{Space: taskedNs, Local: local} }
+
+func NewWebdav(o Options) http.Handler {
+	return &davHandler{New(o).(*handler)}
+}
+
+func (sw *statusWriter) WriteHeader(s int) {
+	sw.written = true
+	sw.ResponseWriter.WriteHeader(s)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if !sw.written {
+		sw.WriteHeader(sw.status)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) finish() {
+	if !sw.written {
+		sw.WriteHeader(sw.status)
+	}
+}
+
+// reads an XML request body. Returns false, when the body is empty.
+func readXmlRequest(r *http.Request, v interface{}, maxBody int64) (bool, error) {
+	var rr io.Reader = r.Body
+	var mr *share.MaxReader
+	if maxBody > 0 {
+		mr = &share.MaxReader{Reader: rr, Count: maxBody}
+		rr = mr
+	}
+	err := xml.NewDecoder(rr).Decode(v)
+	if err == io.EOF {
+		return false, nil
+	}
+	if mr != nil && mr.Count <= 0 {
+		return true, share.RequestBodyTooLarge
+	}
+	return true, err
+}
+
+func checkXmlRequest(w http.ResponseWriter, r *http.Request, v interface{}, maxBody int64) (bool, bool) {
+	found, err := readXmlRequest(r, v, maxBody)
+	return found, share.CheckHandle(w, err != share.RequestBodyTooLarge, http.StatusRequestEntityTooLarge) &&
+		share.CheckBadReq(w, err == nil)
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func davHref(p string, dir bool) string {
+	if dir && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return xmlEscape((&url.URL{Path: p}).EscapedPath())
+}
+
+func davStatus(s int) string {
+	return fmt.Sprintf("<D:status>HTTP/1.1 %d %s</D:status>", s, http.StatusText(s))
+}
+
+func writeDavProp(b *bytes.Buffer, pr davProp, nameOnly bool) {
+	name := "D:" + pr.name.Local
+	if pr.name.Space != davNs {
+		name = "x:" + pr.name.Local
+		b.WriteString(fmt.Sprintf(`<%s xmlns:x="%s"`, name, xmlEscape(pr.name.Space)))
+	} else {
+		b.WriteString("<" + name)
+	}
+	if nameOnly || pr.value == "" {
+		b.WriteString("/>")
+		return
+	}
+	b.WriteString(">" + pr.value + "</" + name + ">")
+}
+
+func writePropstat(b *bytes.Buffer, props []davProp, status int, nameOnly bool) {
+	b.WriteString("<D:propstat><D:prop>")
+	for _, pr := range props {
+		writeDavProp(b, pr, nameOnly)
+	}
+	b.WriteString("</D:prop>" + davStatus(status) + "</D:propstat>")
+}
+
+func writeMultistatus(w http.ResponseWriter, body *bytes.Buffer) {
+	h := w.Header()
+	h.Set(share.HeaderContentType, xmlContentType)
+	h.Set(share.HeaderContentLength, strconv.Itoa(len(xmlHeader)+body.Len()+
+		len(`<D:multistatus xmlns:D="DAV:"></D:multistatus>`)))
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xmlHeader+`<D:multistatus xmlns:D="DAV:">`)
+	body.WriteTo(w)
+	io.WriteString(w, "</D:multistatus>")
+}
+
+func activeLock(l *lock) string {
+	timeout := l.Expires - time.Now().Unix()
+	if timeout < 0 {
+		timeout = 0
+	}
+	return fmt.Sprintf("<D:activelock><D:locktype><D:write/></D:locktype>"+
+		"<D:lockscope><D:%s/></D:lockscope><D:depth>%s</D:depth><D:owner>%s</D:owner>"+
+		"<D:timeout>Second-%d</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken>"+
+		"<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>",
+		l.Scope, l.Depth, xmlEscape(l.Owner),
+		timeout, xmlEscape(l.Token), davHref(l.Path, false))
+}
+
+// the path of the destination header, relative to the root
+func destinationPath(r *http.Request) (string, error) {
+	d := r.Header.Get(headerDestination)
+	if d == "" {
+		return "", invalidDest
+	}
+	u, err := url.Parse(d)
+	if err != nil {
+		return "", invalidDest
+	}
+	if u.Host != "" && u.Host != r.Host {
+		return "", foreignDest
+	}
+	return path.Clean("/" + u.Path), nil
+}
+
+func (d *davHandler) davProps(p, rp string, fi os.FileInfo, own bool, locks []*lock) []davProp {
+	props := []davProp{
+		{davName("displayname"), xmlEscape(fi.Name())},
+		{davName("getlastmodified"), fi.ModTime().UTC().Format(http.TimeFormat)},
+		{davName("getetag"), xmlEscape(etag(fi))}}
+	if fi.IsDir() {
+		props = append(props, davProp{davName("resourcetype"), "<D:collection/>"})
+	} else {
+		props = append(props,
+			davProp{davName("resourcetype"), ""},
+			davProp{davName("getcontentlength"), strconv.FormatInt(fi.Size(), 10)})
+		if f, err := os.Open(p); err == nil {
+			if ct, err := d.contentType(fi.Name(), f); err == nil {
+				props = append(props, davProp{davName("getcontenttype"), xmlEscape(ct)})
+			}
+			share.Doretlog42(f.Close)
+		}
+	}
+	if d.cachedir != "" {
+		var al string
+		for _, l := range locks {
+			if l.covers(rp) {
+				al += activeLock(l)
+			}
+		}
+		props = append(props,
+			davProp{davName("supportedlock"), supportedLock},
+			davProp{davName("lockdiscovery"), al})
+	}
+	if own {
+		props = append(props, davProp{taskedName("mode"), fmt.Sprintf("%04o", uint32(replaceMode(0, fi.Mode())))})
+		pm := toPropertyMap(fi, true)
+		for _, k := range []string{"user", "group"} {
+			if v, ok := pm[k].(string); ok {
+				props = append(props, davProp{taskedName(k), xmlEscape(v)})
+			}
+		}
+	}
+	return props
+}
+
+func (d *davHandler) writePropfindResponse(b *bytes.Buffer, p, rp string, fi os.FileInfo,
+	u *user.User, pf *davPropfind, locks []*lock) error {
+	own, err := isOwner(u, fi)
+	if err != nil {
+		return err
+	}
+	props := d.davProps(p, rp, fi, own, locks)
+	b.WriteString("<D:response><D:href>" + davHref(rp, fi.IsDir()) + "</D:href>")
+	switch {
+	case pf.Propname != nil:
+		writePropstat(b, props, http.StatusOK, true)
+	case pf.Prop != nil:
+		var found, missing []davProp
+		for _, n := range pf.Prop.Props {
+			var pr *davProp
+			for i := range props {
+				if props[i].name == n.XMLName {
+					pr = &props[i]
+					break
+				}
+			}
+			if pr == nil {
+				missing = append(missing, davProp{name: n.XMLName})
+			} else {
+				found = append(found, *pr)
+			}
+		}
+		if len(found) > 0 || len(missing) == 0 {
+			writePropstat(b, found, http.StatusOK, false)
+		}
+		if len(missing) > 0 {
+			writePropstat(b, missing, http.StatusNotFound, false)
+		}
+	default:
+		writePropstat(b, props, http.StatusOK, false)
+	}
+	b.WriteString("</D:response>")
+	return nil
+}
+
+func (d *davHandler) davOptions(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	header.Set(headerDav, "1, 2")
+	header.Set(headerAllow, davMethods)
+	header.Set("MS-Author-Via", "DAV")
+}
+
+func (d *davHandler) davPut(w http.ResponseWriter, r *http.Request) {
+	p, err := d.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	fi, err := os.Stat(path.Dir(p))
+	if !share.CheckHandle(w, err == nil && fi.IsDir(), http.StatusConflict) {
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusNoContent}
+	if _, err = os.Lstat(p); os.IsNotExist(err) {
+		sw.status = http.StatusCreated
+	}
+	d.putf(sw, r)
+	sw.finish()
+}
+
+func (d *davHandler) davDelete(w http.ResponseWriter, r *http.Request) {
+	p, err := d.getLinkPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) ||
+		!share.CheckHandle(w, p != d.dn, http.StatusForbidden) {
+		return
+	}
+	_, err = os.Lstat(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	if d.trashEnabled() {
+		d.deletef(w, r)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusNoContent}
+	d.deletef(sw, r)
+	sw.finish()
+}
+
+func (d *davHandler) propfind(w http.ResponseWriter, r *http.Request) {
+	p, err := d.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+
+	// infinite depth is not supported
+	depth := strings.ToLower(r.Header.Get(headerDepth))
+	if !share.CheckHandle(w, depth != "" && depth != depthInfinity, http.StatusForbidden) ||
+		!share.CheckBadReq(w, depth == "0" || depth == "1") {
+		return
+	}
+	pf := new(davPropfind)
+	if _, ok := checkXmlRequest(w, r, pf, d.maxRequestBody); !ok {
+		return
+	}
+	fi, err := d.statLink(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	u, err := user.Current()
+	if !share.CheckServerError(w, u != nil && err == nil) {
+		return
+	}
+	var locks []*lock
+	if d.cachedir != "" {
+		locks, err = d.readLocks()
+		if !share.CheckServerError(w, err == nil) {
+			return
+		}
+	}
+	var b bytes.Buffer
+	rp := path.Clean("/" + r.URL.Path)
+	err = d.writePropfindResponse(&b, p, rp, fi, u, pf, locks)
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+	if depth == "1" && fi.IsDir() {
+		fis, err := ioutil.ReadDir(p)
+		if !share.CheckOsError(w, err) {
+			return
+		}
+		for _, fii := range fis {
+			cp := path.Join(p, fii.Name())
+			if fii.Mode()&os.ModeSymlink != 0 {
+				fii, err = d.statLink(cp)
+				if err != nil {
+					continue
+				}
+			}
+			err = d.writePropfindResponse(&b, cp, path.Join(rp, fii.Name()), fii, u, pf, locks)
+			if !share.CheckServerError(w, err == nil) {
+				return
+			}
+		}
+	}
+	writeMultistatus(w, &b)
+}
+
+// the changes are applied all or none. The live properties in the DAV namespace are protected.
+func (d *davHandler) proppatch(w http.ResponseWriter, r *http.Request) {
+	p, err := d.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) || !checkPreconditions(w, r, p) {
+		return
+	}
+	pu := new(davPropertyupdate)
+	found, ok := checkXmlRequest(w, r, pu, d.maxRequestBody)
+	if !ok || !share.CheckBadReq(w, found) {
+		return
+	}
+	fi, err := os.Lstat(p)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	u, err := user.Current()
+	if !share.CheckServerError(w, u != nil && err == nil) {
+		return
+	}
+	own, err := isOwner(u, fi)
+	if !share.CheckServerError(w, err == nil) {
+		return
+	}
+
+	var (
+		props    []davProp
+		statuses []int
+		failed   bool
+	)
+	mode := int64(-1)
+	owner := ""
+	group := ""
+	for _, s := range pu.Set {
+		for _, pv := range s.Prop.Props {
+			status := http.StatusOK
+			switch {
+			case !own:
+				status = http.StatusForbidden
+			case pv.XMLName == taskedName("mode"):
+				m, err := strconv.ParseInt(strings.TrimSpace(pv.Value), 8, 64)
+				if err != nil || m < 0 {
+					status = http.StatusConflict
+				}
+				mode = m
+			case pv.XMLName == taskedName("user"):
+				owner = strings.TrimSpace(pv.Value)
+			case pv.XMLName == taskedName("group"):
+				group = strings.TrimSpace(pv.Value)
+			default:
+				status = http.StatusForbidden
+			}
+			failed = failed || status != http.StatusOK
+			props = append(props, davProp{name: pv.XMLName})
+			statuses = append(statuses, status)
+		}
+	}
+	for _, rm := range pu.Remove {
+		for _, pv := range rm.Prop.Props {
+			failed = true
+			props = append(props, davProp{name: pv.XMLName})
+			statuses = append(statuses, http.StatusForbidden)
+		}
+	}
+	if !failed {
+		err = applyProps(p, fi, mode, owner, group)
+		failed = err != nil
+		for i := range statuses {
+			if failed {
+				statuses[i] = http.StatusConflict
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("<D:response><D:href>" + davHref(path.Clean("/"+r.URL.Path), fi.IsDir()) + "</D:href>")
+	byStatus := make(map[int][]davProp)
+	var order []int
+	for i, s := range statuses {
+		if failed && s == http.StatusOK {
+			s = http.StatusFailedDependency
+		}
+		if _, ok := byStatus[s]; !ok {
+			order = append(order, s)
+		}
+		byStatus[s] = append(byStatus[s], props[i])
+	}
+	for _, s := range order {
+		writePropstat(&b, byStatus[s], s, false)
+	}
+	b.WriteString("</D:response>")
+	writeMultistatus(w, &b)
+}
+
+func (d *davHandler) mkcol(w http.ResponseWriter, r *http.Request) {
+	p, err := d.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) ||
+		!share.CheckHandle(w, r.ContentLength <= 0, http.StatusUnsupportedMediaType) {
+		return
+	}
+	_, err = os.Lstat(p)
+	if !share.CheckHandle(w, os.IsNotExist(err), http.StatusMethodNotAllowed) {
+		return
+	}
+	fi, err := os.Stat(path.Dir(p))
+	if !share.CheckHandle(w, err == nil && fi.IsDir(), http.StatusConflict) {
+		return
+	}
+	err = os.Mkdir(p, os.ModePerm)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// writes the copy or the moved source to a temporary path next to the destination, and renames it in place
+// only when complete, so that a failure leaves an existing destination intact. The replaced destination is
+// moved to the trash, when enabled. A replaced directory is moved aside first, because it cannot be renamed
+// over. On failure, revert is called with the temporary path.
+func (d *davHandler) replaceDest(to, rto string, write, revert func(string) error) error {
+	tmp, err := tempPath(to)
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err != nil {
+		share.Doretlog42(func() error { return os.RemoveAll(tmp) })
+		return err
+	}
+	var aside string
+	fi, err := os.Lstat(to)
+	switch {
+	case os.IsNotExist(err):
+		err = nil
+	case err != nil:
+	case d.trashEnabled():
+		_, err = d.moveToTrash(to, rto, fi)
+	case fi.IsDir():
+		aside, err = tempPath(to)
+		if err == nil {
+			err = os.Rename(to, aside)
+		}
+		if err != nil {
+			aside = ""
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, to)
+	}
+	if err != nil {
+		if aside != "" {
+			share.Doretlog42(func() error { return os.Rename(aside, to) })
+		}
+		share.Doretlog42(func() error { return revert(tmp) })
+		return err
+	}
+	if aside != "" {
+		share.Doretlog42(func() error { return os.RemoveAll(aside) })
+	}
+	return nil
+}
+
+// copies or moves to the destination header. An existing destination is replaced, unless the overwrite
+// header is F.
+func (d *davHandler) copyMove(w http.ResponseWriter, r *http.Request, move bool) {
+	from, err := d.getLinkPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	rto, err := destinationPath(r)
+	if !share.CheckHandle(w, err != foreignDest, http.StatusBadGateway) || !share.CheckBadReq(w, err == nil) {
+		return
+	}
+	to, err := d.getPath(rto)
+	if !share.CheckHandle(w, err == nil, http.StatusForbidden) ||
+		!share.CheckHandle(w, from != to, http.StatusForbidden) ||
+		!share.CheckBadReq(w, pathIntersect(from, to) == noMatch && from != d.dn) {
+		return
+	}
+	overwrite := r.Header.Get(headerOverwrite)
+	depth := strings.ToLower(r.Header.Get(headerDepth))
+	if !share.CheckBadReq(w, overwrite == "" || overwrite == "T" || overwrite == "F") ||
+		!share.CheckBadReq(w, depth == "" || depth == depthInfinity || !move && depth == depthZero) {
+		return
+	}
+	if move && !checkPreconditions(w, r, from) {
+		return
+	}
+	fi, err := os.Lstat(from)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	pfi, err := os.Stat(path.Dir(to))
+	if !share.CheckHandle(w, err == nil && pfi.IsDir(), http.StatusConflict) {
+		return
+	}
+	_, err = os.Lstat(to)
+	exists := err == nil
+	if !share.CheckHandle(w, !exists || overwrite != "F", http.StatusPreconditionFailed) {
+		return
+	}
+	write := func(tmp string) error { return d.copyTree(from, tmp) }
+	revert := func(tmp string) error { return os.RemoveAll(tmp) }
+	switch {
+	case move:
+		write = func(tmp string) error { return moveTree(from, tmp) }
+		revert = func(tmp string) error { return moveTree(tmp, from) }
+	case fi.IsDir() && depth == depthZero:
+		write = func(tmp string) error { return os.Mkdir(tmp, fi.Mode().Perm()) }
+	}
+	err = d.replaceDest(to, rto, write, revert)
+	if !share.CheckOsError(w, err) {
+		return
+	}
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// locking a not existing path creates an empty file. The request without a body refreshes a lock.
+func (d *davHandler) davLock(w http.ResponseWriter, r *http.Request) {
+	if !share.CheckHandle(w, d.cachedir != "", http.StatusMethodNotAllowed) {
+		return
+	}
+	p, err := d.getPath(r.URL.Path)
+	if !share.CheckHandle(w, err == nil, http.StatusNotFound) {
+		return
+	}
+	li := new(davLockinfo)
+	found, ok := checkXmlRequest(w, r, li, d.maxRequestBody)
+	if !ok || !share.CheckBadReq(w, found || len(parseIfTokens(r.Header.Get(headerIf))) > 0) {
+		return
+	}
+	scope := scopeExclusive
+	if li.Lockscope.Shared != nil {
+		scope = scopeShared
+	}
+	_, err = os.Lstat(p)
+	create := os.IsNotExist(err)
+	if create {
+		fi, err := os.Stat(path.Dir(p))
+		if !share.CheckHandle(w, err == nil && fi.IsDir(), http.StatusConflict) {
+			return
+		}
+	}
+	l, ok := d.acquireLock(w, r, scope)
+	if !ok {
+		return
+	}
+	status := http.StatusOK
+	if create {
+		f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			share.Doretlog42(f.Close)
+			status = http.StatusCreated
+		} else if !os.IsExist(err) {
+			share.CheckOsError(w, err)
+			return
+		}
+	}
+	body := xmlHeader + `<D:prop xmlns:D="DAV:"><D:lockdiscovery>` + activeLock(l) + "</D:lockdiscovery></D:prop>"
+	h := w.Header()
+	h.Set(share.HeaderContentType, xmlContentType)
+	h.Set(share.HeaderContentLength, strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
+
+// returns the paths modified by a request, and whether the modification is deep
+func davChangedPaths(r *http.Request) ([]string, bool) {
+	rp := path.Clean("/" + r.URL.Path)
+	switch r.Method {
+	case "PUT", "DELETE", "MKCOL":
+		return []string{rp}, true
+	case "PROPPATCH":
+		return []string{rp}, false
+	case "COPY", "MOVE":
+		var ps []string
+		if r.Method == "MOVE" {
+			ps = append(ps, rp)
+		}
+		if to, err := destinationPath(r); err == nil {
+			ps = append(ps, to)
+		}
+		return ps, true
+	default:
+		return nil, false
+	}
+}
+
+func (d *davHandler) checkDavLocks(w http.ResponseWriter, r *http.Request) bool {
+	ps, deep := davChangedPaths(r)
+	return d.checkPathLocks(w, r, ps, deep)
+}
+
+func (d *davHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w, done := d.compressResponse(w, r)
+	defer done()
+	if !d.checkDavLocks(w, r) {
+		return
+	}
+	if d.index != nil || d.du != nil {
+		ps, _ := davChangedPaths(r)
+		defer d.pathsChanged(ps)
+	}
+	switch r.Method {
+	case "OPTIONS":
+		d.davOptions(w, r)
+	case "GET", "HEAD":
+		d.get(w, r)
+	case "PUT":
+		d.davPut(w, r)
+	case "DELETE":
+		d.davDelete(w, r)
+	case "PROPFIND":
+		d.propfind(w, r)
+	case "PROPPATCH":
+		d.proppatch(w, r)
+	case "MKCOL":
+		d.mkcol(w, r)
+	case "COPY":
+		d.copyMove(w, r, false)
+	case "MOVE":
+		d.copyMove(w, r, true)
+	case "LOCK":
+		d.davLock(w, r)
+	case "UNLOCK":
+		d.unlockf(w, r, nil)
+	default:
+		share.ErrorResponse(w, http.StatusMethodNotAllowed)
+	}
+}
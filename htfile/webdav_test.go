@@ -0,0 +1,315 @@
+package htfile
+
+import (
+	"bytes"
+	"encoding/xml"
+	tst "github.com/aryszka/tasked/testing"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type testMultistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Props  struct {
+				Props []struct {
+					XMLName xml.Name
+					Value   string `xml:",innerxml"`
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+func initWebdav(t *testing.T) string {
+	return initTestDir(t, "webdav", map[string]string{"file.txt": "content", "sub/file": "content"}, locksDir)
+}
+
+func davReq(t *testing.T, method, url string, header map[string]string, body string) (*http.Response, []byte) {
+	r, err := http.NewRequest(method, tst.S.URL+url, bytes.NewBufferString(body))
+	tst.ErrFatal(t, err)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	var (
+		rsp *http.Response
+		b   []byte
+	)
+	tst.Htreqr(t, r, func(r *http.Response) {
+		rsp = r
+		b, err = ioutil.ReadAll(r.Body)
+		tst.ErrFatal(t, err)
+	})
+	return rsp, b
+}
+
+func expectDavStatus(t *testing.T, method, url string, header map[string]string, body string, s int) {
+	rsp, _ := davReq(t, method, url, header, body)
+	if rsp.StatusCode != s {
+		t.Log(method, url, rsp.StatusCode)
+		t.Fail()
+	}
+}
+
+func propfind(t *testing.T, url, depth, body string) *testMultistatus {
+	rsp, b := davReq(t, "PROPFIND", url, map[string]string{"Depth": depth}, body)
+	if rsp.StatusCode != http.StatusMultiStatus {
+		t.Fatal(rsp.StatusCode)
+	}
+	ms := new(testMultistatus)
+	err := xml.Unmarshal(b, ms)
+	tst.ErrFatal(t, err)
+	return ms
+}
+
+func TestWebdavOptions(t *testing.T) {
+	ht := NewWebdav(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initWebdav(t)
+	rsp, _ := davReq(t, "OPTIONS", "/webdav", nil, "")
+	if rsp.StatusCode != http.StatusOK || rsp.Header.Get("Dav") != "1, 2" ||
+		!strings.Contains(rsp.Header.Get("Allow"), "PROPFIND") {
+		t.Fail()
+	}
+	expectDavStatus(t, "PROPS", "/webdav", nil, "", http.StatusMethodNotAllowed)
+}
+
+func TestWebdavPropfind(t *testing.T) {
+	ht := NewWebdav(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	initWebdav(t)
+	expectDavStatus(t, "PROPFIND", "/webdav", nil, "", http.StatusForbidden)
+	expectDavStatus(t, "PROPFIND", "/webdav", map[string]string{"Depth": "2"}, "", http.StatusBadRequest)
+	expectDavStatus(t, "PROPFIND", "/webdav", map[string]string{"Depth": "0"}, "<invalid", http.StatusBadRequest)
+	expectDavStatus(t, "PROPFIND", "/webdav/not-existing", map[string]string{"Depth": "0"}, "",
+		http.StatusNotFound)
+
+	ms := propfind(t, "/webdav/file.txt", "0", "")
+	if len(ms.Responses) != 1 || ms.Responses[0].Href != "/webdav/file.txt" ||
+		len(ms.Responses[0].Propstats) != 1 {
+		t.Fatal()
+	}
+	props := make(map[string]string)
+	for _, p := range ms.Responses[0].Propstats[0].Props.Props {
+		props[p.XMLName.Local] = p.Value
+	}
+	if props["getcontentlength"] != "7" || props["displayname"] != "file.txt" ||
+		!strings.HasPrefix(props["getcontenttype"], "text/plain") || props["mode"] != "0600" {
+		t.Fail()
+	}
+
+	ms = propfind(t, "/webdav", "1", "")
+	hrefs := make(map[string]bool)
+	for _, r := range ms.Responses {
+		hrefs[r.Href] = true
+	}
+	if len(hrefs) != 3 || !hrefs["/webdav/"] || !hrefs["/webdav/sub/"] || !hrefs["/webdav/file.txt"] {
+		t.Fail()
+	}
+
+	// selected and missing properties
+	ms = propfind(t, "/webdav/sub", "0", `<?xml version="1.0"?>
+		<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:unknown/></D:prop></D:propfind>`)
+	pss := ms.Responses[0].Propstats
+	if len(pss) != 2 || !strings.Contains(pss[0].Status, "200") || len(pss[0].Props.Props) != 1 ||
+		!strings.Contains(pss[0].Props.Props[0].Value, "collection") ||
+		!strings.Contains(pss[1].Status, "404") || pss[1].Props.Props[0].XMLName.Local != "unknown" {
+		t.Fail()
+	}
+}
+
+func TestWebdavProppatch(t *testing.T) {
+	ht := NewWebdav(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initWebdav(t)
+	update := func(props string) *testMultistatus {
+		rsp, b := davReq(t, "PROPPATCH", "/webdav/file.txt", nil, `<?xml version="1.0"?>
+			<D:propertyupdate xmlns:D="DAV:" xmlns:T="urn:x-tasked:">
+			<D:set><D:prop>`+props+`</D:prop></D:set></D:propertyupdate>`)
+		if rsp.StatusCode != http.StatusMultiStatus {
+			t.Fatal(rsp.StatusCode)
+		}
+		ms := new(testMultistatus)
+		err := xml.Unmarshal(b, ms)
+		tst.ErrFatal(t, err)
+		return ms
+	}
+	expectDavStatus(t, "PROPPATCH", "/webdav/file.txt", nil, "", http.StatusBadRequest)
+
+	ms := update("<T:mode>0640</T:mode>")
+	if !strings.Contains(ms.Responses[0].Propstats[0].Status, "200") {
+		t.Fail()
+	}
+	fi, err := os.Lstat(path.Join(dir, "file.txt"))
+	if err != nil || fi.Mode().Perm() != 0640 {
+		t.Fail()
+	}
+
+	// all or none
+	ms = update("<T:mode>0600</T:mode><D:getetag>x</D:getetag>")
+	pss := ms.Responses[0].Propstats
+	if len(pss) != 2 || !strings.Contains(pss[0].Status, "424") || !strings.Contains(pss[1].Status, "403") {
+		t.Fail()
+	}
+	fi, err = os.Lstat(path.Join(dir, "file.txt"))
+	if err != nil || fi.Mode().Perm() != 0640 {
+		t.Fail()
+	}
+}
+
+func TestWebdavMkcolPutDelete(t *testing.T) {
+	ht := NewWebdav(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initWebdav(t)
+	expectDavStatus(t, "MKCOL", "/webdav/sub", nil, "", http.StatusMethodNotAllowed)
+	expectDavStatus(t, "MKCOL", "/webdav/missing/dir", nil, "", http.StatusConflict)
+	expectDavStatus(t, "MKCOL", "/webdav/body", nil, "content", http.StatusUnsupportedMediaType)
+	expectDavStatus(t, "MKCOL", "/webdav/dir", nil, "", http.StatusCreated)
+	if fi, err := os.Lstat(path.Join(dir, "dir")); err != nil || !fi.IsDir() {
+		t.Fail()
+	}
+
+	expectDavStatus(t, "PUT", "/webdav/missing/file", nil, "content", http.StatusConflict)
+	expectDavStatus(t, "PUT", "/webdav/dir/file", nil, "content", http.StatusCreated)
+	expectDavStatus(t, "PUT", "/webdav/dir/file", nil, "new content", http.StatusNoContent)
+	checkFileContent(t, path.Join(dir, "dir/file"), "new content")
+
+	expectDavStatus(t, "DELETE", "/webdav/not-existing", nil, "", http.StatusNotFound)
+	expectDavStatus(t, "DELETE", "/", nil, "", http.StatusForbidden)
+	expectDavStatus(t, "DELETE", "/webdav/dir", nil, "", http.StatusNoContent)
+	if _, err := os.Lstat(path.Join(dir, "dir")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestWebdavCopyMove(t *testing.T) {
+	ht := NewWebdav(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initWebdav(t)
+	dest := func(p string) map[string]string {
+		return map[string]string{"Destination": tst.S.URL + p}
+	}
+	expectDavStatus(t, "COPY", "/webdav/file.txt", nil, "", http.StatusBadRequest)
+	expectDavStatus(t, "COPY", "/webdav/file.txt", map[string]string{"Destination": "http://other/webdav/copy"},
+		"", http.StatusBadGateway)
+	expectDavStatus(t, "COPY", "/webdav/file.txt", dest("/webdav/file.txt"), "", http.StatusForbidden)
+	expectDavStatus(t, "COPY", "/webdav/file.txt", dest("/webdav/missing/copy"), "", http.StatusConflict)
+	expectDavStatus(t, "COPY", "/webdav/sub", dest("/webdav/sub/copy"), "", http.StatusBadRequest)
+
+	expectDavStatus(t, "COPY", "/webdav/sub", dest("/webdav/copy"), "", http.StatusCreated)
+	checkFileContent(t, path.Join(dir, "copy/file"), "content")
+	expectDavStatus(t, "COPY", "/webdav/file.txt", map[string]string{
+		"Destination": tst.S.URL + "/webdav/copy",
+		"Overwrite":   "F"}, "", http.StatusPreconditionFailed)
+	expectDavStatus(t, "COPY", "/webdav/file.txt", dest("/webdav/copy"), "", http.StatusNoContent)
+	checkFileContent(t, path.Join(dir, "copy"), "content")
+
+	// depth 0 copies only the collection
+	expectDavStatus(t, "COPY", "/webdav/sub", map[string]string{
+		"Destination": tst.S.URL + "/webdav/empty",
+		"Depth":       "0"}, "", http.StatusCreated)
+	if fis, err := ioutil.ReadDir(path.Join(dir, "empty")); err != nil || len(fis) != 0 {
+		t.Fail()
+	}
+
+	expectDavStatus(t, "MOVE", "/webdav/sub", map[string]string{
+		"Destination": tst.S.URL + "/webdav/moved",
+		"Depth":       "0"}, "", http.StatusBadRequest)
+	expectDavStatus(t, "MOVE", "/webdav/sub", dest("/webdav/moved"), "", http.StatusCreated)
+	checkFileContent(t, path.Join(dir, "moved/file"), "content")
+	if _, err := os.Lstat(path.Join(dir, "sub")); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestWebdavOverwrite(t *testing.T) {
+	ht := NewWebdav(&testOptions{root: dn})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initWebdav(t)
+
+	// a directory replaced by a file
+	expectDavStatus(t, "COPY", "/webdav/file.txt", map[string]string{"Destination": tst.S.URL + "/webdav/sub"},
+		"", http.StatusNoContent)
+	checkFileContent(t, path.Join(dir, "sub"), "content")
+
+	// a failed copy leaves the destination intact, e.g. when the source contains a fifo
+	tst.EnsureDirF(t, path.Join(dir, "special"))
+	err := syscall.Mkfifo(path.Join(dir, "special/fifo"), 0600)
+	tst.ErrFatal(t, err)
+	rsp, _ := davReq(t, "COPY", "/webdav/special", map[string]string{"Destination": tst.S.URL + "/webdav/sub"}, "")
+	if rsp.StatusCode < http.StatusBadRequest {
+		t.Fail()
+	}
+	checkFileContent(t, path.Join(dir, "sub"), "content")
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 3 {
+		t.Fail()
+	}
+
+	// the replaced destination moved to the trash
+	ht = NewWebdav(&testOptions{root: dn, cachedir: cachedir, trash: true})
+	tst.Thnd.Sh = ht.ServeHTTP
+	_, tdir := initTrash(t)
+	tst.WithNewFileF(t, path.Join(dir, "other"), func(f *os.File) error {
+		_, err := f.Write([]byte("other content"))
+		return err
+	})
+	expectDavStatus(t, "MOVE", "/webdav/other", map[string]string{"Destination": tst.S.URL + "/webdav/file.txt"},
+		"", http.StatusNoContent)
+	checkFileContent(t, path.Join(dir, "file.txt"), "other content")
+	tis, err := trashItems(tdir)
+	tst.ErrFatal(t, err)
+	if len(tis) != 1 || tis[0].Path != "/webdav/file.txt" {
+		t.Fatal(tis)
+	}
+	checkFileContent(t, path.Join(tdir, tis[0].Id), "content")
+}
+
+func TestWebdavLock(t *testing.T) {
+	ht := NewWebdav(&testOptions{root: dn, cachedir: cachedir})
+	tst.Thnd.Sh = ht.ServeHTTP
+	dir := initWebdav(t)
+	lockinfo := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:">
+		<D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+	expectDavStatus(t, "LOCK", "/webdav/file.txt", nil, "", http.StatusBadRequest)
+	rsp, b := davReq(t, "LOCK", "/webdav/file.txt", map[string]string{"Timeout": "Second-60"}, lockinfo)
+	token := strings.Trim(rsp.Header.Get("Lock-Token"), "<>")
+	if rsp.StatusCode != http.StatusOK || !strings.HasPrefix(token, lockTokenScheme) ||
+		!strings.Contains(string(b), token) || !strings.Contains(string(b), "<D:exclusive/>") {
+		t.Fatal(rsp.StatusCode)
+	}
+	expectDavStatus(t, "LOCK", "/webdav/file.txt", nil, lockinfo, http.StatusLocked)
+	expectDavStatus(t, "PUT", "/webdav/file.txt", nil, "new content", http.StatusLocked)
+	expectDavStatus(t, "MOVE", "/webdav/sub/file", map[string]string{
+		"Destination": tst.S.URL + "/webdav/file.txt"}, "", http.StatusLocked)
+	expectDavStatus(t, "PUT", "/webdav/file.txt", map[string]string{
+		"If": "<" + tst.S.URL + "/webdav/file.txt> (<" + token + ">)"}, "new content", http.StatusNoContent)
+	checkFileContent(t, path.Join(dir, "file.txt"), "new content")
+
+	ms := propfind(t, "/webdav/file.txt", "0", `<?xml version="1.0"?>
+		<D:propfind xmlns:D="DAV:"><D:prop><D:lockdiscovery/></D:prop></D:propfind>`)
+	if !strings.Contains(ms.Responses[0].Propstats[0].Props.Props[0].Value, token) {
+		t.Fail()
+	}
+
+	// refresh
+	rsp, _ = davReq(t, "LOCK", "/webdav/file.txt", map[string]string{"If": "(<" + token + ">)"}, "")
+	if rsp.StatusCode != http.StatusOK {
+		t.Fail()
+	}
+
+	expectDavStatus(t, "UNLOCK", "/webdav/file.txt", map[string]string{"Lock-Token": "<" + token + ">"}, "",
+		http.StatusNoContent)
+	expectDavStatus(t, "PUT", "/webdav/file.txt", nil, "content", http.StatusNoContent)
+
+	// locking a not existing resource
+	expectDavStatus(t, "LOCK", "/webdav/new", nil, lockinfo, http.StatusCreated)
+	checkFileContent(t, path.Join(dir, "new"), "")
+	tst.RemoveIfExistsF(t, path.Join(cachedir, locksDir))
+}
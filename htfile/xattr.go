@@ -0,0 +1,139 @@
+package htfile
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// only the extended attributes in the user namespace can be read and set through the props
+const xattrUserPrefix = "user."
+
+var invalidXattrs = errors.New("Invalid extended attributes.")
+
+func listXattrs(p string) ([]string, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(p, buf)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func getXattr(p, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(p, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	v := make([]byte, size)
+	size, err = syscall.Getxattr(p, name, v)
+	if err != nil {
+		return nil, err
+	}
+	return v[:size], nil
+}
+
+// copies the extended attributes with the names starting with prefix
+func copyXattrs(from, to, prefix string) error {
+	names, err := listXattrs(from)
+	if err == syscall.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "listxattr", Path: from, Err: err}
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		v, err := getXattr(from, name)
+		if err != nil {
+			return &os.PathError{Op: "getxattr", Path: from, Err: err}
+		}
+		err = syscall.Setxattr(to, name, v, 0)
+		if err != nil {
+			return &os.PathError{Op: "setxattr", Path: to, Err: err}
+		}
+	}
+	return nil
+}
+
+// returns the user extended attributes of a file, except for the one storing the tags and the metadata.
+// When the file system doesn't support them, the result is empty.
+func userXattrs(p string) (map[string]string, error) {
+	names, err := listXattrs(p)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: p, Err: err}
+	}
+	m := make(map[string]string)
+	for _, name := range names {
+		if !strings.HasPrefix(name, xattrUserPrefix) || name == metaXattr {
+			continue
+		}
+		v, err := getXattr(p, name)
+		if err == syscall.ENODATA {
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: p, Err: err}
+		}
+		m[name] = string(v)
+	}
+	return m, nil
+}
+
+// reads the xattrs property of a MODPROPS request. A string value sets an attribute, null removes it. The
+// attribute storing the tags and the metadata can be changed only through the tags and meta properties.
+func getXattrProps(v interface{}) (map[string]*string, error) {
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, invalidXattrs
+	}
+	m := make(map[string]*string)
+	for name, vi := range mv {
+		if !strings.HasPrefix(name, xattrUserPrefix) || len(name) == len(xattrUserPrefix) || name == metaXattr {
+			return nil, invalidXattrs
+		}
+		switch vv := vi.(type) {
+		case nil:
+			m[name] = nil
+		case string:
+			m[name] = &vv
+		default:
+			return nil, invalidXattrs
+		}
+	}
+	return m, nil
+}
+
+// sets or removes the extended attributes. Removing a missing attribute is not an error.
+func applyXattrs(p string, m map[string]*string) error {
+	for name, v := range m {
+		if v == nil {
+			err := syscall.Removexattr(p, name)
+			if err != nil && err != syscall.ENODATA {
+				return &os.PathError{Op: "removexattr", Path: p, Err: err}
+			}
+			continue
+		}
+		err := syscall.Setxattr(p, name, []byte(*v), 0)
+		if err != nil {
+			return &os.PathError{Op: "setxattr", Path: p, Err: err}
+		}
+	}
+	return nil
+}
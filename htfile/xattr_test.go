@@ -0,0 +1,95 @@
+package htfile
+
+import (
+	tst "github.com/aryszka/tasked/testing"
+	"net/http"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func modprops(t *testing.T, relurl, body string, status int) {
+	tst.Htreq(t, "MODPROPS", tst.S.URL+relurl, tst.NewByteReaderString(body), func(rsp *http.Response) {
+		if rsp.StatusCode != status {
+			t.Log(relurl, body, rsp.StatusCode)
+			t.Fail()
+		}
+	})
+}
+
+func TestModpropsTimes(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxRequestBody: testMaxRequestBody})
+	tst.Thnd.Sh = ht.ServeHTTP
+	p := path.Join(dn, "some-file")
+	tst.WithNewFileF(t, p, nil)
+
+	modprops(t, "/some-file", "{\"modTime\": \"not a number\"}", http.StatusBadRequest)
+	modprops(t, "/some-file", "{\"accessTime\": -1}", http.StatusBadRequest)
+	modprops(t, "/some-file", "{\"modTime\": 1.5}", http.StatusBadRequest)
+
+	modprops(t, "/some-file", "{\"modTime\": 981173106, \"accessTime\": 981173107}", http.StatusOK)
+	m := getProps(t, "/some-file")
+	if m["modTime"] != float64(981173106) || m["accessTime"] != float64(981173107) {
+		t.Fail()
+	}
+
+	// the other time is kept
+	modprops(t, "/some-file", "{\"modTime\": 981173108}", http.StatusOK)
+	fi, err := os.Stat(p)
+	tst.ErrFatal(t, err)
+	if !fi.ModTime().Equal(time.Unix(981173108, 0)) || fi.Sys().(*syscall.Stat_t).Atim.Sec != 981173107 {
+		t.Fail()
+	}
+}
+
+func TestModpropsXattrs(t *testing.T) {
+	ht := New(&testOptions{root: dn, maxRequestBody: testMaxRequestBody})
+	tst.Thnd.Sh = ht.ServeHTTP
+	p := path.Join(dn, "some-file")
+	tst.RemoveIfExistsF(t, p)
+	tst.WithNewFileF(t, p, nil)
+	err := syscall.Setxattr(p, "user.test", []byte("value"), 0)
+	if err == syscall.ENOTSUP || err == syscall.EPERM {
+		t.Skip("extended attributes not supported")
+	}
+	tst.ErrFatal(t, err)
+
+	m := getProps(t, "/some-file")
+	xattrs, ok := m["xattrs"].(map[string]interface{})
+	if !ok || len(xattrs) != 1 || xattrs["user.test"] != "value" {
+		t.Fail()
+	}
+
+	modprops(t, "/some-file", "{\"xattrs\": \"value\"}", http.StatusBadRequest)
+	modprops(t, "/some-file", "{\"xattrs\": {\"trusted.test\": \"value\"}}", http.StatusBadRequest)
+	modprops(t, "/some-file", "{\"xattrs\": {\"user.\": \"value\"}}", http.StatusBadRequest)
+	modprops(t, "/some-file", "{\"xattrs\": {\"user.test\": 42}}", http.StatusBadRequest)
+
+	modprops(t, "/some-file", "{\"xattrs\": {\"user.test\": null, \"user.other\": \"other value\"}}",
+		http.StatusOK)
+	m = getProps(t, "/some-file")
+	xattrs, ok = m["xattrs"].(map[string]interface{})
+	if !ok || len(xattrs) != 1 || xattrs["user.other"] != "other value" {
+		t.Fail()
+	}
+
+	// kept when the file is overwritten
+	tst.Htreq(t, "PUT", tst.S.URL+"/some-file", tst.NewByteReaderString("new content"), func(rsp *http.Response) {
+		if rsp.StatusCode != http.StatusOK {
+			t.Fail()
+		}
+	})
+	m = getProps(t, "/some-file")
+	xattrs, ok = m["xattrs"].(map[string]interface{})
+	if !ok || len(xattrs) != 1 || xattrs["user.other"] != "other value" {
+		t.Fail()
+	}
+
+	// removing a missing attribute
+	modprops(t, "/some-file", "{\"xattrs\": {\"user.test\": null, \"user.other\": null}}", http.StatusOK)
+	if _, ok := getProps(t, "/some-file")["xattrs"]; ok {
+		t.Fail()
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/aryszka/tasked/htfile"
 	"github.com/aryszka/tasked/keyval"
 	"errors"
 	"flag"
@@ -34,11 +35,26 @@ const (
 
 	includeConfigKey = "include-config"
 
-	helpKey         = "help"
-	rootKey         = "root"
-	cachedirKey     = "cachedir"
-	allowCookiesKey = "allow-cookies"
-	runasKey        = "runas"
+	helpKey          = "help"
+	rootKey          = "root"
+	cachedirKey      = "cachedir"
+	uploadExpiryKey  = "upload-expiry"
+	maxUploadSizeKey = "max-upload-size"
+	allowCookiesKey  = "allow-cookies"
+	runasKey         = "runas"
+	fsyncFilesKey    = "fsync-files"
+	fsyncDirsKey     = "fsync-dirs"
+	trashKey         = "trash"
+	trashExpiryKey   = "trash-expiry"
+	trashMaxSizeKey  = "trash-max-size"
+	maxVersionsKey   = "max-versions"
+	versionExpiryKey = "version-expiry"
+	webdavKey        = "webdav"
+	symlinksKey      = "symlinks"
+	searchTypesKey   = "search-types"
+	searchIndexKey   = "search-index"
+	compressMinKey   = "compress-min-size"
+	mimeTypesKey     = "mime-types"
 
 	addressKey          = "address" // todo: document that address is a non-standard format
 	tlsKeyKey           = "tls-key"
@@ -61,10 +77,16 @@ const (
 	maxUserProcessesKey = "max-user-processes"
 	processIdleTimeKey  = "process-idle-time"
 
+	symlinksFollow   = "follow"
+	symlinksNever    = "never"
+	symlinksPreserve = "preserve"
+
 	defaultAddress          = ":9090"
 	defaultMaxRequestHeader = 1 << 20
 	defaultTokenValidity    = 60 * 60 * 24 * 80
 	defaultProcessIdleTime  = 360
+	defaultUploadExpiry     = 60 * 60 * 24
+	defaultTrashExpiry      = 60 * 60 * 24 * 30
 )
 
 var (
@@ -73,6 +95,7 @@ var (
 	missingCommand = errors.New("missing command")
 	invalidCommand = errors.New("invalid command")
 	invalidArgs    = errors.New("invalid args")
+	invalidOption  = errors.New("invalid option")
 	onFlagError    = flag.ExitOnError
 )
 
@@ -101,10 +124,25 @@ func (f *flg) IsBoolFlag() bool {
 type options struct {
 	command string
 
-	root         string
-	cachedir     string
-	allowCookies bool
-	runas        string
+	root          string
+	cachedir      string
+	uploadExpiry  int
+	maxUploadSize int64
+	allowCookies  bool
+	runas         string
+	fsyncFiles    bool
+	fsyncDirs     bool
+	trash         bool
+	trashExpiry   int
+	trashMaxSize  int64
+	maxVersions   int
+	versionExpiry int
+	webdav        bool
+	symlinks      string
+	searchTypes   string
+	searchIndex   int
+	compressMin   int
+	mimeTypes     string
 
 	address          string
 	tlsKey           string
@@ -138,11 +176,26 @@ func fieldOrFile(field string, fn string) ([]byte, error) {
 	return nil, nil
 }
 
-func (o *options) Command() string    { return o.command }
-func (o *options) Root() string       { return o.root }
-func (o *options) Cachedir() string   { return o.cachedir }
-func (o *options) AllowCookies() bool { return o.allowCookies }
-func (o *options) Runas() string      { return o.runas }
+func (o *options) Command() string      { return o.command }
+func (o *options) Root() string         { return o.root }
+func (o *options) Cachedir() string     { return o.cachedir }
+func (o *options) UploadExpiry() int    { return o.uploadExpiry }
+func (o *options) MaxUploadSize() int64 { return o.maxUploadSize }
+func (o *options) AllowCookies() bool   { return o.allowCookies }
+func (o *options) Runas() string        { return o.runas }
+func (o *options) FsyncFiles() bool     { return o.fsyncFiles }
+func (o *options) FsyncDirs() bool      { return o.fsyncDirs }
+func (o *options) Trash() bool          { return o.trash }
+func (o *options) TrashExpiry() int     { return o.trashExpiry }
+func (o *options) TrashMaxSize() int64  { return o.trashMaxSize }
+func (o *options) MaxVersions() int     { return o.maxVersions }
+func (o *options) VersionExpiry() int   { return o.versionExpiry }
+func (o *options) Webdav() bool         { return o.webdav }
+func (o *options) Symlinks() string     { return o.symlinks }
+func (o *options) SearchTypes() string  { return o.searchTypes }
+func (o *options) SearchIndex() int     { return o.searchIndex }
+func (o *options) CompressMinSize() int { return o.compressMin }
+func (o *options) MimeTypes() string    { return o.mimeTypes }
 
 func (o *options) Address() string          { return o.address }
 func (o *options) TlsKey() ([]byte, error)  { return fieldOrFile(o.tlsKey, o.tlsKeyFile) }
@@ -199,8 +252,23 @@ func parseFlags() ([]*keyval.Entry, []string) {
 		&flg{key: helpKey, isBool: true},
 		&flg{key: rootKey},
 		&flg{key: cachedirKey},
+		&flg{key: uploadExpiryKey},
+		&flg{key: maxUploadSizeKey},
 		&flg{key: allowCookiesKey, isBool: true},
 		&flg{key: runasKey},
+		&flg{key: fsyncFilesKey, isBool: true},
+		&flg{key: fsyncDirsKey, isBool: true},
+		&flg{key: trashKey, isBool: true},
+		&flg{key: trashExpiryKey},
+		&flg{key: trashMaxSizeKey},
+		&flg{key: maxVersionsKey},
+		&flg{key: versionExpiryKey},
+		&flg{key: webdavKey, isBool: true},
+		&flg{key: symlinksKey},
+		&flg{key: searchTypesKey},
+		&flg{key: searchIndexKey},
+		&flg{key: compressMinKey},
+		&flg{key: mimeTypesKey},
 
 		&flg{key: addressKey},
 		&flg{key: tlsKeyKey},
@@ -270,6 +338,8 @@ func applyDefaults(o *options) {
 	o.maxRequestHeader = defaultMaxRequestHeader
 	o.tokenValidity = defaultTokenValidity
 	o.processIdleTime = defaultProcessIdleTime
+	o.uploadExpiry = defaultUploadExpiry
+	o.trashExpiry = defaultTrashExpiry
 }
 
 func applyFreeArgs(o *options, args []string) error {
@@ -297,6 +367,18 @@ func parseOptions(o *options, e []*keyval.Entry) error {
 			o.root = ei.Val
 		case cachedirKey:
 			o.cachedir = ei.Val
+		case uploadExpiryKey:
+			v, err := strconv.ParseInt(ei.Val, 0, 32)
+			if err != nil {
+				return err
+			}
+			o.uploadExpiry = int(v)
+		case maxUploadSizeKey:
+			v, err := strconv.ParseInt(ei.Val, 0, 64)
+			if err != nil {
+				return err
+			}
+			o.maxUploadSize = v
 		case allowCookiesKey:
 			v, err := strconv.ParseBool(ei.Val)
 			if err != nil {
@@ -305,6 +387,77 @@ func parseOptions(o *options, e []*keyval.Entry) error {
 			o.allowCookies = v
 		case runasKey:
 			o.runas = ei.Val
+		case fsyncFilesKey:
+			v, err := strconv.ParseBool(ei.Val)
+			if err != nil {
+				return err
+			}
+			o.fsyncFiles = v
+		case fsyncDirsKey:
+			v, err := strconv.ParseBool(ei.Val)
+			if err != nil {
+				return err
+			}
+			o.fsyncDirs = v
+		case trashKey:
+			v, err := strconv.ParseBool(ei.Val)
+			if err != nil {
+				return err
+			}
+			o.trash = v
+		case trashExpiryKey:
+			v, err := strconv.ParseInt(ei.Val, 0, 32)
+			if err != nil {
+				return err
+			}
+			o.trashExpiry = int(v)
+		case trashMaxSizeKey:
+			v, err := strconv.ParseInt(ei.Val, 0, 64)
+			if err != nil {
+				return err
+			}
+			o.trashMaxSize = v
+		case maxVersionsKey:
+			v, err := strconv.ParseInt(ei.Val, 0, 32)
+			if err != nil {
+				return err
+			}
+			o.maxVersions = int(v)
+		case versionExpiryKey:
+			v, err := strconv.ParseInt(ei.Val, 0, 32)
+			if err != nil {
+				return err
+			}
+			o.versionExpiry = int(v)
+		case webdavKey:
+			v, err := strconv.ParseBool(ei.Val)
+			if err != nil {
+				return err
+			}
+			o.webdav = v
+		case symlinksKey:
+			switch ei.Val {
+			case symlinksFollow, symlinksNever, symlinksPreserve:
+			default:
+				return invalidOption
+			}
+			o.symlinks = ei.Val
+		case searchTypesKey:
+			o.searchTypes = ei.Val
+		case searchIndexKey:
+			v, err := strconv.ParseInt(ei.Val, 0, 32)
+			if err != nil {
+				return err
+			}
+			o.searchIndex = int(v)
+		case compressMinKey:
+			v, err := strconv.ParseInt(ei.Val, 0, 32)
+			if err != nil {
+				return err
+			}
+			o.compressMin = int(v)
+		case mimeTypesKey:
+			o.mimeTypes = ei.Val
 
 		// http
 		case addressKey:
@@ -413,5 +566,9 @@ func readOptions() (*options, error) {
 		printUsage()
 		return nil, err
 	}
+	err = htfile.CheckMimeTypes(o.mimeTypes)
+	if err != nil {
+		return nil, err
+	}
 	return o, nil
 }
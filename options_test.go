@@ -131,8 +131,23 @@ func TestParseFlags(t *testing.T) {
 		"-" + helpKey,
 		"-" + rootKey, "some-file-0",
 		"-" + cachedirKey, "some-file-1",
+		"-" + uploadExpiryKey, "21",
+		"-" + maxUploadSizeKey, "41",
 		"-" + allowCookiesKey,
 		"-" + runasKey, "testuser",
+		"-" + fsyncFilesKey,
+		"-" + fsyncDirsKey,
+		"-" + trashKey,
+		"-" + trashExpiryKey, "22",
+		"-" + trashMaxSizeKey, "23",
+		"-" + maxVersionsKey, "24",
+		"-" + versionExpiryKey, "25",
+		"-" + webdavKey,
+		"-" + symlinksKey, "never",
+		"-" + searchTypesKey, "text/*",
+		"-" + searchIndexKey, "26",
+		"-" + compressMinKey, "27",
+		"-" + mimeTypesKey, "some-file-8",
 
 		"-" + addressKey, "some-file-2",
 		"-" + tlsKeyKey, "some-data-0",
@@ -163,8 +178,23 @@ func TestParseFlags(t *testing.T) {
 		&keyval.Entry{Key: helpKey, Val: "true"},
 		&keyval.Entry{Key: rootKey, Val: "some-file-0"},
 		&keyval.Entry{Key: cachedirKey, Val: "some-file-1"},
+		&keyval.Entry{Key: uploadExpiryKey, Val: "21"},
+		&keyval.Entry{Key: maxUploadSizeKey, Val: "41"},
 		&keyval.Entry{Key: allowCookiesKey, Val: "true"},
 		&keyval.Entry{Key: runasKey, Val: "testuser"},
+		&keyval.Entry{Key: fsyncFilesKey, Val: "true"},
+		&keyval.Entry{Key: fsyncDirsKey, Val: "true"},
+		&keyval.Entry{Key: trashKey, Val: "true"},
+		&keyval.Entry{Key: trashExpiryKey, Val: "22"},
+		&keyval.Entry{Key: trashMaxSizeKey, Val: "23"},
+		&keyval.Entry{Key: maxVersionsKey, Val: "24"},
+		&keyval.Entry{Key: versionExpiryKey, Val: "25"},
+		&keyval.Entry{Key: webdavKey, Val: "true"},
+		&keyval.Entry{Key: symlinksKey, Val: "never"},
+		&keyval.Entry{Key: searchTypesKey, Val: "text/*"},
+		&keyval.Entry{Key: searchIndexKey, Val: "26"},
+		&keyval.Entry{Key: compressMinKey, Val: "27"},
+		&keyval.Entry{Key: mimeTypesKey, Val: "some-file-8"},
 
 		&keyval.Entry{Key: addressKey, Val: "some-file-2"},
 		&keyval.Entry{Key: tlsKeyKey, Val: "some-data-0"},
@@ -243,7 +273,9 @@ func TestApplyDefaults(t *testing.T) {
 	if o.address != defaultAddress ||
 		o.maxRequestHeader != defaultMaxRequestHeader ||
 		o.tokenValidity != defaultTokenValidity ||
-		o.processIdleTime != defaultProcessIdleTime {
+		o.processIdleTime != defaultProcessIdleTime ||
+		o.uploadExpiry != defaultUploadExpiry ||
+		o.trashExpiry != defaultTrashExpiry {
 		t.Fail()
 	}
 }
@@ -287,6 +319,19 @@ func TestParseOptions(t *testing.T) {
 		o.cachedir != "" ||
 		o.maxSearchResults != 0 ||
 		o.runas != "" ||
+		o.fsyncFiles ||
+		o.fsyncDirs ||
+		o.trash ||
+		o.trashExpiry != 0 ||
+		o.trashMaxSize != 0 ||
+		o.maxVersions != 0 ||
+		o.versionExpiry != 0 ||
+		o.webdav ||
+		o.symlinks != "" ||
+		o.searchTypes != "" ||
+		o.searchIndex != 0 ||
+		o.compressMin != 0 ||
+		o.mimeTypes != "" ||
 
 		o.address != "" ||
 		o.tlsKey != "" ||
@@ -298,6 +343,8 @@ func TestParseOptions(t *testing.T) {
 		o.maxRequestHeader != 0 ||
 		o.proxy != "" ||
 		o.proxyFile != "" ||
+		o.uploadExpiry != 0 ||
+		o.maxUploadSize != 0 ||
 
 		o.authenticate ||
 		o.publicUser != "" ||
@@ -320,6 +367,19 @@ func TestParseOptions(t *testing.T) {
 		&keyval.Entry{Key: cachedirKey, Val: "some-file-1"},
 		&keyval.Entry{Key: maxSearchResultsKey, Val: "15"},
 		&keyval.Entry{Key: runasKey, Val: "testuser"},
+		&keyval.Entry{Key: fsyncFilesKey, Val: "true"},
+		&keyval.Entry{Key: fsyncDirsKey, Val: "true"},
+		&keyval.Entry{Key: trashKey, Val: "true"},
+		&keyval.Entry{Key: trashExpiryKey, Val: "22"},
+		&keyval.Entry{Key: trashMaxSizeKey, Val: "23"},
+		&keyval.Entry{Key: maxVersionsKey, Val: "24"},
+		&keyval.Entry{Key: versionExpiryKey, Val: "25"},
+		&keyval.Entry{Key: webdavKey, Val: "true"},
+		&keyval.Entry{Key: symlinksKey, Val: "never"},
+		&keyval.Entry{Key: searchTypesKey, Val: "text/*"},
+		&keyval.Entry{Key: searchIndexKey, Val: "26"},
+		&keyval.Entry{Key: compressMinKey, Val: "27"},
+		&keyval.Entry{Key: mimeTypesKey, Val: "some-file-8"},
 
 		&keyval.Entry{Key: addressKey, Val: "some-file-2"},
 		&keyval.Entry{Key: tlsKeyKey, Val: "some-data-0"},
@@ -331,6 +391,8 @@ func TestParseOptions(t *testing.T) {
 		&keyval.Entry{Key: maxRequestHeaderKey, Val: "17"},
 		&keyval.Entry{Key: proxyKey, Val: "{}"},
 		&keyval.Entry{Key: proxyFileKey, Val: "some-file-5"},
+		&keyval.Entry{Key: uploadExpiryKey, Val: "21"},
+		&keyval.Entry{Key: maxUploadSizeKey, Val: "41"},
 
 		&keyval.Entry{Key: authenticateKey, Val: "true"},
 		&keyval.Entry{Key: publicUserKey, Val: "some-user"},
@@ -346,6 +408,19 @@ func TestParseOptions(t *testing.T) {
 		o.cachedir != "some-file-1" ||
 		o.maxSearchResults != 15 ||
 		o.runas != "testuser" ||
+		!o.fsyncFiles ||
+		!o.fsyncDirs ||
+		!o.trash ||
+		o.trashExpiry != 22 ||
+		o.trashMaxSize != 23 ||
+		o.maxVersions != 24 ||
+		o.versionExpiry != 25 ||
+		!o.webdav ||
+		o.symlinks != "never" ||
+		o.searchTypes != "text/*" ||
+		o.searchIndex != 26 ||
+		o.compressMin != 27 ||
+		o.mimeTypes != "some-file-8" ||
 
 		o.address != "some-file-2" ||
 		o.tlsKey != "some-data-0" ||
@@ -357,6 +432,8 @@ func TestParseOptions(t *testing.T) {
 		o.maxRequestHeader != 17 ||
 		o.proxy != "{}" ||
 		o.proxyFile != "some-file-5" ||
+		o.uploadExpiry != 21 ||
+		o.maxUploadSize != 41 ||
 
 		!o.authenticate ||
 		o.publicUser != "some-user" ||
@@ -398,6 +475,20 @@ func TestParseOptions(t *testing.T) {
 		t.Fail()
 	}
 
+	// parse enumerated
+	o = new(options)
+	err = parseOptions(o, []*keyval.Entry{
+		&keyval.Entry{Key: symlinksKey, Val: "nevr"}})
+	if err == nil {
+		t.Fail()
+	}
+	o = new(options)
+	err = parseOptions(o, []*keyval.Entry{
+		&keyval.Entry{Key: symlinksKey, Val: "preserve"}})
+	if err != nil || o.symlinks != "preserve" {
+		t.Fail()
+	}
+
 	// parse bool
 	o = new(options)
 	err = parseOptions(o, []*keyval.Entry{
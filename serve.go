@@ -13,9 +13,15 @@ import (
 	"net"
 )
 
+// the file handlers need to be closed to stop their background work
+type closer interface {
+	Close()
+}
+
 type server struct {
 	l net.Listener
 	p *htproc.ProcFilter
+	c closer
 	q chan int
 }
 
@@ -48,20 +54,23 @@ func runasUser(un string) error {
 	}
 }
 
-func createHandler(o *options, a *auth.It) (http.Handler, *htproc.ProcFilter) {
+func createHandler(o *options, a *auth.It) (http.Handler, *htproc.ProcFilter, closer) {
 	var root http.Handler
 	if o.Root() == "" {
 		// root = htio.New(o)
+	} else if o.Webdav() {
+		root = htfile.NewWebdav(o)
 	} else {
 		root = htfile.New(o)
 	}
+	c, _ := root.(closer)
 	if a == nil {
-		return root, nil
+		return root, nil, c
 	}
 	ha := htauth.New(a, o)
 	p := htproc.New(o)
 	hf := EndFilter(root)
-	return CascadeFilters(ha, p, hf), p
+	return CascadeFilters(ha, p, hf), p, c
 }
 
 func (s *server) run(o *options, h http.Handler) error {
@@ -76,6 +85,9 @@ func (s *server) run(o *options, h http.Handler) error {
 		hs.MaxHeaderBytes = o.MaxRequestHeader()
 		es <- hs.Serve(s.l)
 	}()
+	if s.c != nil {
+		defer s.c.Close()
+	}
 	select {
 	case err := <-ep:
 		Doretlog42(s.l.Close)
@@ -99,6 +111,7 @@ func (s *server) serve(o *options) error {
 		a *auth.It
 		h http.Handler
 		p *htproc.ProcFilter
+		c closer
 		l net.Listener
 		err error
 	)
@@ -110,11 +123,12 @@ func (s *server) serve(o *options) error {
 			return err
 		}
 	}
-	h, p = createHandler(o, a)
+	h, p, c = createHandler(o, a)
 	if l, err = listen(o); err != nil {
 		return err
 	}
 	s.p = p
+	s.c = c
 	s.l = l
 	return s.run(o, h)
 }
@@ -46,8 +46,8 @@ func TestCreateHandler(t *testing.T) {
 	// no auth
 	o := new(options)
 	o.root = path.Join(Testdir, "root")
-	h, p := createHandler(o, nil)
-	if h == nil || p != nil {
+	h, p, c := createHandler(o, nil)
+	if h == nil || p != nil || c == nil {
 		t.Fail()
 	}
 
@@ -57,12 +57,18 @@ func TestCreateHandler(t *testing.T) {
 	a := auth.New(
 		auth.PasswordCheckerFunc(authPam),
 		new(authOptions))
-	h, p = createHandler(o, a)
-	if h == nil || p == nil {
+	h, p, c = createHandler(o, a)
+	if h == nil || p == nil || c == nil {
 		t.Fail()
 	}
 }
 
+type testCloser struct {
+	closed bool
+}
+
+func (c *testCloser) Close() { c.closed = true }
+
 func TestRun(t *testing.T) {
 	// no proc filter
 	s := newServer()
@@ -106,6 +112,32 @@ func TestRun(t *testing.T) {
 		close(s.q)
 		<-done
 	})
+
+	// closing the handler
+	s = newServer()
+	o = new(options)
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){})
+	l, err = net.Listen("tcp", ":9099")
+	ErrFatal(t, err)
+	s.l = l
+	c := new(testCloser)
+	s.c = c
+	WithTimeout(t, 240 * time.Millisecond, func() {
+		done := make(chan int)
+		go func() {
+			err := s.run(o, h)
+			if err != nil {
+				t.Fail()
+			}
+			done <- 0
+		}()
+		<-time.After(120 * time.Millisecond)
+		close(s.q)
+		<-done
+	})
+	if !c.closed {
+		t.Fail()
+	}
 }
 
 func TestServe(t *testing.T) {
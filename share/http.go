@@ -20,6 +20,18 @@ const (
 	HttpCmdMkdir    = "mkdir"
 	HttpCmdCopy     = "copy"
 	HttpCmdRename   = "rename"
+	HttpCmdUpload   = "upload"
+	HttpCmdAppend   = "append"
+	HttpCmdArchive  = "archive"
+	HttpCmdExtract  = "extract"
+	HttpCmdVerify   = "verify"
+	HttpCmdTrash    = "trash"
+	HttpCmdRestore  = "restore"
+	HttpCmdPurge    = "purge"
+	HttpCmdVersions = "versions"
+	HttpCmdSymlink  = "symlink"
+	HttpCmdIndex    = "index"
+	HttpCmdDu       = "du"
 	HttpCmdAuth     = "auth"
 	HttpCmdAll      = "all_"
 )
@@ -33,9 +45,24 @@ var (
 		HttpCmdMkdir,
 		HttpCmdCopy,
 		HttpCmdRename,
+		HttpCmdUpload,
+		HttpCmdAppend,
+		HttpCmdArchive,
+		HttpCmdExtract,
+		HttpCmdVerify,
+		HttpCmdTrash,
+		HttpCmdRestore,
+		HttpCmdPurge,
+		HttpCmdVersions,
+		HttpCmdSymlink,
+		HttpCmdIndex,
+		HttpCmdDu,
 		HttpCmdAuth}
 	HeaderContentType         = http.CanonicalHeaderKey("content-type")
 	HeaderContentLength       = http.CanonicalHeaderKey("content-length")
+	HeaderEtag                = http.CanonicalHeaderKey("etag")
+	HeaderIfMatch             = http.CanonicalHeaderKey("if-match")
+	HeaderIfNoneMatch         = http.CanonicalHeaderKey("if-none-match")
 	JsonContentType           = "application/json; charset=utf-8"
 	maxReadExceeded           = errors.New("Maximum read count exceeded.")
 	MarshalError        error = errors.New("Marshaling error.")
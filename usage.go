@@ -7,7 +7,22 @@ include-config     filename none
 # general
 root               filename none # also as default parameter, when not set then serving stdio
 cachedir           filename none
+upload-expiry      seconds  60 * 60 * 24 # resumable uploads are kept in cachedir/uploads
+max-upload-size    int      none # total size of a resumable upload, max-request-body limits the chunks
 max-search-results int      0 # search disabled default
+fsync-files        bool     false # sync uploaded files to disk before moving them in place
+fsync-dirs         bool     false # sync the containing directory after moving uploads in place
+trash              bool     false # deleted items are moved to cachedir/trash
+trash-expiry       seconds  60 * 60 * 24 * 30 # trash items older than this are purged
+trash-max-size     int      unlimited # the oldest trash items are purged over this size
+max-versions       int      none # previous versions of overwritten files kept in cachedir/versions
+version-expiry     seconds  none # previous versions older than this are removed
+webdav             bool     false # serving the root over webdav instead of the native api
+symlinks           string   follow # follow: only within the root, never: not followed, preserve: copied as links
+search-types       string   text types # media types searched by content, comma separated, e.g. text/*,application/json
+search-index       seconds  none # rescan interval of the persistent search index in cachedir
+compress-min-size  int      1024 # smaller responses are not gzip compressed, negative: no compression
+mime-types         string   none # file mapping extensions to media types, e.g. md = text/markdown; charset=utf-8; text
 
 # http
 address            string   :9090 # when filename, then unix socket